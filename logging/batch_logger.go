@@ -1,38 +1,143 @@
 package logging
 
 import (
+	"context"
 	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// OverflowPolicy determines what a batchLogger does when a log entry is enqueued while its queue is full
+type OverflowPolicy int
+
+const (
+	// Enqueue will block until there is space in the queue for the new log entry
+	BlockOnOverflow OverflowPolicy = iota
+
+	// The new log entry will be dropped, and Enqueue will return immediately
+	DropNewestOnOverflow
+
+	// The oldest log entry in the queue will be dropped to make space for the new log entry, and Enqueue will return immediately
+	DropOldestOnOverflow
+)
+
 // A batchLogger receives log entries via its Enqueue method & arranges them into batches that it then passes to its batchHandler
 type batchLogger struct {
-	queue         chan *LogEntry // A channel down which LogEntrys will be queued to be sent to Firetail
-	maxBatchSize  int            // The maximum size of a batch in bytes
-	maxLogAge     time.Duration  // The maximum age of a log item to hold onto
-	batchCallback func([][]byte) // A handler that takes a batch of log entries as a slice of slices of bytes & sends them to Firetail
+	queue          chan *LogEntry // A channel down which LogEntrys will be queued to be sent to Firetail
+	overflowPolicy OverflowPolicy // What to do with new log entries when the queue is full
+	maxBatchSize   int            // The maximum size of a batch in bytes
+	maxLogAge      time.Duration  // The maximum age of a log item to hold onto
+	batchCallback  func([][]byte) // A handler that takes a batch of log entries as a slice of slices of bytes & sends them to Firetail
+	sink           Sink           // The sink to which the batchCallback writes batches, if a BatchCallback wasn't provided, closed by Close
+	stats          batchLoggerStats
+
+	flushRequests chan chan struct{} // A channel down which Flush asks the worker to send its current batch, & waits for a reply
+	inFlightMutex sync.Mutex         // Guards inFlight & idle
+	inFlight      int                // The number of batchCallback goroutines which are yet to return
+	idle          chan struct{}      // Closed whenever there are no batchCallback goroutines in progress
+	closeOnce     sync.Once          // Ensures the stop channel is only closed once
+	closeMutex    sync.RWMutex       // Held for reading by Enqueue whilst it checks closed & joins enqueuers, & for writing by Close whilst setting closed
+	closed        bool               // Set by Close, after which Enqueue drops log entries; guarded by closeMutex
+	enqueuers     sync.WaitGroup     // The calls to Enqueue in progress, which the worker waits for before its final drain
+	sinkCloseOnce sync.Once          // Ensures the sink is only closed once
+	sinkCloseErr  error              // The error returned when the sink was closed
+	stop          chan struct{}      // Closed by Close to tell the worker to send its current batch & exit
+	stopped       chan struct{}      // Closed by the worker once it has exited
+}
+
+// batchLoggerStats holds the counters reported by a batchLogger's Stats method, which may be updated from several goroutines at once
+type batchLoggerStats struct {
+	enqueuedEntries  atomic.Uint64
+	droppedEntries   atomic.Uint64
+	discardedEntries atomic.Uint64
+	batchesCreated   atomic.Uint64
+}
+
+// BatchLoggerStats is a snapshot of the counters kept by a batchLogger, returned by its Stats method
+type BatchLoggerStats struct {
+	QueueLength      int    // The number of log entries currently waiting in the queue
+	QueueCapacity    int    // The maximum number of log entries the queue can hold
+	EnqueuedEntries  uint64 // The total number of log entries which have been added to the queue
+	DroppedEntries   uint64 // The total number of log entries which were dropped because the queue was full
+	DiscardedEntries uint64 // The total number of log entries which were discarded because they couldn't be marshalled or were larger than the max batch size
+	BatchesCreated   uint64 // The total number of batches which have been passed to the batch callback
+	BatchesSent      uint64 // The total number of batches which were sent to the Firetail logging API, including those replayed from the spool
+	BatchesFailed    uint64 // The total number of batches which failed to send to the Firetail logging API after all of their retries
+	Retries          uint64 // The total number of times sending a batch to the Firetail logging API was retried, including replays from the spool
 }
 
 // BatchLoggerOptions is an options struct used by the NewBatchLogger constructor
 type BatchLoggerOptions struct {
-	MaxBatchSize  int            // The maximum size of a batch in bytes
-	MaxLogAge     time.Duration  // The maximum age of a log item in a batch - once an item is older than this, the batch is passed to the callback
-	LogApiKey     string         // The API key used by the default BatchCallback used to send logs to the Firetail logging API
-	LogApiUrl     string         // The URL of the Firetail logging API endpoint to send log entries to
-	BatchCallback func([][]byte) // An optional callback to which batches will be passed; the default callback sends logs to the Firetail logging API
+	MaxBatchSize   int            // The maximum size of a batch in bytes, before any compression by the default BatchCallback's Compressor
+	MaxLogAge      time.Duration  // The maximum age of a log item in a batch - once an item is older than this, the batch is passed to the callback
+	QueueCapacity  int            // The maximum number of log entries which can be waiting to be added to a batch; the default value is 1024
+	OverflowPolicy OverflowPolicy // What to do with new log entries when the queue is full; the default is to block until there's space
+	LogApiKey      string         // The API key used by the default BatchCallback used to send logs to the Firetail logging API
+	LogApiUrl      string         // The URL of the Firetail logging API endpoint to send log entries to
+	BatchCallback  func([][]byte) // An optional callback to which batches will be passed; the default callback writes them to the Sink
+	Sink           Sink           // An optional Sink to which batches will be written if no BatchCallback is provided; the default is a NewFiretailSink
+
+	// SpoolDirectory is an optional directory in which the default BatchCallback will persist batches it fails to send, so that they can be
+	// replayed once the Firetail logging API can be reached again, including after the process has been restarted. If unset, batches which
+	// can't be sent are dropped
+	SpoolDirectory string
+
+	SpoolMaxSize        int64         // The maximum total size of the batches in the spool in bytes, beyond which the oldest are dropped; the default value is 64MB
+	SpoolMaxAge         time.Duration // The maximum age of a batch in the spool, after which it is dropped; the default value is 24 hours
+	SpoolBaseRetryDelay time.Duration // How long to wait before replaying the spool after a failed attempt, doubled for each consecutive failure; the default value is 1 second
+	SpoolMaxRetryDelay  time.Duration // The maximum delay between attempts to replay the spool; the default value is 5 minutes
+
+	// HTTPClient is the client used by the default BatchCallback to send logs to the Firetail logging API. It can be used to configure
+	// proxies, client certificates, custom CA bundles etc. via its Transport. The default is a http.Client with a 30 second timeout
+	HTTPClient *http.Client
+
+	// RequestSigner is an optional hook which the default BatchCallback calls with each request to the Firetail logging API just before
+	// it's sent, e.g. to add signature headers for an egress gateway. The request's body can be read via its GetBody method. If it returns
+	// an error, the batch is not sent and isn't retried
+	RequestSigner func(*http.Request) error
+
+	// Compressor is an optional Compressor which the default BatchCallback uses to compress the body of its requests to the Firetail logging
+	// API, setting the Content-Encoding header accordingly, e.g. GzipCompressor(gzip.DefaultCompression). If unset, batches are sent
+	// uncompressed
+	Compressor Compressor
+
+	RetryPolicy *RetryPolicy     // How the default BatchCallback retries batches after a retryable failure; the default is DefaultRetryPolicy
+	ErrCallback func(BatchError) // An optional callback which the default BatchCallback passes batches it fails to send to; the default logs them
 }
 
 // NewBatchLogger creates a new batchLogger with the provided options
 func NewBatchLogger(options BatchLoggerOptions) *batchLogger {
+	queueCapacity := 1024
+	if options.QueueCapacity > 0 {
+		queueCapacity = options.QueueCapacity
+	}
+
 	newLogger := &batchLogger{
-		queue:         make(chan *LogEntry),
-		maxBatchSize:  options.MaxBatchSize,
-		maxLogAge:     options.MaxLogAge,
-		batchCallback: options.BatchCallback,
+		queue:          make(chan *LogEntry, queueCapacity),
+		overflowPolicy: options.OverflowPolicy,
+		maxBatchSize:   options.MaxBatchSize,
+		maxLogAge:      options.MaxLogAge,
+		batchCallback:  options.BatchCallback,
+		flushRequests:  make(chan chan struct{}),
+		idle:           make(chan struct{}),
+		stop:           make(chan struct{}),
+		stopped:        make(chan struct{}),
 	}
+	close(newLogger.idle)
 
 	if options.BatchCallback == nil {
-		newLogger.batchCallback = getDefaultBatchCallback(options)
+		newLogger.sink = options.Sink
+		if newLogger.sink == nil {
+			newLogger.sink = NewFiretailSink(options)
+		}
+		newLogger.batchCallback = func(batch [][]byte) {
+			if err := newLogger.sink.WriteBatch(batch); err != nil {
+				log.Println("Error writing logs to sink: ", err)
+			}
+		}
 	}
 
 	go newLogger.worker()
@@ -40,89 +145,268 @@ func NewBatchLogger(options BatchLoggerOptions) *batchLogger {
 	return newLogger
 }
 
-// Enqueue enqueues a logentry to be batched & sent to Firetail. Should normally be run in a new goroutine as it blocks until another routine receives from l.queue.
+// Enqueue enqueues a logentry to be batched & sent to Firetail. If the queue is full, what happens depends upon the batchLogger's
+// OverflowPolicy; by default it blocks until there's space in the queue. Log entries enqueued after the batchLogger has been closed,
+// or which are still waiting for space in the queue when it's closed, are dropped.
 func (l *batchLogger) Enqueue(logEntry *LogEntry) {
-	l.queue <- logEntry
+	// The worker waits for every Enqueue which started before Close to return before its final drain, so an entry we enqueue can't arrive
+	// after it. We don't hold the lock whilst waiting for space in the queue, so that a blocked Enqueue can't hold up Close
+	l.closeMutex.RLock()
+	if l.closed {
+		l.closeMutex.RUnlock()
+		l.stats.droppedEntries.Add(1)
+		return
+	}
+	l.enqueuers.Add(1)
+	l.closeMutex.RUnlock()
+	defer l.enqueuers.Done()
+
+	switch l.overflowPolicy {
+	case DropNewestOnOverflow:
+		select {
+		case l.queue <- logEntry:
+		default:
+			l.stats.droppedEntries.Add(1)
+			return
+		}
+
+	case DropOldestOnOverflow:
+		for {
+			select {
+			case l.queue <- logEntry:
+				l.stats.enqueuedEntries.Add(1)
+				return
+			default:
+			}
+			// The queue is full, so take the oldest entry out of it to make space; the worker may have beaten us to it, in which case
+			// there'll be space for our new entry on the next attempt anyway
+			select {
+			case <-l.queue:
+				l.stats.droppedEntries.Add(1)
+			default:
+			}
+		}
+
+	default:
+		select {
+		case l.queue <- logEntry:
+		case <-l.stop:
+			// Close was called whilst we were waiting for space in the queue
+			l.stats.droppedEntries.Add(1)
+			return
+		}
+	}
+
+	l.stats.enqueuedEntries.Add(1)
+}
+
+// Flush passes all of the log entries currently held by the batchLogger to its batch callback, then waits for all of the batch callbacks
+// which are in progress to return. If the context expires first, its error is returned.
+func (l *batchLogger) Flush(ctx context.Context) error {
+	flushed := make(chan struct{})
+	select {
+	case l.flushRequests <- flushed:
+	case <-l.stopped:
+		// If the worker has already exited then it's already sent everything it had
+		return l.waitForBatchCallbacks(ctx)
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	select {
+	case <-flushed:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	return l.waitForBatchCallbacks(ctx)
+}
+
+// Close stops the batchLogger from accepting any more log entries, passes all of the log entries it currently holds to its batch callback,
+// then waits for all of the batch callbacks which are in progress to return before closing its sink. If the context expires first, its error
+// is returned.
+func (l *batchLogger) Close(ctx context.Context) error {
+	l.closeOnce.Do(func() {
+		// Once closed is set, no more calls to Enqueue can start, so the worker knows which to wait for before it drains the queue
+		l.closeMutex.Lock()
+		l.closed = true
+		l.closeMutex.Unlock()
+		close(l.stop)
+	})
+
+	select {
+	case <-l.stopped:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	if err := l.waitForBatchCallbacks(ctx); err != nil {
+		return err
+	}
+
+	// The sink can only be closed once we know its WriteBatch method won't be called again
+	if l.sink != nil {
+		l.sinkCloseOnce.Do(func() { l.sinkCloseErr = l.sink.Close() })
+		return l.sinkCloseErr
+	}
+	return nil
+}
+
+// startBatchCallback passes a batch to the batchCallback in a new goroutine, keeping track of it so waitForBatchCallbacks can wait for it to return
+func (l *batchLogger) startBatchCallback(batch [][]byte) {
+	l.inFlightMutex.Lock()
+	if l.inFlight == 0 {
+		l.idle = make(chan struct{})
+	}
+	l.inFlight++
+	l.inFlightMutex.Unlock()
+
+	go func() {
+		defer func() {
+			l.inFlightMutex.Lock()
+			l.inFlight--
+			if l.inFlight == 0 {
+				close(l.idle)
+			}
+			l.inFlightMutex.Unlock()
+		}()
+		l.batchCallback(batch)
+	}()
+}
+
+// waitForBatchCallbacks waits until there are no batchCallback goroutines in progress, or the context expires
+func (l *batchLogger) waitForBatchCallbacks(ctx context.Context) error {
+	l.inFlightMutex.Lock()
+	idle := l.idle
+	l.inFlightMutex.Unlock()
+
+	select {
+	case <-idle:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Stats returns a snapshot of the batchLogger's queue length & counters. BatchesSent, BatchesFailed & Retries are only counted if the
+// batchLogger is sending logs to the Firetail logging API via its default BatchCallback, or a Sink created with NewFiretailSink
+func (l *batchLogger) Stats() BatchLoggerStats {
+	stats := BatchLoggerStats{
+		QueueLength:      len(l.queue),
+		QueueCapacity:    cap(l.queue),
+		EnqueuedEntries:  l.stats.enqueuedEntries.Load(),
+		DroppedEntries:   l.stats.droppedEntries.Load(),
+		DiscardedEntries: l.stats.discardedEntries.Load(),
+		BatchesCreated:   l.stats.batchesCreated.Load(),
+	}
+	if reporter, isReporter := l.sink.(deliveryStatsReporter); isReporter {
+		for _, sinkStats := range reporter.deliveryStats() {
+			stats.BatchesSent += sinkStats.batchesSent.Load()
+			stats.BatchesFailed += sinkStats.batchesFailed.Load()
+			stats.Retries += sinkStats.retries.Load()
+		}
+	}
+	return stats
 }
 
 // worker receives log entries via the batchLogger's queue and arranges them into batches of up to the batchLogger's maxBatchSize, and passes them to the logger's
 // batchHandler when either (1) it receives a new log entry that would make the batch oversized, or (2) the oldest log entry in the current batch is older than
-// the batchLogger's maxLogAge
+// the batchLogger's maxLogAge. The age of the current batch is checked whenever a new entry is received, and periodically by a ticker so that the worker can
+// otherwise sit idle while it waits for new entries. When the batchLogger is flushed or closed, everything in the queue is added to batches which are sent
+// immediately.
 func (l *batchLogger) worker() {
+	defer close(l.stopped)
+
 	currentBatch := [][]byte{}
 	currentBatchSize := 0
-	var overflowEntry *LogEntry
-	var overflowEntryBytes *[]byte
 	var oldestEntryCreatedAt *time.Time
 
-	for {
-		batchIsReady := false
+	sendBatch := func() {
+		if len(currentBatch) > 0 {
+			// Pass the batch to the batchHandler! :)
+			l.startBatchCallback(currentBatch)
+			l.stats.batchesCreated.Add(1)
+		}
 
-		// Read a new entry from the queue if there's one available
-		select {
-		case newEntry := <-l.queue:
-			// Marshal the entry to bytes...
-			entryBytes, err := json.Marshal(newEntry)
-			if err != nil {
-				// TODO: log that we're skipping this entry?
-				continue
-			}
+		// Clear out the current batch & set oldestEntryCreatedAt to nil
+		currentBatch = [][]byte{}
+		currentBatchSize = 0
+		oldestEntryCreatedAt = nil
+	}
 
-			if len(entryBytes) > l.maxBatchSize {
-				// TODO: log that we're skipping this entry?
-				continue
-			}
+	// Check the age of the batch at least as often as maxLogAge, but no more than every millisecond & no less than every second
+	tickInterval := l.maxLogAge
+	if tickInterval < time.Millisecond {
+		tickInterval = time.Millisecond
+	} else if tickInterval > time.Second {
+		tickInterval = time.Second
+	}
+	ticker := time.NewTicker(tickInterval)
+	defer ticker.Stop()
 
-			// If it's too big to add to the batch, place it in the overflow, flag the batch is ready to send & break from this case
-			if len(entryBytes)+currentBatchSize > l.maxBatchSize {
-				overflowEntry = newEntry
-				overflowEntryBytes = &entryBytes
-				batchIsReady = true
-				break
-			}
+	addEntry := func(newEntry *LogEntry) {
+		// Marshal the entry to bytes...
+		entryBytes, err := json.Marshal(newEntry)
+		if err != nil {
+			l.stats.discardedEntries.Add(1)
+			return
+		}
 
-			// Append it to the batch & increment the currentBatchSize appropriately
-			currentBatch = append(currentBatch, entryBytes)
-			currentBatchSize += len(entryBytes)
+		if len(entryBytes) > l.maxBatchSize {
+			l.stats.discardedEntries.Add(1)
+			return
+		}
 
-			// If the new entry is older than the oldest currently in the batch, we update oldestEntryCreatedAt
-			if oldestEntryCreatedAt == nil || newEntry.DateCreated < oldestEntryCreatedAt.UnixMilli() {
-				createdAt := time.UnixMilli(newEntry.DateCreated)
-				oldestEntryCreatedAt = &createdAt
-			}
-		default:
-			// If there's no new entry available, just break
-			break
+		// If it's too big to add to the current batch, then the current batch is ready to send & the new entry will start the next one
+		if len(entryBytes)+currentBatchSize > l.maxBatchSize {
+			sendBatch()
 		}
 
-		// If the oldest entry in the currentBatch was logged long enough ago, then the currentBatch is ready to send
-		if oldestEntryCreatedAt != nil && time.Since(*oldestEntryCreatedAt) > l.maxLogAge {
-			batchIsReady = true
+		// Append it to the batch & increment the currentBatchSize appropriately
+		currentBatch = append(currentBatch, entryBytes)
+		currentBatchSize += len(entryBytes)
+
+		// If the new entry is older than the oldest currently in the batch, we update oldestEntryCreatedAt
+		if oldestEntryCreatedAt == nil || newEntry.DateCreated < oldestEntryCreatedAt.UnixMilli() {
+			createdAt := time.UnixMilli(newEntry.DateCreated)
+			oldestEntryCreatedAt = &createdAt
 		}
+	}
 
-		if batchIsReady {
-			// Pass the batch to the batchHandler! :)
-			go l.batchCallback(currentBatch)
+	// drainQueue adds everything currently in the queue to batches & sends them all
+	drainQueue := func() {
+		for {
+			select {
+			case newEntry := <-l.queue:
+				addEntry(newEntry)
+			default:
+				sendBatch()
+				return
+			}
+		}
+	}
 
-			// Clear out the current batch & set oldestEntryCreatedAt to nil
-			currentBatch = [][]byte{}
-			currentBatchSize = 0
-			oldestEntryCreatedAt = nil
+	for {
+		select {
+		case newEntry := <-l.queue:
+			addEntry(newEntry)
 
-			// If there's an overflow entry, add it to the batch immediately
-			if overflowEntry != nil {
-				createdAt := time.UnixMilli(overflowEntry.DateCreated)
-				oldestEntryCreatedAt = &createdAt
+		case flushed := <-l.flushRequests:
+			drainQueue()
+			close(flushed)
 
-				currentBatch = append(currentBatch, *overflowEntryBytes)
-				currentBatchSize += len(*overflowEntryBytes)
+		case <-l.stop:
+			// Any calls to Enqueue blocked on a full queue give up now stop is closed, so this doesn't wait for long
+			l.enqueuers.Wait()
+			drainQueue()
+			return
 
-				overflowEntry = nil
-				overflowEntryBytes = nil
-			}
+		case <-ticker.C:
 		}
 
-		// Give the CPU some time to do other things :)
-		time.Sleep(1)
+		// If the oldest entry in the currentBatch was logged long enough ago, then the currentBatch is ready to send
+		if oldestEntryCreatedAt != nil && time.Since(*oldestEntryCreatedAt) > l.maxLogAge {
+			sendBatch()
+		}
 	}
 }
@@ -1,9 +1,12 @@
 package logging
 
 import (
+	"context"
 	"encoding/json"
 	"math/rand"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -172,3 +175,176 @@ func TestOldLogTriggersBatch(t *testing.T) {
 	// Assert that the batch has all the same byte slices as the expected batch
 	require.ElementsMatch(t, expectedBatch, *batch)
 }
+
+func TestDropNewestOnOverflow(t *testing.T) {
+	// Create a batchLogger without starting its worker so that nothing is taken out of the queue
+	batchLogger := &batchLogger{
+		queue:          make(chan *LogEntry, 2),
+		overflowPolicy: DropNewestOnOverflow,
+	}
+
+	testLogEntries := []*LogEntry{{DateCreated: 1}, {DateCreated: 2}, {DateCreated: 3}}
+	for _, logEntry := range testLogEntries {
+		batchLogger.Enqueue(logEntry)
+	}
+
+	stats := batchLogger.Stats()
+	assert.Equal(t, 2, stats.QueueLength)
+	assert.Equal(t, 2, stats.QueueCapacity)
+	assert.Equal(t, uint64(2), stats.EnqueuedEntries)
+	assert.Equal(t, uint64(1), stats.DroppedEntries)
+
+	// The newest entry should have been dropped
+	assert.Equal(t, testLogEntries[0], <-batchLogger.queue)
+	assert.Equal(t, testLogEntries[1], <-batchLogger.queue)
+}
+
+func TestDropOldestOnOverflow(t *testing.T) {
+	// Create a batchLogger without starting its worker so that nothing is taken out of the queue
+	batchLogger := &batchLogger{
+		queue:          make(chan *LogEntry, 2),
+		overflowPolicy: DropOldestOnOverflow,
+	}
+
+	testLogEntries := []*LogEntry{{DateCreated: 1}, {DateCreated: 2}, {DateCreated: 3}}
+	for _, logEntry := range testLogEntries {
+		batchLogger.Enqueue(logEntry)
+	}
+
+	stats := batchLogger.Stats()
+	assert.Equal(t, 2, stats.QueueLength)
+	assert.Equal(t, uint64(3), stats.EnqueuedEntries)
+	assert.Equal(t, uint64(1), stats.DroppedEntries)
+
+	// The oldest entry should have been dropped
+	assert.Equal(t, testLogEntries[1], <-batchLogger.queue)
+	assert.Equal(t, testLogEntries[2], <-batchLogger.queue)
+}
+
+func TestOversizedEntryIsDiscarded(t *testing.T) {
+	batchChannel := make(chan *[][]byte, 1)
+	batchLogger := SetupLogger(batchChannel, 16, time.Minute)
+
+	batchLogger.Enqueue(&LogEntry{
+		DateCreated: time.Now().UnixMilli() - time.Minute.Milliseconds()*2,
+	})
+
+	require.Eventually(t, func() bool { return batchLogger.Stats().DiscardedEntries == 1 }, time.Second, time.Millisecond)
+	assert.Equal(t, 0, len(batchChannel))
+}
+
+func TestFlushSendsPendingBatch(t *testing.T) {
+	batchChannel := make(chan *[][]byte, 1)
+	batchLogger := SetupLogger(batchChannel, 1024*512, time.Minute)
+
+	for i := 0; i < 3; i++ {
+		batchLogger.Enqueue(&LogEntry{DateCreated: time.Now().UnixMilli()})
+	}
+
+	// None of the entries are old enough to trigger a batch, so it's only sent because we flush
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	require.Nil(t, batchLogger.Flush(ctx))
+
+	require.Equal(t, 1, len(batchChannel))
+	batch := <-batchChannel
+	assert.Equal(t, 3, len(*batch))
+}
+
+func TestCloseWaitsForBatchCallbacks(t *testing.T) {
+	batchLogger := NewBatchLogger(BatchLoggerOptions{
+		MaxBatchSize: 1024 * 512,
+		MaxLogAge:    time.Minute,
+	})
+	release := make(chan struct{})
+	batchLogger.batchCallback = func(b [][]byte) {
+		<-release
+	}
+
+	batchLogger.Enqueue(&LogEntry{DateCreated: time.Now().UnixMilli()})
+
+	// The batch callback can't return until we release it, so Close should give up when its context expires
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*10)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, batchLogger.Close(ctx))
+
+	// Once it's released, Close should succeed
+	close(release)
+	require.Nil(t, batchLogger.Close(context.Background()))
+
+	// Entries enqueued after the batchLogger is closed should be dropped
+	batchLogger.Enqueue(&LogEntry{DateCreated: time.Now().UnixMilli()})
+	stats := batchLogger.Stats()
+	assert.Equal(t, uint64(1), stats.EnqueuedEntries)
+	assert.Equal(t, uint64(1), stats.DroppedEntries)
+	assert.Equal(t, uint64(1), stats.BatchesCreated)
+}
+
+func TestEnqueueConcurrentlyWithClose(t *testing.T) {
+	for _, overflowPolicy := range []OverflowPolicy{BlockOnOverflow, DropNewestOnOverflow} {
+		batchLogger := NewBatchLogger(BatchLoggerOptions{
+			MaxBatchSize:   1024 * 512,
+			MaxLogAge:      time.Minute,
+			QueueCapacity:  8,
+			OverflowPolicy: overflowPolicy,
+		})
+		var sentEntries atomic.Uint64
+		batchLogger.batchCallback = func(b [][]byte) {
+			sentEntries.Add(uint64(len(b)))
+		}
+
+		const enqueuers, entriesPerEnqueuer = 8, 100
+		wg := sync.WaitGroup{}
+		for i := 0; i < enqueuers; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < entriesPerEnqueuer; j++ {
+					batchLogger.Enqueue(&LogEntry{DateCreated: time.Now().UnixMilli()})
+				}
+			}()
+		}
+		require.Nil(t, batchLogger.Close(context.Background()))
+		wg.Wait()
+
+		// Every entry should either have been dropped or sent; none should be left in the queue after the final drain
+		stats := batchLogger.Stats()
+		assert.Equal(t, uint64(enqueuers*entriesPerEnqueuer), stats.EnqueuedEntries+stats.DroppedEntries)
+		assert.Equal(t, 0, stats.QueueLength)
+		assert.Equal(t, stats.EnqueuedEntries, sentEntries.Load())
+	}
+}
+
+func TestCloseHonoursContextWhilstEnqueueIsBlocked(t *testing.T) {
+	// Create a batchLogger without starting its worker so that nothing is taken out of the queue & Enqueue blocks once it's full
+	batchLogger := &batchLogger{
+		queue:          make(chan *LogEntry, 1),
+		overflowPolicy: BlockOnOverflow,
+		stop:           make(chan struct{}),
+		stopped:        make(chan struct{}),
+	}
+	batchLogger.Enqueue(&LogEntry{DateCreated: 1})
+
+	enqueued := make(chan struct{})
+	go func() {
+		batchLogger.Enqueue(&LogEntry{DateCreated: 2})
+		close(enqueued)
+	}()
+	// Give the second Enqueue time to block on the full queue
+	time.Sleep(10 * time.Millisecond)
+
+	// The worker never stops, so Close should give up when its context expires rather than waiting on the blocked Enqueue
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	startTime := time.Now()
+	assert.Equal(t, context.DeadlineExceeded, batchLogger.Close(ctx))
+	assert.Less(t, time.Since(startTime), time.Second)
+
+	// The blocked Enqueue should have given up & dropped its entry once Close was called
+	select {
+	case <-enqueued:
+	case <-time.After(time.Second):
+		t.Fatal("Enqueue was still blocked after Close was called")
+	}
+	assert.Equal(t, uint64(1), batchLogger.Stats().DroppedEntries)
+}
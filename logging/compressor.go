@@ -0,0 +1,34 @@
+package logging
+
+import (
+	"compress/gzip"
+	"io"
+)
+
+// A Compressor is used by the default batch callback to compress the body of its requests to the Firetail logging API. Compressors for
+// encodings not included in this package, such as zstd, can be implemented by wrapping a third party encoder
+type Compressor interface {
+	// ContentEncoding returns the value of the Content-Encoding header to send with the compressed body, e.g. "gzip"
+	ContentEncoding() string
+
+	// NewWriter returns a WriteCloser which writes the compressed form of everything written to it to w. It will be closed once the
+	// whole body has been written
+	NewWriter(w io.Writer) (io.WriteCloser, error)
+}
+
+type gzipCompressor struct {
+	level int
+}
+
+// GzipCompressor returns a Compressor using gzip with the given compression level, e.g. gzip.DefaultCompression or gzip.BestSpeed
+func GzipCompressor(level int) Compressor {
+	return gzipCompressor{level}
+}
+
+func (c gzipCompressor) ContentEncoding() string {
+	return "gzip"
+}
+
+func (c gzipCompressor) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return gzip.NewWriterLevel(w, c.level)
+}
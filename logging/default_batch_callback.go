@@ -2,60 +2,239 @@ package logging
 
 import (
 	"bytes"
-	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
 )
 
-func getDefaultBatchCallback(options BatchLoggerOptions) func([][]byte) {
+// BatchError describes a failure to send a batch of log entries to the Firetail logging API, and is passed to the ErrCallback in the
+// BatchLoggerOptions, if one is provided
+type BatchError struct {
+	Err        error         // The error which caused the final attempt to send the batch to fail
+	StatusCode int           // The status code of the logging API's response to the final attempt, or 0 if no response was received
+	Retryable  bool          // Whether the failure is expected to be temporary, e.g. a network error, a 429 or a 5xx response
+	RetryAfter time.Duration // The delay requested by the Retry-After header of a 429 or 503 response, or 0 if there was none
+	Attempts   int           // The number of attempts which were made to send the batch
+	EntryCount int           // The number of log entries in the batch
+	Spooled    bool          // Whether the batch was written to the spool, from which it'll be replayed later
+}
+
+func (e BatchError) Error() string {
+	return fmt.Sprintf("failed to send batch of %d log entries to firetail after %d attempt(s): %s", e.EntryCount, e.Attempts, e.Err.Error())
+}
+
+func (e BatchError) Unwrap() error {
+	return e.Err
+}
+
+// defaultHTTPClientTimeout is the timeout of the http.Client used by the default batch callback if none is provided in the
+// BatchLoggerOptions, so that a stalled logging endpoint can't hold up a batch forever
+const defaultHTTPClientTimeout = time.Second * 30
+
+// deliveryStats holds counters kept by the default batch callback, which are included in the Stats of the batchLogger using it
+type deliveryStats struct {
+	batchesSent   atomic.Uint64
+	batchesFailed atomic.Uint64
+	retries       atomic.Uint64
+}
+
+func getDefaultBatchCallback(options BatchLoggerOptions, spool *spool, stats *deliveryStats) func([][]byte) {
+	retryPolicy := DefaultRetryPolicy
+	if options.RetryPolicy != nil {
+		retryPolicy = *options.RetryPolicy
+	}
+	if retryPolicy.MaxAttempts < 1 {
+		retryPolicy.MaxAttempts = 1
+	}
+
+	httpClient := options.HTTPClient
+	if httpClient == nil {
+		httpClient = &http.Client{Timeout: defaultHTTPClientTimeout}
+	}
+
+	errCallback := options.ErrCallback
+	if errCallback == nil {
+		errCallback = func(err BatchError) {
+			log.Println("Error sending logs to Firetail API: ", err)
+		}
+	}
+
+	// sendBatch makes a single attempt to send a batch, returning a BatchError classifying the failure if it's unsuccessful
 	sendBatch := func(batchBytes [][]byte) error {
-		reqBytes := []byte{}
-		for _, entry := range batchBytes {
-			reqBytes = append(reqBytes, entry...)
-			reqBytes = append(reqBytes, '\n')
+		reqBytes := ndjson(batchBytes)
+
+		if options.Compressor != nil {
+			compressedBytes, err := compress(options.Compressor, reqBytes)
+			if err != nil {
+				return BatchError{Err: fmt.Errorf("failed to compress batch: %w", err), EntryCount: len(batchBytes)}
+			}
+			reqBytes = compressedBytes
 		}
 
 		req, err := http.NewRequest("POST", options.LogApiUrl, bytes.NewBuffer(reqBytes))
 		if err != nil {
-			return err
+			return BatchError{Err: err, EntryCount: len(batchBytes)}
 		}
 
 		req.Header.Set("x-ft-api-key", options.LogApiKey)
+		if options.Compressor != nil {
+			req.Header.Set("Content-Encoding", options.Compressor.ContentEncoding())
+		}
+
+		if options.RequestSigner != nil {
+			if err := options.RequestSigner(req); err != nil {
+				return BatchError{Err: fmt.Errorf("failed to sign request: %w", err), EntryCount: len(batchBytes)}
+			}
+		}
 
-		resp, err := http.DefaultClient.Do(req)
+		resp, err := httpClient.Do(req)
 		if err != nil {
-			return err
+			// Errors from the client are network errors, timeouts etc. which are worth retrying
+			return BatchError{Err: err, Retryable: true, EntryCount: len(batchBytes)}
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+			// Read the rest of the body so the connection can be reused
+			io.Copy(io.Discard, resp.Body)
+			return nil
 		}
 
-		var res map[string]interface{}
-		json.NewDecoder(resp.Body).Decode(&res)
-		if res["message"] != "success" {
-			return errors.New(fmt.Sprintf("got err response from firetail api: %v", res))
+		respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		batchErr := BatchError{
+			Err:        fmt.Errorf("got %d response from firetail api: %s", resp.StatusCode, string(respBody)),
+			StatusCode: resp.StatusCode,
+			Retryable:  isRetryableStatusCode(resp.StatusCode),
+			EntryCount: len(batchBytes),
 		}
+		if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable {
+			batchErr.RetryAfter = parseRetryAfter(resp.Header.Get("Retry-After"))
+		}
+		return batchErr
+	}
+
+	// If there's no log API url or log API key set then we can't log, so just return
+	if options.LogApiUrl == "" || options.LogApiKey == "" {
+		return func(batch [][]byte) {}
+	}
 
-		return nil
+	// If there's a spool, replay anything in it in the background. Batches which fail permanently when they're replayed are dropped
+	// from the spool, so they're reported to the errCallback
+	if spool != nil {
+		go spool.replay(func(batch [][]byte) error {
+			err := sendBatch(batch)
+			if err == nil {
+				stats.batchesSent.Add(1)
+			} else if batchErr, isBatchErr := err.(BatchError); isBatchErr && !batchErr.Retryable {
+				stats.batchesFailed.Add(1)
+				batchErr.Attempts = 1
+				errCallback(batchErr)
+			} else {
+				stats.retries.Add(1)
+			}
+			return err
+		})
 	}
 
 	return func(batch [][]byte) {
-		// If there's no log API url or log API key set then we can't log, so just return
-		if options.LogApiUrl == "" || options.LogApiKey == "" {
-			return
-		}
-
-		var err error
-		retries := 0
-		for {
-			err = sendBatch(batch)
-			retries++
-			// If sendBatch succeeded, or we've had 3 retries, we give up
-			if err == nil || retries >= 3 {
+		var batchErr BatchError
+		for attempt := 1; ; attempt++ {
+			err := sendBatch(batch)
+			if err == nil {
+				stats.batchesSent.Add(1)
+				return
+			}
+			batchErr = err.(BatchError)
+			batchErr.Attempts = attempt
+
+			// If the failure isn't retryable, or we've run out of attempts, we give up
+			if !batchErr.Retryable || attempt >= retryPolicy.MaxAttempts {
 				break
 			}
+
+			// If the logging API asks us to wait longer than we're willing to block for & there's a spool, we stop retrying here rather
+			// than retrying early; the spool honours the Retry-After delay when the batch is replayed. Without a spool, we'd rather retry
+			// early than drop the batch, so we wait as long as we're willing to & retry anyway
+			if batchErr.RetryAfter > retryPolicy.MaxDelay && spool != nil {
+				break
+			}
+
+			delay := retryPolicy.delay(attempt)
+			if batchErr.RetryAfter > delay {
+				delay = batchErr.RetryAfter
+			}
+			if delay > retryPolicy.MaxDelay {
+				delay = retryPolicy.MaxDelay
+			}
+			time.Sleep(delay)
+			stats.retries.Add(1)
 		}
-		if err != nil {
-			log.Println("Error sending logs to Firetail API: ", err)
+
+		stats.batchesFailed.Add(1)
+
+		// Retryable failures are written to the spool, if there is one, to be replayed later
+		if batchErr.Retryable && spool != nil {
+			if spoolErr := spool.write(batch); spoolErr != nil {
+				log.Println("Error writing logs to the spool: ", spoolErr)
+			} else {
+				batchErr.Spooled = true
+			}
+		}
+
+		errCallback(batchErr)
+	}
+}
+
+// compress returns the given bytes compressed with the given Compressor
+func compress(compressor Compressor, uncompressedBytes []byte) ([]byte, error) {
+	compressedBytes := &bytes.Buffer{}
+	writer, err := compressor.NewWriter(compressedBytes)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := writer.Write(uncompressedBytes); err != nil {
+		writer.Close()
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return compressedBytes.Bytes(), nil
+}
+
+// isRetryableStatusCode returns true if a response from the logging API with the given status code indicates a failure that may succeed
+// if retried; e.g. rate limiting or server errors. Other 4xx responses, such as those for an invalid API key, won't succeed if retried.
+func isRetryableStatusCode(statusCode int) bool {
+	return statusCode == http.StatusRequestTimeout || statusCode == http.StatusTooManyRequests || statusCode >= 500
+}
+
+// parseRetryAfter parses the value of a Retry-After header, which may be either a number of seconds or a HTTP date. If the value is empty
+// or invalid, 0 is returned
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0
 		}
+		return time.Duration(seconds) * time.Second
 	}
+	if retryAt, err := http.ParseTime(value); err == nil {
+		if delay := time.Until(retryAt); delay > 0 {
+			return delay
+		}
+	}
+	return 0
+}
+
+// isPermanentBatchError returns true if the error was returned by sendBatch for a failure that won't succeed if retried
+func isPermanentBatchError(err error) bool {
+	var batchErr BatchError
+	return errors.As(err, &batchErr) && !batchErr.Retryable
 }
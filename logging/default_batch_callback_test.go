@@ -0,0 +1,265 @@
+package logging
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDefaultBatchCallbackRetriesAfterRetryAfter(t *testing.T) {
+	requests := atomic.Int64{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1) == 1 {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.Write([]byte("{\"message\":\"success\"}"))
+	}))
+	defer server.Close()
+
+	batchErrs := make(chan BatchError, 1)
+	batchCallback := getDefaultBatchCallback(BatchLoggerOptions{
+		LogApiKey:   "test-api-key",
+		LogApiUrl:   server.URL,
+		RetryPolicy: &RetryPolicy{MaxAttempts: 2, BaseDelay: time.Millisecond, MaxDelay: time.Second * 5},
+		ErrCallback: func(err BatchError) { batchErrs <- err },
+	}, nil, &deliveryStats{})
+
+	startTime := time.Now()
+	batchCallback([][]byte{[]byte("{\"dateCreated\":1}")})
+
+	// The retry should have waited for the delay in the Retry-After header rather than the policy's BaseDelay
+	assert.GreaterOrEqual(t, time.Since(startTime), time.Second)
+	assert.Equal(t, int64(2), requests.Load())
+	assert.Equal(t, 0, len(batchErrs))
+}
+
+func TestDefaultBatchCallbackRetriesLongRetryAfterWithoutSpool(t *testing.T) {
+	requests := atomic.Int64{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.Header().Set("Retry-After", "120")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	batchErrs := make(chan BatchError, 1)
+	batchCallback := getDefaultBatchCallback(BatchLoggerOptions{
+		LogApiKey:   "test-api-key",
+		LogApiUrl:   server.URL,
+		RetryPolicy: &RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond * 10},
+		ErrCallback: func(err BatchError) { batchErrs <- err },
+	}, nil, &deliveryStats{})
+
+	startTime := time.Now()
+	batchCallback([][]byte{[]byte("{\"dateCreated\":1}")})
+
+	// The Retry-After delay exceeds the policy's MaxDelay & there's no spool, so rather than dropping the batch we should've retried it
+	// after waiting for the MaxDelay, until we ran out of attempts
+	assert.Less(t, time.Since(startTime), time.Second)
+	assert.GreaterOrEqual(t, time.Since(startTime), time.Millisecond*20)
+	assert.Equal(t, int64(3), requests.Load())
+	require.Equal(t, 1, len(batchErrs))
+	batchErr := <-batchErrs
+	assert.True(t, batchErr.Retryable)
+	assert.Equal(t, time.Second*120, batchErr.RetryAfter)
+	assert.Equal(t, 3, batchErr.Attempts)
+	assert.False(t, batchErr.Spooled)
+}
+
+func TestDefaultBatchCallbackSpoolsOnLongRetryAfter(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "120")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer server.Close()
+
+	spool, err := newSpool(t.TempDir(), 1024*1024, time.Hour, time.Hour, time.Hour)
+	require.Nil(t, err)
+	defer spool.close()
+
+	batchErrs := make(chan BatchError, 1)
+	batchCallback := getDefaultBatchCallback(BatchLoggerOptions{
+		LogApiKey:   "test-api-key",
+		LogApiUrl:   server.URL,
+		RetryPolicy: &RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond * 10},
+		ErrCallback: func(err BatchError) { batchErrs <- err },
+	}, spool, &deliveryStats{})
+
+	batchCallback([][]byte{[]byte("{\"dateCreated\":1}")})
+
+	require.Equal(t, 1, len(batchErrs))
+	batchErr := <-batchErrs
+	assert.True(t, batchErr.Spooled)
+	assert.Equal(t, 1, batchErr.Attempts)
+	segments, err := spool.segments()
+	require.Nil(t, err)
+	assert.Len(t, segments, 1)
+}
+
+func TestDefaultBatchCallbackDoesNotRetryPermanentFailures(t *testing.T) {
+	requests := atomic.Int64{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer server.Close()
+
+	batchErrs := make(chan BatchError, 1)
+	batchCallback := getDefaultBatchCallback(BatchLoggerOptions{
+		LogApiKey:   "test-api-key",
+		LogApiUrl:   server.URL,
+		RetryPolicy: &RetryPolicy{MaxAttempts: 5, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond},
+		ErrCallback: func(err BatchError) { batchErrs <- err },
+	}, nil, &deliveryStats{})
+
+	batchCallback([][]byte{[]byte("{\"dateCreated\":1}"), []byte("{\"dateCreated\":2}")})
+
+	assert.Equal(t, int64(1), requests.Load())
+	require.Equal(t, 1, len(batchErrs))
+	batchErr := <-batchErrs
+	assert.Equal(t, http.StatusUnauthorized, batchErr.StatusCode)
+	assert.False(t, batchErr.Retryable)
+	assert.False(t, batchErr.Spooled)
+	assert.Equal(t, 1, batchErr.Attempts)
+	assert.Equal(t, 2, batchErr.EntryCount)
+}
+
+func TestDefaultBatchCallbackGivesUpAfterMaxAttempts(t *testing.T) {
+	requests := atomic.Int64{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	batchErrs := make(chan BatchError, 1)
+	stats := &deliveryStats{}
+	batchCallback := getDefaultBatchCallback(BatchLoggerOptions{
+		LogApiKey:   "test-api-key",
+		LogApiUrl:   server.URL,
+		RetryPolicy: &RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond * 10},
+		ErrCallback: func(err BatchError) { batchErrs <- err },
+	}, nil, stats)
+
+	batchCallback([][]byte{[]byte("{\"dateCreated\":1}")})
+
+	assert.Equal(t, int64(3), requests.Load())
+	assert.Equal(t, uint64(0), stats.batchesSent.Load())
+	assert.Equal(t, uint64(1), stats.batchesFailed.Load())
+	assert.Equal(t, uint64(2), stats.retries.Load())
+	require.Equal(t, 1, len(batchErrs))
+	batchErr := <-batchErrs
+	assert.Equal(t, http.StatusInternalServerError, batchErr.StatusCode)
+	assert.True(t, batchErr.Retryable)
+	assert.Equal(t, 3, batchErr.Attempts)
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	assert.Equal(t, time.Second*120, parseRetryAfter("120"))
+	assert.Equal(t, time.Duration(0), parseRetryAfter(""))
+	assert.Equal(t, time.Duration(0), parseRetryAfter("not a delay"))
+	assert.Equal(t, time.Duration(0), parseRetryAfter(time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat)))
+
+	delay := parseRetryAfter(time.Now().Add(time.Minute).UTC().Format(http.TimeFormat))
+	assert.Greater(t, delay, time.Second*58)
+	assert.LessOrEqual(t, delay, time.Minute)
+}
+
+func TestDefaultBatchCallbackUsesHTTPClientAndRequestSigner(t *testing.T) {
+	signatures := make(chan string, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		signatures <- r.Header.Get("X-Signature")
+		w.Write([]byte("{\"message\":\"success\"}"))
+	}))
+	defer server.Close()
+
+	batchCallback := getDefaultBatchCallback(BatchLoggerOptions{
+		LogApiKey:  "test-api-key",
+		LogApiUrl:  server.URL,
+		HTTPClient: server.Client(),
+		RequestSigner: func(r *http.Request) error {
+			body, err := r.GetBody()
+			if err != nil {
+				return err
+			}
+			bodyBytes, err := io.ReadAll(body)
+			if err != nil {
+				return err
+			}
+			r.Header.Set("X-Signature", fmt.Sprintf("%d", len(bodyBytes)))
+			return nil
+		},
+	}, nil, &deliveryStats{})
+
+	batchCallback([][]byte{[]byte("{\"dateCreated\":1}")})
+
+	require.Equal(t, 1, len(signatures))
+	assert.Equal(t, "18", <-signatures)
+}
+
+func TestDefaultBatchCallbackTimesOutStalledRequests(t *testing.T) {
+	unstall := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-unstall
+	}))
+	defer server.Close()
+	defer close(unstall)
+
+	batchErrs := make(chan BatchError, 1)
+	batchCallback := getDefaultBatchCallback(BatchLoggerOptions{
+		LogApiKey:   "test-api-key",
+		LogApiUrl:   server.URL,
+		HTTPClient:  &http.Client{Timeout: time.Millisecond * 10},
+		RetryPolicy: &RetryPolicy{MaxAttempts: 1},
+		ErrCallback: func(err BatchError) { batchErrs <- err },
+	}, nil, &deliveryStats{})
+
+	batchCallback([][]byte{[]byte("{\"dateCreated\":1}")})
+
+	require.Equal(t, 1, len(batchErrs))
+	batchErr := <-batchErrs
+	assert.True(t, batchErr.Retryable)
+	assert.Equal(t, 0, batchErr.StatusCode)
+}
+
+func TestDefaultBatchCallbackCompressesBatches(t *testing.T) {
+	type receivedRequest struct {
+		contentEncoding string
+		body            []byte
+	}
+	received := make(chan receivedRequest, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gzipReader, err := gzip.NewReader(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		body, _ := io.ReadAll(gzipReader)
+		received <- receivedRequest{r.Header.Get("Content-Encoding"), body}
+		w.Write([]byte("{\"message\":\"success\"}"))
+	}))
+	defer server.Close()
+
+	batchCallback := getDefaultBatchCallback(BatchLoggerOptions{
+		LogApiKey:  "test-api-key",
+		LogApiUrl:  server.URL,
+		Compressor: GzipCompressor(gzip.BestSpeed),
+	}, nil, &deliveryStats{})
+
+	batchCallback([][]byte{[]byte("{\"dateCreated\":1}"), []byte("{\"dateCreated\":2}")})
+
+	require.Equal(t, 1, len(received))
+	request := <-received
+	assert.Equal(t, "gzip", request.contentEncoding)
+	assert.Equal(t, "{\"dateCreated\":1}\n{\"dateCreated\":2}\n", string(request.body))
+}
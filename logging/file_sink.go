@@ -0,0 +1,109 @@
+package logging
+
+import (
+	"fmt"
+	"os"
+	"sync"
+)
+
+// FileSink is a Sink which appends batches to a file as newline-delimited JSON, rotating the file once it reaches a maximum size
+type FileSink struct {
+	path       string     // The path of the file to which batches are appended
+	maxSize    int64      // The size in bytes beyond which the file is rotated
+	maxBackups int        // The number of rotated files to keep, named path.1, path.2 etc. from newest to oldest
+	mutex      sync.Mutex // Held whilst the file is being written to or rotated
+	file       *os.File
+	size       int64
+}
+
+// NewFileSink creates a FileSink which appends batches to the file at the given path, creating it if it doesn't exist. Before a batch is
+// written which would take the file beyond maxSize bytes, the file is rotated: it's renamed to path.1, any existing path.1 is renamed to
+// path.2 and so on, and those beyond maxBackups are deleted. If maxSize is 0 or less, the file is never rotated.
+func NewFileSink(path string, maxSize int64, maxBackups int) (*FileSink, error) {
+	sink := &FileSink{
+		path:       path,
+		maxSize:    maxSize,
+		maxBackups: maxBackups,
+	}
+	if err := sink.open(); err != nil {
+		return nil, err
+	}
+	return sink, nil
+}
+
+// open opens the sink's file for appending. The caller must hold s.mutex, or be the constructor
+func (s *FileSink) open() error {
+	file, err := os.OpenFile(s.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	s.file = file
+	s.size = info.Size()
+	return nil
+}
+
+// rotate closes the sink's file, shifts it & its backups along by one, then opens a new file. The caller must hold s.mutex
+func (s *FileSink) rotate() error {
+	if err := s.file.Close(); err != nil {
+		return err
+	}
+	s.file = nil
+
+	if s.maxBackups <= 0 {
+		if err := os.Remove(s.path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return s.open()
+	}
+
+	os.Remove(fmt.Sprintf("%s.%d", s.path, s.maxBackups))
+	for i := s.maxBackups - 1; i >= 1; i-- {
+		if err := os.Rename(fmt.Sprintf("%s.%d", s.path, i), fmt.Sprintf("%s.%d", s.path, i+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if err := os.Rename(s.path, s.path+".1"); err != nil {
+		return err
+	}
+	return s.open()
+}
+
+func (s *FileSink) WriteBatch(batch [][]byte) error {
+	batchBytes := ndjson(batch)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// If a previous rotation failed part way through, we'll need to reopen the file
+	if s.file == nil {
+		if err := s.open(); err != nil {
+			return err
+		}
+	}
+
+	if s.maxSize > 0 && s.size > 0 && s.size+int64(len(batchBytes)) > s.maxSize {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+
+	written, err := s.file.Write(batchBytes)
+	s.size += int64(written)
+	return err
+}
+
+func (s *FileSink) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Close()
+	s.file = nil
+	return err
+}
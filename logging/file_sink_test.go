@@ -0,0 +1,48 @@
+package logging
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileSinkAppendsToExistingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "firetail.ndjson")
+	require.Nil(t, os.WriteFile(path, []byte("{\"dateCreated\":1}\n"), 0o600))
+
+	sink, err := NewFileSink(path, 0, 0)
+	require.Nil(t, err)
+	require.Nil(t, sink.WriteBatch([][]byte{[]byte("{\"dateCreated\":2}")}))
+	require.Nil(t, sink.Close())
+
+	fileBytes, err := os.ReadFile(path)
+	require.Nil(t, err)
+	assert.Equal(t, "{\"dateCreated\":1}\n{\"dateCreated\":2}\n", string(fileBytes))
+}
+
+func TestFileSinkRotatesAtMaxSize(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "firetail.ndjson")
+
+	// Each of these batches will be 18 bytes, so only one will fit in the file at a time
+	sink, err := NewFileSink(path, 32, 2)
+	require.Nil(t, err)
+	defer sink.Close()
+	for _, entry := range []string{"{\"dateCreated\":1}", "{\"dateCreated\":2}", "{\"dateCreated\":3}", "{\"dateCreated\":4}"} {
+		require.Nil(t, sink.WriteBatch([][]byte{[]byte(entry)}))
+	}
+
+	for path, expectedContents := range map[string]string{
+		path:        "{\"dateCreated\":4}\n",
+		path + ".1": "{\"dateCreated\":3}\n",
+		path + ".2": "{\"dateCreated\":2}\n",
+	} {
+		fileBytes, err := os.ReadFile(path)
+		require.Nil(t, err)
+		assert.Equal(t, expectedContents, string(fileBytes))
+	}
+	_, err = os.Stat(path + ".3")
+	assert.True(t, os.IsNotExist(err))
+}
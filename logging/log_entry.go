@@ -25,8 +25,50 @@ type LogEntry struct {
 	Request       Request  `json:"request"`
 	Response      Response `json:"response"`
 	Version       Version  `json:"version"` // The version of the firetail logging schema used
+
+	TraceID            string              `json:"traceId,omitempty"`            // The ID of the OpenTelemetry trace of which the request was a part, if it was traced; added in version 1.1.0-alpha
+	SpanID             string              `json:"spanId,omitempty"`             // The ID of the OpenTelemetry server span created for the request, if one was recorded; added in version 1.1.0-alpha
+	ValidationFindings []ValidationFinding `json:"validationFindings,omitempty"` // The errors which occurred while validating the request & response; added in version 1.1.0-alpha
+	Identity           *Identity           `json:"identity,omitempty"`           // Who made the request, if an auth callback authenticated them; added in version 1.2.0-alpha
+}
+
+// The caller who made a request, as authenticated by one of the security schemes in the OpenAPI spec
+type Identity struct {
+	Subject        string   `json:"subject,omitempty"`        // The user or client who made the request, e.g. the "sub" claim of a JWT or a basic auth username
+	Tenant         string   `json:"tenant,omitempty"`         // The tenant or organisation to which the subject belongs, if any
+	Scopes         []string `json:"scopes,omitempty"`         // The scopes granted to the subject
+	SecurityScheme string   `json:"securityScheme,omitempty"` // The name of the security scheme in the OpenAPI spec by which the subject was authenticated
 }
 
+// An error which occurred while handling the request, such as the request or response failing to validate against the OpenAPI spec. A
+// single error may be broken down into several findings, e.g. one for each property of a request body which didn't match its schema
+type ValidationFinding struct {
+	Type     string             `json:"type"`              // The type of the error, e.g. ErrorRequestBodyInvalid
+	Title    string             `json:"title"`             // The title of the error, as would be given in an RFC7807 error response
+	Message  string             `json:"message"`           // A description of the error
+	Blocked  bool               `json:"blocked"`           // Whether the request or response was blocked because of the error, which is never the case in monitor-only mode
+	Location ValidationLocation `json:"location"`          // The part of the request or response which failed to validate
+	Pointer  string             `json:"pointer,omitempty"` // A JSON pointer to the value which failed to validate within the location, e.g. /pets/0/name; for parameters, the first token is the parameter name
+	Keyword  string             `json:"keyword,omitempty"` // The schema keyword which the value failed to satisfy, e.g. required, enum or maxLength
+}
+
+// The part of the request or response in which a validation finding occurred
+type ValidationLocation string
+
+const (
+	RequestRouteLocation    ValidationLocation = "request.route"
+	RequestPathLocation     ValidationLocation = "request.path"
+	RequestQueryLocation    ValidationLocation = "request.query"
+	RequestHeaderLocation   ValidationLocation = "request.header"
+	RequestCookieLocation   ValidationLocation = "request.cookie"
+	RequestBodyLocation     ValidationLocation = "request.body"
+	RequestSecurityLocation ValidationLocation = "request.security"
+	ResponseStatusLocation  ValidationLocation = "response.status"
+	ResponseHeaderLocation  ValidationLocation = "response.header"
+	ResponseBodyLocation    ValidationLocation = "response.body"
+	UnknownLocation         ValidationLocation = "unknown"
+)
+
 type Request struct {
 	Body         string              `json:"body"`         // The request body, stringified
 	Headers      map[string][]string `json:"headers"`      // The request headers
@@ -35,12 +77,21 @@ type Request struct {
 	Method       Method              `json:"method"`       // The request method. Src for allowed values can be found here: <a; href='https://www.iana.org/assignments/http-methods/http-methods.xhtml#methods'>https://www.iana.org/assignments/http-methods/http-methods.xhtml#methods</a>.
 	URI          string              `json:"uri"`          // The URI the request was made to
 	Resource     string              `json:"resource"`     // The resource path that the request matched up to in the OpenAPI spec
+
+	// The following fields were added in version 1.1.0-alpha of the schema
+	OperationID string            `json:"operationId,omitempty"` // The operationId of the operation in the OpenAPI spec that the request matched, if it has one
+	Route       string            `json:"route,omitempty"`       // The path template in the OpenAPI spec that the request matched, e.g. /pets/{id}; unset if it matched none
+	PathParams  map[string]string `json:"pathParams,omitempty"`  // The values of the path parameters in the route template, by name
 }
 
 type Response struct {
 	Body       string              `json:"body"`    // The response body, stringified
 	Headers    map[string][]string `json:"headers"` // The response headers
 	StatusCode int64               `json:"statusCode"`
+
+	// The following fields were added in version 1.1.0-alpha of the schema
+	BodySize int64 `json:"bodySize,omitempty"` // The number of bytes written to the response body, which may exceed len(Body) if the body was truncated
+	Hijacked bool  `json:"hijacked,omitempty"` // Whether the connection was hijacked by the handler, in which case no response was written by the server
 }
 
 // The HTTP protocol used in the request
@@ -105,4 +156,6 @@ type Version string
 
 const (
 	The100Alpha Version = "1.0.0-alpha"
+	The110Alpha Version = "1.1.0-alpha" // Adds the request's operationId, route & pathParams, the response's bodySize & hijacked, the traceId & spanId, and the validationFindings
+	The120Alpha Version = "1.2.0-alpha" // Adds the identity
 )
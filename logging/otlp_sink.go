@@ -0,0 +1,238 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// OTLPSinkOptions is an options struct used by the NewOTLPSink constructor
+type OTLPSinkOptions struct {
+	Endpoint           string            // The URL of the collector's OTLP/HTTP logs endpoint; the default value is http://localhost:4318/v1/logs
+	Headers            map[string]string // Any additional headers to send with each export request, e.g. for authentication
+	HTTPClient         *http.Client      // The client used to send export requests; the default is a http.Client with a 30 second timeout
+	ServiceName        string            // The service.name resource attribute; the default value is "unknown_service"
+	ResourceAttributes map[string]string // Any additional resource attributes, e.g. deployment.environment
+}
+
+// otlpSink is a Sink which converts log entries to OTLP log records & exports them to a collector using OTLP/HTTP with JSON encoding
+type otlpSink struct {
+	endpoint   string
+	headers    map[string]string
+	httpClient *http.Client
+	resource   otlpResource
+}
+
+// NewOTLPSink creates a Sink which converts each log entry into an OpenTelemetry log record, with attributes following the HTTP semantic
+// conventions, and exports them to an OpenTelemetry collector via OTLP/HTTP. The body of each log record is the log entry itself.
+func NewOTLPSink(options OTLPSinkOptions) Sink {
+	sink := &otlpSink{
+		endpoint:   options.Endpoint,
+		headers:    options.Headers,
+		httpClient: options.HTTPClient,
+	}
+	if sink.endpoint == "" {
+		sink.endpoint = "http://localhost:4318/v1/logs"
+	}
+	if sink.httpClient == nil {
+		sink.httpClient = &http.Client{Timeout: defaultHTTPClientTimeout}
+	}
+
+	serviceName := options.ServiceName
+	if serviceName == "" {
+		serviceName = "unknown_service"
+	}
+	sink.resource.Attributes = []otlpKeyValue{otlpString("service.name", serviceName)}
+	for key, value := range options.ResourceAttributes {
+		sink.resource.Attributes = append(sink.resource.Attributes, otlpString(key, value))
+	}
+
+	return sink
+}
+
+// The following types are the parts of the JSON encoding of an OTLP ExportLogsServiceRequest used by the otlpSink. Note that 64 bit
+// integers are encoded as strings
+type otlpExportLogsRequest struct {
+	ResourceLogs []otlpResourceLogs `json:"resourceLogs"`
+}
+
+type otlpResourceLogs struct {
+	Resource  otlpResource    `json:"resource"`
+	ScopeLogs []otlpScopeLogs `json:"scopeLogs"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpScopeLogs struct {
+	Scope      otlpScope       `json:"scope"`
+	LogRecords []otlpLogRecord `json:"logRecords"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpLogRecord struct {
+	TraceID              string         `json:"traceId,omitempty"`
+	SpanID               string         `json:"spanId,omitempty"`
+	TimeUnixNano         string         `json:"timeUnixNano"`
+	ObservedTimeUnixNano string         `json:"observedTimeUnixNano"`
+	SeverityNumber       int            `json:"severityNumber"`
+	SeverityText         string         `json:"severityText"`
+	Body                 otlpAnyValue   `json:"body"`
+	Attributes           []otlpKeyValue `json:"attributes"`
+}
+
+type otlpKeyValue struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+type otlpAnyValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+}
+
+func otlpString(key string, value string) otlpKeyValue {
+	return otlpKeyValue{key, otlpAnyValue{StringValue: &value}}
+}
+
+func otlpInt(key string, value int64) otlpKeyValue {
+	intString := strconv.FormatInt(value, 10)
+	return otlpKeyValue{key, otlpAnyValue{IntValue: &intString}}
+}
+
+func otlpDouble(key string, value float64) otlpKeyValue {
+	return otlpKeyValue{key, otlpAnyValue{DoubleValue: &value}}
+}
+
+func otlpBool(key string, value bool) otlpKeyValue {
+	return otlpKeyValue{key, otlpAnyValue{BoolValue: &value}}
+}
+
+// otlpLogRecordFromLogEntry converts a log entry into an OTLP log record. Its severity is ERROR for 5xx responses, WARN for 4xx responses
+// and INFO otherwise
+func otlpLogRecordFromLogEntry(logEntry LogEntry, logEntryBytes []byte, observedTime time.Time) otlpLogRecord {
+	body := string(logEntryBytes)
+	logRecord := otlpLogRecord{
+		TraceID:              logEntry.TraceID,
+		SpanID:               logEntry.SpanID,
+		TimeUnixNano:         strconv.FormatInt(time.UnixMilli(logEntry.DateCreated).UnixNano(), 10),
+		ObservedTimeUnixNano: strconv.FormatInt(observedTime.UnixNano(), 10),
+		SeverityNumber:       9,
+		SeverityText:         "INFO",
+		Body:                 otlpAnyValue{StringValue: &body},
+		Attributes: []otlpKeyValue{
+			otlpString("http.request.method", string(logEntry.Request.Method)),
+			otlpString("url.full", logEntry.Request.URI),
+			otlpString("client.address", logEntry.Request.IP),
+			otlpDouble("firetail.execution_time_ms", logEntry.ExecutionTime),
+			otlpInt("http.request.body.size", int64(len(logEntry.Request.Body))),
+		},
+	}
+
+	// http.route must be the path template the request matched, so it's left out if the request didn't match one
+	if logEntry.Request.Route != "" {
+		logRecord.Attributes = append(logRecord.Attributes, otlpString("http.route", logEntry.Request.Route))
+	}
+
+	switch {
+	case logEntry.Response.StatusCode >= 500:
+		logRecord.SeverityNumber, logRecord.SeverityText = 17, "ERROR"
+	case logEntry.Response.StatusCode >= 400:
+		logRecord.SeverityNumber, logRecord.SeverityText = 13, "WARN"
+	}
+
+	if requestURL, err := url.Parse(logEntry.Request.URI); err == nil {
+		logRecord.Attributes = append(logRecord.Attributes,
+			otlpString("url.scheme", requestURL.Scheme),
+			otlpString("url.path", requestURL.Path),
+			otlpString("server.address", requestURL.Hostname()),
+		)
+	}
+
+	if protocol := strings.TrimPrefix(string(logEntry.Request.HTTPProtocol), "HTTP/"); protocol != "" {
+		logRecord.Attributes = append(logRecord.Attributes, otlpString("network.protocol.name", "http"), otlpString("network.protocol.version", protocol))
+	}
+
+	for header, values := range logEntry.Request.Headers {
+		if strings.EqualFold(header, "User-Agent") && len(values) > 0 {
+			logRecord.Attributes = append(logRecord.Attributes, otlpString("user_agent.original", values[0]))
+		}
+	}
+
+	if logEntry.Response.Hijacked {
+		logRecord.Attributes = append(logRecord.Attributes, otlpBool("firetail.response.hijacked", true))
+	} else {
+		responseBodySize := logEntry.Response.BodySize
+		if responseBodySize == 0 {
+			responseBodySize = int64(len(logEntry.Response.Body))
+		}
+		logRecord.Attributes = append(logRecord.Attributes,
+			otlpInt("http.response.status_code", logEntry.Response.StatusCode),
+			otlpInt("http.response.body.size", responseBodySize),
+		)
+	}
+
+	return logRecord
+}
+
+func (s *otlpSink) WriteBatch(batch [][]byte) error {
+	observedTime := time.Now()
+	logRecords := []otlpLogRecord{}
+	for _, logEntryBytes := range batch {
+		logEntry, err := UnmarshalLogEntry(logEntryBytes)
+		if err != nil {
+			return fmt.Errorf("failed to unmarshal log entry: %w", err)
+		}
+		logRecords = append(logRecords, otlpLogRecordFromLogEntry(logEntry, logEntryBytes, observedTime))
+	}
+
+	reqBytes, err := json.Marshal(otlpExportLogsRequest{
+		ResourceLogs: []otlpResourceLogs{{
+			Resource: s.resource,
+			ScopeLogs: []otlpScopeLogs{{
+				Scope:      otlpScope{Name: "github.com/FireTail-io/firetail-go-lib"},
+				LogRecords: logRecords,
+			}},
+		}},
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", s.endpoint, bytes.NewBuffer(reqBytes))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for header, value := range s.headers {
+		req.Header.Set(header, value)
+	}
+
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("got %d response from otlp collector: %s", resp.StatusCode, string(respBody))
+	}
+	return nil
+}
+
+func (s *otlpSink) Close() error {
+	return nil
+}
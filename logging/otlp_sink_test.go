@@ -0,0 +1,148 @@
+package logging
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestCollector starts a stand-in for an OpenTelemetry collector's OTLP/HTTP logs endpoint, which passes the requests it receives & the
+// export requests decoded from their bodies down the returned channels
+func newTestCollector(t *testing.T) (*httptest.Server, chan *http.Request, chan otlpExportLogsRequest) {
+	requests := make(chan *http.Request, 1)
+	exports := make(chan otlpExportLogsRequest, 1)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/logs" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		export := otlpExportLogsRequest{}
+		if err := json.NewDecoder(r.Body).Decode(&export); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		requests <- r
+		exports <- export
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte("{}"))
+	}))
+	t.Cleanup(collector.Close)
+	return collector, requests, exports
+}
+
+func getOTLPAttribute(attributes []otlpKeyValue, key string) *otlpAnyValue {
+	for _, attribute := range attributes {
+		if attribute.Key == key {
+			return &attribute.Value
+		}
+	}
+	return nil
+}
+
+func TestOTLPSinkExportsLogRecords(t *testing.T) {
+	collector, requests, exports := newTestCollector(t)
+
+	sink := NewOTLPSink(OTLPSinkOptions{
+		Endpoint:    collector.URL + "/v1/logs",
+		Headers:     map[string]string{"Authorization": "Bearer test-token"},
+		ServiceName: "test-service",
+	})
+	defer sink.Close()
+
+	logEntry := LogEntry{
+		DateCreated:   1672531200000,
+		ExecutionTime: 250,
+		Request: Request{
+			HTTPProtocol: HTTP11,
+			Method:       Get,
+			URI:          "https://example.com/pets/1?verbose=true",
+			Resource:     "/pets/1",
+			Route:        "/pets/{id}",
+			IP:           "192.0.2.1",
+			Headers:      map[string][]string{"User-Agent": {"test-agent"}},
+		},
+		Response: Response{
+			StatusCode: 404,
+			Body:       "{\"code\":404}",
+		},
+		Version: The110Alpha,
+	}
+	logEntryBytes, err := logEntry.Marshal()
+	require.Nil(t, err)
+
+	require.Nil(t, sink.WriteBatch([][]byte{logEntryBytes}))
+
+	require.Equal(t, 1, len(requests))
+	request := <-requests
+	assert.Equal(t, "application/json", request.Header.Get("Content-Type"))
+	assert.Equal(t, "Bearer test-token", request.Header.Get("Authorization"))
+
+	export := <-exports
+	require.Len(t, export.ResourceLogs, 1)
+	serviceName := getOTLPAttribute(export.ResourceLogs[0].Resource.Attributes, "service.name")
+	require.NotNil(t, serviceName)
+	assert.Equal(t, "test-service", *serviceName.StringValue)
+
+	require.Len(t, export.ResourceLogs[0].ScopeLogs, 1)
+	require.Len(t, export.ResourceLogs[0].ScopeLogs[0].LogRecords, 1)
+	logRecord := export.ResourceLogs[0].ScopeLogs[0].LogRecords[0]
+	assert.Equal(t, "1672531200000000000", logRecord.TimeUnixNano)
+	assert.Equal(t, 13, logRecord.SeverityNumber)
+	assert.Equal(t, "WARN", logRecord.SeverityText)
+	assert.Equal(t, string(logEntryBytes), *logRecord.Body.StringValue)
+
+	for key, expectedValue := range map[string]string{
+		"http.request.method":      "GET",
+		"http.route":               "/pets/{id}",
+		"url.full":                 "https://example.com/pets/1?verbose=true",
+		"url.scheme":               "https",
+		"url.path":                 "/pets/1",
+		"server.address":           "example.com",
+		"client.address":           "192.0.2.1",
+		"network.protocol.version": "1.1",
+		"user_agent.original":      "test-agent",
+	} {
+		value := getOTLPAttribute(logRecord.Attributes, key)
+		require.NotNil(t, value, key)
+		require.NotNil(t, value.StringValue, key)
+		assert.Equal(t, expectedValue, *value.StringValue, key)
+	}
+	for key, expectedValue := range map[string]string{
+		"http.response.status_code": "404",
+		"http.response.body.size":   "12",
+	} {
+		value := getOTLPAttribute(logRecord.Attributes, key)
+		require.NotNil(t, value, key)
+		require.NotNil(t, value.IntValue, key)
+		assert.Equal(t, expectedValue, *value.IntValue, key)
+	}
+	executionTime := getOTLPAttribute(logRecord.Attributes, "firetail.execution_time_ms")
+	require.NotNil(t, executionTime)
+	assert.Equal(t, 250.0, *executionTime.DoubleValue)
+	assert.Nil(t, getOTLPAttribute(logRecord.Attributes, "http.server.request.duration"))
+}
+
+func TestOTLPLogRecordOmitsRouteIfUnmatched(t *testing.T) {
+	logEntry := LogEntry{Request: Request{Method: Get, Resource: "/not-in-the-spec"}}
+	logEntryBytes, err := logEntry.Marshal()
+	require.Nil(t, err)
+
+	logRecord := otlpLogRecordFromLogEntry(logEntry, logEntryBytes, time.Now())
+	assert.Nil(t, getOTLPAttribute(logRecord.Attributes, "http.route"))
+}
+
+func TestOTLPSinkReturnsErrorOnFailedExport(t *testing.T) {
+	collector, _, _ := newTestCollector(t)
+
+	sink := NewOTLPSink(OTLPSinkOptions{Endpoint: collector.URL + "/not-the-logs-endpoint"})
+	defer sink.Close()
+
+	logEntryBytes, err := (&LogEntry{DateCreated: 1}).Marshal()
+	require.Nil(t, err)
+	assert.NotNil(t, sink.WriteBatch([][]byte{logEntryBytes}))
+}
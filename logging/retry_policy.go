@@ -0,0 +1,52 @@
+package logging
+
+import (
+	"math/rand"
+	"time"
+)
+
+// RetryPolicy configures how the default batch callback retries sending a batch to the Firetail logging API after a retryable failure
+type RetryPolicy struct {
+	MaxAttempts int           // The maximum number of attempts made to send a batch, including the first; values less than 1 are treated as 1
+	BaseDelay   time.Duration // The delay before the first retry, which is doubled for each subsequent retry
+	MaxDelay    time.Duration // The maximum delay between retries; if a Retry-After header requests a longer delay, the batch is spooled rather than retried inline, or retried after MaxDelay if there's no spool
+	Jitter      float64       // The fraction (from 0 to 1) of each delay which is randomised, so that many clients don't retry in lockstep
+}
+
+// DefaultRetryPolicy is the RetryPolicy used by the default batch callback if none is provided in the BatchLoggerOptions
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts: 3,
+	BaseDelay:   time.Millisecond * 500,
+	MaxDelay:    time.Second * 10,
+	Jitter:      0.5,
+}
+
+// delay returns how long to wait before making the given retry (starting at 1 for the first retry)
+func (p RetryPolicy) delay(retry int) time.Duration {
+	return backoffDelay(retry, p.BaseDelay, p.MaxDelay, p.Jitter)
+}
+
+// backoffDelay returns how long to wait before making the given retry (starting at 1 for the first retry), doubling baseDelay for each
+// retry up to maxDelay. The given fraction of the delay is then randomised, e.g. with a jitter of 0.5 the delay will be somewhere between
+// half and all of this value
+func backoffDelay(retry int, baseDelay time.Duration, maxDelay time.Duration, jitter float64) time.Duration {
+	delay := baseDelay
+	for i := 1; i < retry && delay < maxDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxDelay {
+		delay = maxDelay
+	}
+
+	if jitter <= 0 {
+		return delay
+	}
+	if jitter > 1 {
+		jitter = 1
+	}
+	jitterRange := int64(float64(delay) * jitter)
+	if jitterRange <= 0 {
+		return delay
+	}
+	return delay - time.Duration(jitterRange) + time.Duration(rand.Int63n(jitterRange+1))
+}
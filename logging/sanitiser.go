@@ -23,6 +23,10 @@ type SanitiserOptions struct {
 	// is then logged to Firetail. This is useful for writing custom logic to redact any sensitive data from your response bodies before it is logged
 	// in Firetail.
 	ResponseSanitisationCallback func(string) string
+
+	// HashIdentity is an optional flag which, if set to true, will hash the subject & tenant of the log entry's identity before it is logged to
+	// Firetail, so that API activity can still be attributed per consumer without revealing who they are.
+	HashIdentity bool
 }
 
 func DefaultSanitiser() func(LogEntry) LogEntry {
@@ -80,6 +84,18 @@ func GetSanitiser(options SanitiserOptions) func(LogEntry) LogEntry {
 			logEntry.Response.Body = options.ResponseSanitisationCallback(logEntry.Response.Body)
 		}
 
+		// If the identity should be hashed, hash it. We copy it first, as the log entry's identity is a pointer
+		if options.HashIdentity && logEntry.Identity != nil {
+			identity := *logEntry.Identity
+			if identity.Subject != "" {
+				identity.Subject = hashString(identity.Subject)
+			}
+			if identity.Tenant != "" {
+				identity.Tenant = hashString(identity.Tenant)
+			}
+			logEntry.Identity = &identity
+		}
+
 		return logEntry
 	}
 }
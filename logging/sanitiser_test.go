@@ -84,3 +84,28 @@ func TestCustomSanitiserWithNoRequestHeadersMask(t *testing.T) {
 		assert.Equal(t, headerName, headerValues[0])
 	}
 }
+
+func TestCustomSanitiserHashesIdentity(t *testing.T) {
+	sanitiser := GetSanitiser(SanitiserOptions{HashIdentity: true})
+	identity := &Identity{
+		Subject:        "test-subject",
+		Tenant:         "test-tenant",
+		Scopes:         []string{"pets:read"},
+		SecurityScheme: "BearerAuth",
+	}
+	sanitisedLogEntry := sanitiser(LogEntry{Identity: identity})
+
+	assert.Equal(t, &Identity{
+		Subject:        hashString("test-subject"),
+		Tenant:         hashString("test-tenant"),
+		Scopes:         []string{"pets:read"},
+		SecurityScheme: "BearerAuth",
+	}, sanitisedLogEntry.Identity)
+	assert.Equal(t, "test-subject", identity.Subject)
+}
+
+func TestDefaultSanitiserPreservesIdentity(t *testing.T) {
+	sanitiser := DefaultSanitiser()
+	sanitisedLogEntry := sanitiser(LogEntry{Identity: &Identity{Subject: "test-subject"}})
+	assert.Equal(t, "test-subject", sanitisedLogEntry.Identity.Subject)
+}
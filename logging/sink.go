@@ -0,0 +1,195 @@
+package logging
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+)
+
+// A Sink is a destination for batches of log entries, each of which is a JSON object. A Sink can be passed to a batchLogger via the Sink
+// field of its BatchLoggerOptions, and multiple sinks can be combined with NewFanOutSink
+type Sink interface {
+	// WriteBatch writes a batch of log entries to the sink. It may be called from several goroutines at once
+	WriteBatch(batch [][]byte) error
+
+	// Close releases any resources held by the sink. WriteBatch will not be called again once Close has been called
+	Close() error
+}
+
+// ndjson joins a batch of log entries into newline-delimited JSON, with a trailing newline
+func ndjson(batch [][]byte) []byte {
+	ndjsonBytes := []byte{}
+	for _, entry := range batch {
+		ndjsonBytes = append(ndjsonBytes, entry...)
+		ndjsonBytes = append(ndjsonBytes, '\n')
+	}
+	return ndjsonBytes
+}
+
+// firetailSink is a Sink which sends batches to the Firetail logging API using the default batch callback
+type firetailSink struct {
+	batchCallback func([][]byte)
+	spool         *spool
+	stats         deliveryStats
+}
+
+// deliveryStatsReporter is implemented by sinks which keep deliveryStats, directly or via other sinks, so that they can be included in
+// the Stats of the batchLogger using them
+type deliveryStatsReporter interface {
+	deliveryStats() []*deliveryStats
+}
+
+// NewFiretailSink creates a Sink which sends batches to the Firetail logging API, using the LogApiKey, LogApiUrl, HTTPClient, Compressor,
+// RetryPolicy, SpoolDirectory etc. in the provided options just like the default BatchCallback. Batches which fail to send are retried
+// and spooled according to those options, then passed to the ErrCallback, so its WriteBatch method never returns an error.
+func NewFiretailSink(options BatchLoggerOptions) Sink {
+	sink := &firetailSink{}
+	if options.SpoolDirectory != "" {
+		sink.spool = getSpool(options)
+	}
+	sink.batchCallback = getDefaultBatchCallback(options, sink.spool, &sink.stats)
+	return sink
+}
+
+func (s *firetailSink) deliveryStats() []*deliveryStats {
+	return []*deliveryStats{&s.stats}
+}
+
+func (s *firetailSink) WriteBatch(batch [][]byte) error {
+	s.batchCallback(batch)
+	return nil
+}
+
+func (s *firetailSink) Close() error {
+	if s.spool != nil {
+		s.spool.close()
+	}
+	return nil
+}
+
+// writerSink is a Sink which writes batches to an io.Writer as newline-delimited JSON
+type writerSink struct {
+	writer io.Writer
+	mutex  sync.Mutex // Held whilst writing a batch, so that batches written concurrently aren't interleaved
+}
+
+// NewWriterSink creates a Sink which writes each batch to the given io.Writer as newline-delimited JSON, in a single call to its Write
+// method. The io.Writer is not closed when the Sink is closed.
+func NewWriterSink(writer io.Writer) Sink {
+	return &writerSink{writer: writer}
+}
+
+// StdoutSink creates a Sink which writes batches to stdout as newline-delimited JSON
+func StdoutSink() Sink {
+	return NewWriterSink(os.Stdout)
+}
+
+// StderrSink creates a Sink which writes batches to stderr as newline-delimited JSON
+func StderrSink() Sink {
+	return NewWriterSink(os.Stderr)
+}
+
+func (s *writerSink) WriteBatch(batch [][]byte) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	_, err := s.writer.Write(ndjson(batch))
+	return err
+}
+
+func (s *writerSink) Close() error {
+	return nil
+}
+
+// callbackSink is a Sink which passes batches to a batch callback, such as the BatchCallback of a batchLogger
+type callbackSink struct {
+	callback func([][]byte)
+}
+
+// NewCallbackSink creates a Sink which passes each batch to the given callback, so that a custom BatchCallback can be combined with
+// other sinks using NewFanOutSink
+func NewCallbackSink(callback func([][]byte)) Sink {
+	return &callbackSink{callback}
+}
+
+func (s *callbackSink) WriteBatch(batch [][]byte) error {
+	s.callback(batch)
+	return nil
+}
+
+func (s *callbackSink) Close() error {
+	return nil
+}
+
+// FanOutError is returned by the WriteBatch and Close methods of a Sink created with NewFanOutSink when one or more of its sinks fail
+type FanOutError struct {
+	Errs []error // The errors returned by each of the sinks which failed
+}
+
+func (e FanOutError) Error() string {
+	errStrings := []string{}
+	for _, err := range e.Errs {
+		errStrings = append(errStrings, err.Error())
+	}
+	return fmt.Sprintf("%d sink(s) failed: %s", len(e.Errs), strings.Join(errStrings, "; "))
+}
+
+func (e FanOutError) Unwrap() []error {
+	return e.Errs
+}
+
+// fanOutSink is a Sink which writes every batch to each of several sinks
+type fanOutSink struct {
+	sinks []Sink
+}
+
+// NewFanOutSink creates a Sink which writes every batch to each of the provided sinks concurrently, so a failing sink doesn't prevent the
+// batch from being written to the others. WriteBatch only returns once all of the sinks have returned, so a slow sink delays the next batch
+// from being written to any of them. If any of the sinks fail, a FanOutError containing each of their errors is returned
+func NewFanOutSink(sinks ...Sink) Sink {
+	return &fanOutSink{sinks}
+}
+
+func (s *fanOutSink) WriteBatch(batch [][]byte) error {
+	return s.forEachSink(func(sink Sink) error { return sink.WriteBatch(batch) })
+}
+
+func (s *fanOutSink) Close() error {
+	return s.forEachSink(func(sink Sink) error { return sink.Close() })
+}
+
+func (s *fanOutSink) deliveryStats() []*deliveryStats {
+	stats := []*deliveryStats{}
+	for _, sink := range s.sinks {
+		if reporter, isReporter := sink.(deliveryStatsReporter); isReporter {
+			stats = append(stats, reporter.deliveryStats()...)
+		}
+	}
+	return stats
+}
+
+// forEachSink calls f with each of the fanOutSink's sinks concurrently, returning a FanOutError if any of the calls return an error
+func (s *fanOutSink) forEachSink(f func(Sink) error) error {
+	errs := make([]error, len(s.sinks))
+	wg := sync.WaitGroup{}
+	for i, sink := range s.sinks {
+		wg.Add(1)
+		go func(i int, sink Sink) {
+			defer wg.Done()
+			errs[i] = f(sink)
+		}(i, sink)
+	}
+	wg.Wait()
+
+	fanOutErr := FanOutError{}
+	for _, err := range errs {
+		if err != nil {
+			fanOutErr.Errs = append(fanOutErr.Errs, err)
+		}
+	}
+	if len(fanOutErr.Errs) > 0 {
+		return fanOutErr
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testSink struct {
+	batches chan [][]byte
+	err     error
+	closed  atomic.Bool
+}
+
+func (s *testSink) WriteBatch(batch [][]byte) error {
+	if s.err != nil {
+		return s.err
+	}
+	s.batches <- batch
+	return nil
+}
+
+func (s *testSink) Close() error {
+	s.closed.Store(true)
+	return nil
+}
+
+func TestWriterSinkWritesNDJSON(t *testing.T) {
+	buffer := &bytes.Buffer{}
+	sink := NewWriterSink(buffer)
+
+	require.Nil(t, sink.WriteBatch([][]byte{[]byte("{\"dateCreated\":1}"), []byte("{\"dateCreated\":2}")}))
+	require.Nil(t, sink.WriteBatch([][]byte{[]byte("{\"dateCreated\":3}")}))
+	require.Nil(t, sink.Close())
+
+	assert.Equal(t, "{\"dateCreated\":1}\n{\"dateCreated\":2}\n{\"dateCreated\":3}\n", buffer.String())
+}
+
+func TestCallbackSinkPassesBatchesToCallback(t *testing.T) {
+	batches := make(chan [][]byte, 1)
+	sink := NewCallbackSink(func(batch [][]byte) { batches <- batch })
+
+	testBatch := [][]byte{[]byte("{\"dateCreated\":1}")}
+	require.Nil(t, sink.WriteBatch(testBatch))
+	require.Nil(t, sink.Close())
+
+	require.Equal(t, 1, len(batches))
+	assert.Equal(t, testBatch, <-batches)
+}
+
+func TestFanOutSinkWritesToAllSinksDespiteFailures(t *testing.T) {
+	sinkErr := errors.New("test sink error")
+	failingSink := &testSink{err: sinkErr}
+	workingSink := &testSink{batches: make(chan [][]byte, 1)}
+	sink := NewFanOutSink(failingSink, workingSink)
+
+	testBatch := [][]byte{[]byte("{\"dateCreated\":1}")}
+	err := sink.WriteBatch(testBatch)
+
+	require.IsType(t, FanOutError{}, err)
+	assert.Equal(t, []error{sinkErr}, err.(FanOutError).Errs)
+	require.Equal(t, 1, len(workingSink.batches))
+	assert.Equal(t, testBatch, <-workingSink.batches)
+
+	require.Nil(t, sink.Close())
+	assert.True(t, failingSink.closed.Load())
+	assert.True(t, workingSink.closed.Load())
+}
+
+func TestBatchLoggerWritesToSinkAndClosesIt(t *testing.T) {
+	sink := &testSink{batches: make(chan [][]byte, 1)}
+	batchLogger := NewBatchLogger(BatchLoggerOptions{
+		MaxBatchSize: 1024 * 512,
+		MaxLogAge:    time.Minute,
+		Sink:         sink,
+	})
+
+	batchLogger.Enqueue(&LogEntry{DateCreated: 1})
+	require.Nil(t, batchLogger.Close(context.Background()))
+
+	require.Equal(t, 1, len(sink.batches))
+	batch := <-sink.batches
+	require.Len(t, batch, 1)
+	logEntry, err := UnmarshalLogEntry(batch[0])
+	require.Nil(t, err)
+	assert.Equal(t, int64(1), logEntry.DateCreated)
+	assert.True(t, sink.closed.Load())
+}
@@ -0,0 +1,264 @@
+package logging
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const spoolSegmentExtension = ".ndjson"
+
+// A spool persists batches which couldn't be sent to a directory on disk, with one segment file per batch, so that they can be replayed
+// once the logging endpoint recovers - even if the process has since been restarted
+type spool struct {
+	directory      string        // The directory in which segment files are stored
+	maxSize        int64         // The maximum total size of all the segment files in bytes; the oldest are deleted to stay within it
+	maxAge         time.Duration // The maximum age of a segment file, after which it is deleted
+	baseRetryDelay time.Duration // The delay before replaying after the first failed attempt, doubled for each consecutive failure
+	maxRetryDelay  time.Duration // The maximum delay between replay attempts
+	mutex          sync.Mutex    // Held whilst segment files are being written, read or deleted
+	sequence       atomic.Uint64 // Used to give segment files written in the same nanosecond distinct names
+	written        chan struct{} // Signals the replay loop that a new segment has been written
+	stop           chan struct{} // Closed to stop the replay loop
+	closeOnce      sync.Once
+}
+
+func newSpool(directory string, maxSize int64, maxAge time.Duration, baseRetryDelay time.Duration, maxRetryDelay time.Duration) (*spool, error) {
+	if err := os.MkdirAll(directory, 0o700); err != nil {
+		return nil, err
+	}
+
+	// Remove any temporary files left behind if the process previously died whilst writing a segment
+	tempFiles, err := filepath.Glob(filepath.Join(directory, "*.tmp"))
+	if err != nil {
+		return nil, err
+	}
+	for _, tempFile := range tempFiles {
+		os.Remove(tempFile)
+	}
+
+	return &spool{
+		directory:      directory,
+		maxSize:        maxSize,
+		maxAge:         maxAge,
+		baseRetryDelay: baseRetryDelay,
+		maxRetryDelay:  maxRetryDelay,
+		written:        make(chan struct{}, 1),
+		stop:           make(chan struct{}),
+	}, nil
+}
+
+// getSpool creates a spool from the SpoolDirectory etc. in the provided options, filling in defaults for any which are unset. If the spool
+// can't be created, the error is logged & nil is returned, in which case batches which can't be sent will be dropped
+func getSpool(options BatchLoggerOptions) *spool {
+	maxSize := int64(1024 * 1024 * 64)
+	if options.SpoolMaxSize > 0 {
+		maxSize = options.SpoolMaxSize
+	}
+	maxAge := time.Hour * 24
+	if options.SpoolMaxAge > 0 {
+		maxAge = options.SpoolMaxAge
+	}
+	baseRetryDelay := time.Second
+	if options.SpoolBaseRetryDelay > 0 {
+		baseRetryDelay = options.SpoolBaseRetryDelay
+	}
+	maxRetryDelay := time.Minute * 5
+	if options.SpoolMaxRetryDelay > 0 {
+		maxRetryDelay = options.SpoolMaxRetryDelay
+	}
+
+	spool, err := newSpool(options.SpoolDirectory, maxSize, maxAge, baseRetryDelay, maxRetryDelay)
+	if err != nil {
+		log.Println("Error creating Firetail log spool, logs which can't be sent will be dropped: ", err)
+		return nil
+	}
+	return spool
+}
+
+// write persists a batch to a new segment file, then deletes the oldest segments if the spool has exceeded its maximum size
+func (s *spool) write(batch [][]byte) error {
+	segmentBytes := ndjson(batch)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// Write to a temporary file first & then rename it so a partially written segment is never replayed
+	segmentName := fmt.Sprintf("%020d-%06d%s", time.Now().UnixNano(), s.sequence.Add(1)%1000000, spoolSegmentExtension)
+	segmentPath := filepath.Join(s.directory, segmentName)
+	if err := os.WriteFile(segmentPath+".tmp", segmentBytes, 0o600); err != nil {
+		return err
+	}
+	if err := os.Rename(segmentPath+".tmp", segmentPath); err != nil {
+		os.Remove(segmentPath + ".tmp")
+		return err
+	}
+
+	s.prune()
+
+	// Let the replay loop know there's something to replay, if it isn't already aware
+	select {
+	case s.written <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+// segments returns the segment files in the spool, oldest first. The caller must hold s.mutex
+func (s *spool) segments() ([]os.FileInfo, error) {
+	dirEntries, err := os.ReadDir(s.directory)
+	if err != nil {
+		return nil, err
+	}
+	segments := []os.FileInfo{}
+	for _, dirEntry := range dirEntries {
+		if dirEntry.IsDir() || !strings.HasSuffix(dirEntry.Name(), spoolSegmentExtension) {
+			continue
+		}
+		info, err := dirEntry.Info()
+		if err != nil {
+			continue
+		}
+		segments = append(segments, info)
+	}
+	// Segment names begin with a zero-padded timestamp, so sorting them by name sorts them by age
+	sort.Slice(segments, func(i, j int) bool { return segments[i].Name() < segments[j].Name() })
+	return segments, nil
+}
+
+// prune deletes any segments older than the spool's maxAge, and then the oldest segments until the spool is within its maxSize. The caller
+// must hold s.mutex
+func (s *spool) prune() {
+	segments, err := s.segments()
+	if err != nil {
+		log.Println("Error reading Firetail log spool: ", err)
+		return
+	}
+
+	totalSize := int64(0)
+	for _, segment := range segments {
+		totalSize += segment.Size()
+	}
+
+	for _, segment := range segments {
+		if time.Since(segment.ModTime()) <= s.maxAge && totalSize <= s.maxSize {
+			break
+		}
+		if err := os.Remove(filepath.Join(s.directory, segment.Name())); err != nil {
+			log.Println("Error removing segment from Firetail log spool: ", err)
+			continue
+		}
+		totalSize -= segment.Size()
+		log.Println("Dropped logs from Firetail log spool as it exceeded its maximum size or age: ", segment.Name())
+	}
+}
+
+// oldest returns the path to the oldest segment in the spool & the batch it contains. If the spool is empty, the path is an empty string
+func (s *spool) oldest() (string, [][]byte, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.prune()
+
+	segments, err := s.segments()
+	if err != nil || len(segments) == 0 {
+		return "", nil, err
+	}
+
+	segmentPath := filepath.Join(s.directory, segments[0].Name())
+	segmentBytes, err := os.ReadFile(segmentPath)
+	if err != nil {
+		return segmentPath, nil, err
+	}
+
+	batch := [][]byte{}
+	for _, entry := range bytes.Split(segmentBytes, []byte{'\n'}) {
+		if len(entry) > 0 {
+			batch = append(batch, entry)
+		}
+	}
+	return segmentPath, batch, nil
+}
+
+func (s *spool) remove(segmentPath string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if err := os.Remove(segmentPath); err != nil && !os.IsNotExist(err) {
+		log.Println("Error removing segment from Firetail log spool: ", err)
+	}
+}
+
+// replay passes the segments in the spool to send, oldest first, deleting each once it has been sent or has failed permanently. After a
+// retryable failure it waits with an exponential backoff, or the Retry-After delay if longer, before trying again. It runs until the spool
+// is closed.
+func (s *spool) replay(send func([][]byte) error) {
+	failedAttempts := 0
+	for {
+		var wait <-chan time.Time
+
+		segmentPath, batch, err := s.oldest()
+		switch {
+		case err != nil && segmentPath != "":
+			// The segment couldn't be read, so it's no use keeping it around
+			log.Println("Error reading segment from Firetail log spool, removing it: ", err)
+			s.remove(segmentPath)
+			continue
+
+		case err != nil:
+			log.Println("Error reading Firetail log spool: ", err)
+			failedAttempts++
+			wait = time.After(backoffDelay(failedAttempts, s.baseRetryDelay, s.maxRetryDelay, 0.5))
+
+		case segmentPath == "":
+			// The spool is empty, so there's nothing to do until another segment is written. We still check back periodically so
+			// that segments written by another process using the same directory are eventually replayed too
+			failedAttempts = 0
+			wait = time.After(s.maxRetryDelay)
+
+		default:
+			err := send(batch)
+			if err == nil || isPermanentBatchError(err) {
+				// Batches which can never be sent are removed along with those that have been
+				s.remove(segmentPath)
+				failedAttempts = 0
+				continue
+			}
+			failedAttempts++
+			delay := backoffDelay(failedAttempts, s.baseRetryDelay, s.maxRetryDelay, 0.5)
+			var batchErr BatchError
+			if errors.As(err, &batchErr) && batchErr.RetryAfter > delay {
+				delay = batchErr.RetryAfter
+			}
+			wait = time.After(delay)
+		}
+
+		select {
+		case <-wait:
+		case <-s.written:
+			// Only skip the wait if we're not backing off from a failed attempt
+			if failedAttempts > 0 {
+				select {
+				case <-wait:
+				case <-s.stop:
+					return
+				}
+			}
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// close stops the replay loop; any segments left in the spool will be replayed the next time a spool is created in the same directory
+func (s *spool) close() {
+	s.closeOnce.Do(func() { close(s.stop) })
+}
@@ -0,0 +1,145 @@
+package logging
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSpoolSurvivesRestart(t *testing.T) {
+	directory := t.TempDir()
+	testBatch := [][]byte{[]byte("{\"dateCreated\":1}"), []byte("{\"dateCreated\":2}")}
+
+	spool, err := newSpool(directory, 1024, time.Hour, time.Millisecond, time.Millisecond)
+	require.Nil(t, err)
+	require.Nil(t, spool.write(testBatch))
+
+	// A new spool in the same directory should find the segment written by the first
+	restartedSpool, err := newSpool(directory, 1024, time.Hour, time.Millisecond, time.Millisecond)
+	require.Nil(t, err)
+	segmentPath, batch, err := restartedSpool.oldest()
+	require.Nil(t, err)
+	require.NotEqual(t, "", segmentPath)
+	assert.Equal(t, testBatch, batch)
+
+	restartedSpool.remove(segmentPath)
+	segmentPath, _, err = restartedSpool.oldest()
+	require.Nil(t, err)
+	assert.Equal(t, "", segmentPath)
+}
+
+func TestSpoolMaxSizeDropsOldestSegments(t *testing.T) {
+	spool, err := newSpool(t.TempDir(), 32, time.Hour, time.Millisecond, time.Millisecond)
+	require.Nil(t, err)
+
+	// Each of these segments will be 18 bytes, so only one will fit in the spool at a time
+	require.Nil(t, spool.write([][]byte{[]byte("{\"dateCreated\":1}")}))
+	require.Nil(t, spool.write([][]byte{[]byte("{\"dateCreated\":2}")}))
+
+	_, batch, err := spool.oldest()
+	require.Nil(t, err)
+	assert.Equal(t, [][]byte{[]byte("{\"dateCreated\":2}")}, batch)
+}
+
+func TestSpoolMaxAgeDropsOldSegments(t *testing.T) {
+	directory := t.TempDir()
+	spool, err := newSpool(directory, 1024, time.Hour, time.Millisecond, time.Millisecond)
+	require.Nil(t, err)
+	require.Nil(t, spool.write([][]byte{[]byte("{\"dateCreated\":1}")}))
+
+	// Backdate the segment so it's older than the spool's max age
+	segments, err := filepath.Glob(filepath.Join(directory, "*"+spoolSegmentExtension))
+	require.Nil(t, err)
+	require.Len(t, segments, 1)
+	twoHoursAgo := time.Now().Add(-time.Hour * 2)
+	require.Nil(t, os.Chtimes(segments[0], twoHoursAgo, twoHoursAgo))
+
+	segmentPath, _, err := spool.oldest()
+	require.Nil(t, err)
+	assert.Equal(t, "", segmentPath)
+}
+
+func TestSpoolReplaysAfterFailures(t *testing.T) {
+	spool, err := newSpool(t.TempDir(), 1024, time.Hour, time.Millisecond, time.Millisecond*10)
+	require.Nil(t, err)
+	defer spool.close()
+	require.Nil(t, spool.write([][]byte{[]byte("{\"dateCreated\":1}")}))
+
+	attempts := atomic.Int64{}
+	replayed := make(chan [][]byte, 1)
+	go spool.replay(func(batch [][]byte) error {
+		// Fail the first two attempts
+		if attempts.Add(1) <= 2 {
+			return errors.New("logging API unreachable")
+		}
+		replayed <- batch
+		return nil
+	})
+
+	select {
+	case batch := <-replayed:
+		assert.Equal(t, [][]byte{[]byte("{\"dateCreated\":1}")}, batch)
+	case <-time.After(time.Second):
+		t.Fatal("spool was not replayed")
+	}
+	assert.Equal(t, int64(3), attempts.Load())
+
+	// Once replayed, the segment should be removed from the spool
+	require.Eventually(t, func() bool {
+		segmentPath, _, err := spool.oldest()
+		return err == nil && segmentPath == ""
+	}, time.Second, time.Millisecond)
+}
+
+func TestDefaultBatchCallbackSpoolsFailedBatches(t *testing.T) {
+	apiIsUp := atomic.Bool{}
+	received := make(chan string, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !apiIsUp.Load() {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		received <- string(body)
+		w.Write([]byte("{\"message\":\"success\"}"))
+	}))
+	defer server.Close()
+
+	batchLogger := NewBatchLogger(BatchLoggerOptions{
+		MaxBatchSize:        1024 * 512,
+		MaxLogAge:           time.Minute,
+		LogApiKey:           "test-api-key",
+		LogApiUrl:           server.URL,
+		SpoolDirectory:      t.TempDir(),
+		SpoolBaseRetryDelay: time.Millisecond,
+		SpoolMaxRetryDelay:  time.Millisecond * 10,
+		RetryPolicy:         &RetryPolicy{MaxAttempts: 1},
+	})
+	defer batchLogger.Close(context.Background())
+
+	// The batch should fail to send & be spooled...
+	batchLogger.Enqueue(&LogEntry{DateCreated: 1})
+	require.Nil(t, batchLogger.Flush(context.Background()))
+	assert.Equal(t, 0, len(received))
+
+	// ...then be replayed once the API is back up
+	apiIsUp.Store(true)
+	select {
+	case body := <-received:
+		logEntry, err := UnmarshalLogEntry([]byte(body[:len(body)-1]))
+		require.Nil(t, err)
+		assert.Equal(t, int64(1), logEntry.DateCreated)
+	case <-time.After(time.Second):
+		t.Fatal("spooled batch was not replayed")
+	}
+}
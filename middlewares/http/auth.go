@@ -0,0 +1,249 @@
+package firetail
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/FireTail-io/firetail-go-lib/logging"
+	"github.com/getkin/kin-openapi/openapi3filter"
+	"github.com/getkin/kin-openapi/routers"
+)
+
+// ErrCredentialsMissing is wrapped by the errors returned from the built-in auth callbacks when a request doesn't include the credentials
+// required by a security scheme
+var ErrCredentialsMissing = errors.New("credentials missing")
+
+// ErrCredentialsInvalid is wrapped by the errors returned from the built-in auth callbacks when a request includes credentials for a
+// security scheme, but they couldn't be verified
+var ErrCredentialsInvalid = errors.New("credentials invalid")
+
+// The key under which an authValues is stored in the context given to auth callbacks
+type authValuesKey struct{}
+
+// authValues collects the values which an auth callback wants to pass on to the next handler in the request's context, such as the claims
+// of a verified JWT. Auth callbacks can't modify the request themselves, so the middleware adds the values once the request has been
+// validated
+type authValues struct {
+	mutex  sync.Mutex
+	values map[interface{}]interface{}
+}
+
+// setAuthContextValue stores a value which the middleware will add to the request's context under the given key once the request has been
+// validated. If the context didn't come from the middleware, e.g. if an auth callback is used elsewhere, it does nothing
+func setAuthContextValue(ctx context.Context, key interface{}, value interface{}) {
+	values, hasValues := ctx.Value(authValuesKey{}).(*authValues)
+	if !hasValues {
+		return
+	}
+	values.mutex.Lock()
+	defer values.mutex.Unlock()
+	if values.values == nil {
+		values.values = map[interface{}]interface{}{}
+	}
+	values.values[key] = value
+}
+
+// authState records each call made to an auth callback whilst a request is validated, and the values it stored, so that only the values
+// stored by the callbacks of the security requirement which passed are passed on to the next handler. Otherwise, if the first scheme of
+// an AND-requirement succeeded but the second failed, the values from the first would leak into a request authenticated by another
+// requirement
+type authState struct {
+	mutex    sync.Mutex
+	attempts []authAttempt
+}
+
+// authAttempt is a call made to an auth callback whilst validating a request
+type authAttempt struct {
+	securitySchemeName string
+	err                error // The error the auth callback returned, or nil if it succeeded
+	values             *authValues
+}
+
+// authenticate calls an auth callback, recording the error it returned and the values it stored
+func (s *authState) authenticate(ctx context.Context, ai *openapi3filter.AuthenticationInput, authCallback openapi3filter.AuthenticationFunc) error {
+	values := &authValues{}
+	err := authCallback(context.WithValue(ctx, authValuesKey{}, values), ai)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.attempts = append(s.attempts, authAttempt{ai.SecuritySchemeName, err, values})
+	return err
+}
+
+// passedValues returns the values stored by the auth callbacks of the security requirement of the route which the request passed, or nil
+// if it passed none. The calls made to the auth callbacks are matched up with the requirements by replaying the order in which openapi3filter
+// evaluates them: each requirement in turn, and each of its schemes in alphabetical order, stopping at the first scheme which fails and the
+// first requirement which passes
+func (s *authState) passedValues(route *routers.Route) map[interface{}]interface{} {
+	securityRequirements := getSecurityRequirements(route)
+	if securityRequirements == nil {
+		return nil
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	attempts := s.attempts
+	for _, securityRequirement := range *securityRequirements {
+		schemeNames := []string{}
+		for schemeName := range securityRequirement {
+			schemeNames = append(schemeNames, schemeName)
+		}
+		sort.Strings(schemeNames)
+
+		passedValues, passed := map[interface{}]interface{}{}, true
+		for _, schemeName := range schemeNames {
+			// openapi3filter fails a requirement without calling the auth callback if it uses a scheme that isn't declared
+			if schemeRef := route.Spec.Components.SecuritySchemes[schemeName]; schemeRef == nil || schemeRef.Value == nil {
+				passed = false
+				break
+			}
+			if len(attempts) == 0 || attempts[0].securitySchemeName != schemeName {
+				// The requirement wasn't evaluated, e.g. because the request failed validation before its security was checked
+				return nil
+			}
+			attempt := attempts[0]
+			attempts = attempts[1:]
+			if attempt.err != nil {
+				passed = false
+				break
+			}
+			attempt.values.mutex.Lock()
+			for key, value := range attempt.values.values {
+				passedValues[key] = value
+			}
+			attempt.values.mutex.Unlock()
+		}
+		if passed {
+			return passedValues
+		}
+	}
+	return nil
+}
+
+// invalidCredentialsSchemes returns the names of the security schemes whose auth callbacks returned an error wrapping ErrCredentialsInvalid
+func (s *authState) invalidCredentialsSchemes() map[string]bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	invalidSchemes := map[string]bool{}
+	for _, attempt := range s.attempts {
+		if errors.Is(attempt.err, ErrCredentialsInvalid) {
+			invalidSchemes[attempt.securitySchemeName] = true
+		}
+	}
+	return invalidSchemes
+}
+
+// withAuthValues returns a copy of ctx with all of the given values set by auth callbacks
+func withAuthValues(ctx context.Context, values map[interface{}]interface{}) context.Context {
+	for key, value := range values {
+		ctx = context.WithValue(ctx, key, value)
+	}
+	return ctx
+}
+
+// Principal describes the caller who made a request, as authenticated by an auth callback
+type Principal struct {
+	Subject            string   // The user or client who made the request, e.g. the "sub" claim of a JWT or a basic auth username
+	Tenant             string   // The tenant or organisation to which the subject belongs, if any
+	Scopes             []string // The scopes granted to the subject
+	SecuritySchemeName string   // The name of the security scheme in the OpenAPI spec by which the subject was authenticated
+}
+
+// The key under which the Principal authenticated for a request is stored in its context
+type principalKey struct{}
+
+// SetPrincipal records the principal an auth callback has authenticated, and should be called with the context given to the callback.
+// Once the request has been validated, the middleware adds the principal to the request's context, from which handlers can get it via
+// GetPrincipal, and records it in the identity of the request's log entry. The built-in auth callbacks all call it when they succeed
+func SetPrincipal(ctx context.Context, principal Principal) {
+	setAuthContextValue(ctx, principalKey{}, principal)
+}
+
+// GetPrincipal returns the principal authenticated by an auth callback from the context of a request which the middleware has validated.
+// If no auth callback recorded a principal, the second return value is false
+func GetPrincipal(ctx context.Context) (Principal, bool) {
+	principal, ok := ctx.Value(principalKey{}).(Principal)
+	return principal, ok
+}
+
+// getIdentity converts a Principal into the identity recorded in log entries
+func getIdentity(principal Principal) *logging.Identity {
+	return &logging.Identity{
+		Subject:        principal.Subject,
+		Tenant:         principal.Tenant,
+		Scopes:         principal.Scopes,
+		SecurityScheme: principal.SecuritySchemeName,
+	}
+}
+
+// NewAPIKeyAuthCallback returns an auth callback, for use in the AuthCallbacks option, for security schemes of type apiKey. It reads the
+// API key from the header, query parameter or cookie which the scheme names in the OpenAPI spec, and checks it against the store
+func NewAPIKeyAuthCallback(store CredentialStore) openapi3filter.AuthenticationFunc {
+	return func(ctx context.Context, ai *openapi3filter.AuthenticationInput) error {
+		if ai.SecurityScheme == nil || ai.SecurityScheme.Type != "apiKey" {
+			return fmt.Errorf("the security scheme \"%s\" is not an apiKey scheme", ai.SecuritySchemeName)
+		}
+
+		apiKey, err := getAPIKey(ai.RequestValidationInput.Request, ai.SecurityScheme.In, ai.SecurityScheme.Name)
+		if err != nil {
+			return fmt.Errorf("the security scheme \"%s\" is invalid: %w", ai.SecuritySchemeName, err)
+		}
+		if apiKey == "" {
+			return fmt.Errorf("%w: no API key supplied for \"%s\"", ErrCredentialsMissing, ai.SecuritySchemeName)
+		}
+
+		name, valid := store.VerifyCredentials("", apiKey)
+		if !valid {
+			return fmt.Errorf("%w: invalid API key supplied for \"%s\"", ErrCredentialsInvalid, ai.SecuritySchemeName)
+		}
+		SetPrincipal(ctx, Principal{Subject: name, SecuritySchemeName: ai.SecuritySchemeName})
+		return nil
+	}
+}
+
+// getAPIKey returns the value of the header, query parameter or cookie with the given name, or an empty string if the request has none
+func getAPIKey(r *http.Request, in string, name string) (string, error) {
+	switch in {
+	case "header":
+		return r.Header.Get(name), nil
+	case "query":
+		return r.URL.Query().Get(name), nil
+	case "cookie":
+		cookie, err := r.Cookie(name)
+		if err != nil {
+			return "", nil
+		}
+		return cookie.Value, nil
+	default:
+		return "", fmt.Errorf("unsupported API key location \"%s\"", in)
+	}
+}
+
+// NewBasicAuthCallback returns an auth callback, for use in the AuthCallbacks option, for security schemes of type http with the basic
+// scheme. It reads the username & password from the Authorization header and checks them against the store
+func NewBasicAuthCallback(store CredentialStore) openapi3filter.AuthenticationFunc {
+	return func(ctx context.Context, ai *openapi3filter.AuthenticationInput) error {
+		if ai.SecurityScheme == nil || ai.SecurityScheme.Type != "http" || !strings.EqualFold(ai.SecurityScheme.Scheme, "basic") {
+			return fmt.Errorf("the security scheme \"%s\" is not an http basic scheme", ai.SecuritySchemeName)
+		}
+
+		username, password, hasBasicAuth := ai.RequestValidationInput.Request.BasicAuth()
+		if !hasBasicAuth {
+			return fmt.Errorf("%w: no basic auth credentials supplied for \"%s\"", ErrCredentialsMissing, ai.SecuritySchemeName)
+		}
+		if username == "" {
+			return fmt.Errorf("%w: no username supplied for \"%s\"", ErrCredentialsInvalid, ai.SecuritySchemeName)
+		}
+
+		name, valid := store.VerifyCredentials(username, password)
+		if !valid {
+			return fmt.Errorf("%w: invalid basic auth credentials supplied for \"%s\"", ErrCredentialsInvalid, ai.SecuritySchemeName)
+		}
+		SetPrincipal(ctx, Principal{Subject: name, SecuritySchemeName: ai.SecuritySchemeName})
+		return nil
+	}
+}
@@ -0,0 +1,161 @@
+package firetail
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/getkin/kin-openapi/openapi3"
+	"github.com/getkin/kin-openapi/routers"
+)
+
+// The error codes which RFC6750 defines for Bearer challenges
+const (
+	bearerErrorInvalidToken      = "invalid_token"
+	bearerErrorInsufficientScope = "insufficient_scope"
+)
+
+// addAuthChallenges fills in the WWW-Authenticate challenges of an auth ErrorAtRequest, including any within an ErrorRequestInvalid, from
+// the security schemes of the route the request matched. As RFC6750 requires, the invalid_token error is only included in the challenges
+// of the schemes in invalidSchemes, whose credentials were given but invalid, not those whose credentials were missing. Other errors are
+// returned unchanged
+func addAuthChallenges(errAtRequest ErrorAtRequest, route *routers.Route, realm string, invalidSchemes map[string]bool) ErrorAtRequest {
+	switch err := errAtRequest.(type) {
+	case ErrorAuthNoMatchingScheme:
+		err.Challenges = getAuthChallenges(route, realm, nil, "")
+		return err
+	case ErrorAuthCredentialsMissing:
+		err.Challenges = getAuthChallenges(route, realm, nil, "")
+		return err
+	case ErrorAuthCredentialsInvalid:
+		bearerErrors := map[string]string{}
+		for schemeName := range invalidSchemes {
+			bearerErrors[schemeName] = bearerErrorInvalidToken
+		}
+		err.Challenges = getAuthChallenges(route, realm, bearerErrors, "")
+		return err
+	case ErrorAuthInsufficientScope:
+		bearerErrors := map[string]string{err.SecuritySchemeName: bearerErrorInsufficientScope}
+		err.Challenges = getAuthChallenges(route, realm, bearerErrors, err.SecuritySchemeName)
+		return err
+	case ErrorRequestInvalid:
+		errs := make([]ErrorAtRequest, len(err.Errs))
+		for i, subErr := range err.Errs {
+			errs[i] = addAuthChallenges(subErr, route, realm, invalidSchemes)
+		}
+		err.Errs = errs
+		return err
+	default:
+		return errAtRequest
+	}
+}
+
+// getErrAuthChallenges returns the WWW-Authenticate challenges of an ErrorAtRequest, if it has any. For an ErrorRequestInvalid, the
+// challenges of its first error are used, as that's the error its status code is taken from
+func getErrAuthChallenges(errAtRequest ErrorAtRequest) []string {
+	switch err := errAtRequest.(type) {
+	case ErrorAuthNoMatchingScheme:
+		return err.Challenges
+	case ErrorAuthCredentialsMissing:
+		return err.Challenges
+	case ErrorAuthCredentialsInvalid:
+		return err.Challenges
+	case ErrorAuthInsufficientScope:
+		return err.Challenges
+	case ErrorRequestInvalid:
+		if len(err.Errs) > 0 {
+			return getErrAuthChallenges(err.Errs[0])
+		}
+	}
+	return nil
+}
+
+// getAuthChallenges returns a WWW-Authenticate challenge for each of the http basic, http bearer, oauth2 and openIdConnect security
+// schemes in the security requirements of a route's operation, or of the spec if the operation has none, in the order they're listed.
+// apiKey schemes have no standard challenge, so they're skipped. Bearer challenges include the scopes of the requirement and the RFC6750
+// error code given for the scheme in bearerErrors, if any. If onlyScheme is set, only the challenges for the security scheme with that name
+// are returned
+func getAuthChallenges(route *routers.Route, realm string, bearerErrors map[string]string, onlyScheme string) []string {
+	securityRequirements := getSecurityRequirements(route)
+	if securityRequirements == nil {
+		return nil
+	}
+	if realm == "" && route.Spec.Info != nil {
+		realm = route.Spec.Info.Title
+	}
+
+	challenges, seenChallenges := []string{}, map[string]bool{}
+	for _, securityRequirement := range *securityRequirements {
+		schemeNames := []string{}
+		for schemeName := range securityRequirement {
+			schemeNames = append(schemeNames, schemeName)
+		}
+		sort.Strings(schemeNames)
+
+		for _, schemeName := range schemeNames {
+			if onlyScheme != "" && schemeName != onlyScheme {
+				continue
+			}
+			schemeRef := route.Spec.Components.SecuritySchemes[schemeName]
+			if schemeRef == nil || schemeRef.Value == nil {
+				continue
+			}
+			challenge := getAuthChallenge(schemeRef.Value, realm, securityRequirement[schemeName], bearerErrors[schemeName])
+			if challenge != "" && !seenChallenges[challenge] {
+				challenges = append(challenges, challenge)
+				seenChallenges[challenge] = true
+			}
+		}
+	}
+	return challenges
+}
+
+// getSecurityRequirements returns the security requirements of a route's operation, or of the spec if the operation has none, or nil if the
+// route has no operation
+func getSecurityRequirements(route *routers.Route) *openapi3.SecurityRequirements {
+	if route == nil || route.Spec == nil || route.Operation == nil {
+		return nil
+	}
+	if route.Operation.Security != nil {
+		return route.Operation.Security
+	}
+	return &route.Spec.Security
+}
+
+// getAuthChallenge returns the WWW-Authenticate challenge for a security scheme, or an empty string if it has no standard challenge
+func getAuthChallenge(scheme *openapi3.SecurityScheme, realm string, scopes []string, bearerError string) string {
+	switch {
+	case scheme.Type == "http" && strings.EqualFold(scheme.Scheme, "basic"):
+		// RFC7617 requires a realm for Basic challenges
+		return "Basic realm=" + quoteAuthParam(realm)
+
+	case scheme.Type == "oauth2" || scheme.Type == "openIdConnect" || (scheme.Type == "http" && strings.EqualFold(scheme.Scheme, "bearer")):
+		params := []string{}
+		if realm != "" {
+			params = append(params, "realm="+quoteAuthParam(realm))
+		}
+		if len(scopes) > 0 {
+			params = append(params, "scope="+quoteAuthParam(strings.Join(scopes, " ")))
+		}
+		switch bearerError {
+		case bearerErrorInvalidToken:
+			params = append(params, "error="+quoteAuthParam(bearerError), "error_description="+quoteAuthParam("The access token is invalid"))
+		case bearerErrorInsufficientScope:
+			params = append(params,
+				"error="+quoteAuthParam(bearerError),
+				"error_description="+quoteAuthParam("The access token does not grant the required scopes"),
+			)
+		}
+		if len(params) == 0 {
+			return "Bearer"
+		}
+		return "Bearer " + strings.Join(params, ", ")
+
+	default:
+		return ""
+	}
+}
+
+// quoteAuthParam formats a value as a quoted-string for an auth-param of a WWW-Authenticate challenge
+func quoteAuthParam(value string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(value) + `"`
+}
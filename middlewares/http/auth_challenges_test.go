@@ -0,0 +1,142 @@
+package firetail
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/getkin/kin-openapi/openapi3filter"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func getTestAuthChallengeHandler(t *testing.T, options *Options) http.Handler {
+	secret := []byte("test-secret")
+	jwtAuthCallback, err := NewJWTAuthCallback(JWTOptions{Keys: map[string]interface{}{"test-key": secret}})
+	require.Nil(t, err)
+	options.OpenapiSpecPath = "./test-spec.yaml"
+	options.EnableRequestValidation = true
+	options.AuthCallbacks = map[string]openapi3filter.AuthenticationFunc{
+		"BearerAuth": jwtAuthCallback,
+		"OAuth2Auth": jwtAuthCallback,
+		"BasicAuth":  NewBasicAuthCallback(StaticCredentials{"alice": "alice-secret"}),
+	}
+	middleware, err := GetMiddleware(options)
+	require.Nil(t, err)
+	return middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+	}))
+}
+
+func getTestProblemTitle(t *testing.T, responseRecorder *httptest.ResponseRecorder) string {
+	var problem struct {
+		Title string `json:"title"`
+	}
+	require.Nil(t, json.Unmarshal(responseRecorder.Body.Bytes(), &problem))
+	return problem.Title
+}
+
+func TestAuthCredentialsMissing(t *testing.T) {
+	handler := getTestAuthChallengeHandler(t, &Options{})
+	responseRecorder := httptest.NewRecorder()
+	handler.ServeHTTP(responseRecorder, httptest.NewRequest("GET", "/basic-or-bearer-auth", nil))
+
+	assert.Equal(t, 401, responseRecorder.Code)
+	assert.Equal(t, "you need to authenticate to do this", getTestProblemTitle(t, responseRecorder))
+	assert.Equal(
+		t,
+		[]string{`Bearer realm="Test Spec"`, `Basic realm="Test Spec"`},
+		responseRecorder.Result().Header.Values("WWW-Authenticate"),
+	)
+}
+
+func TestAuthCredentialsInvalid(t *testing.T) {
+	handler := getTestAuthChallengeHandler(t, &Options{AuthRealm: "test-realm"})
+
+	request := httptest.NewRequest("GET", "/basic-or-bearer-auth", nil)
+	request.Header.Set("Authorization", "Bearer not-a-jwt")
+	responseRecorder := httptest.NewRecorder()
+	handler.ServeHTTP(responseRecorder, request)
+
+	assert.Equal(t, 401, responseRecorder.Code)
+	assert.Equal(t, "your credentials are invalid", getTestProblemTitle(t, responseRecorder))
+	assert.Equal(
+		t,
+		[]string{
+			`Bearer realm="test-realm", error="invalid_token", error_description="The access token is invalid"`,
+			`Basic realm="test-realm"`,
+		},
+		responseRecorder.Result().Header.Values("WWW-Authenticate"),
+	)
+
+	request = httptest.NewRequest("GET", "/basic-or-bearer-auth", nil)
+	request.SetBasicAuth("alice", "wrong-secret")
+	responseRecorder = httptest.NewRecorder()
+	handler.ServeHTTP(responseRecorder, request)
+	assert.Equal(t, 401, responseRecorder.Code)
+	assert.Equal(t, "your credentials are invalid", getTestProblemTitle(t, responseRecorder))
+	// No bearer token was sent, so the Bearer challenge shouldn't say that one was invalid
+	assert.Equal(
+		t,
+		[]string{`Bearer realm="test-realm"`, `Basic realm="test-realm"`},
+		responseRecorder.Result().Header.Values("WWW-Authenticate"),
+	)
+
+	request = httptest.NewRequest("GET", "/basic-or-bearer-auth", nil)
+	request.SetBasicAuth("alice", "alice-secret")
+	responseRecorder = httptest.NewRecorder()
+	handler.ServeHTTP(responseRecorder, request)
+	assert.Equal(t, 200, responseRecorder.Code)
+	assert.Empty(t, responseRecorder.Result().Header.Values("WWW-Authenticate"))
+}
+
+func TestAuthInsufficientScope(t *testing.T) {
+	handler := getTestAuthChallengeHandler(t, &Options{})
+
+	request := httptest.NewRequest("GET", "/oauth2-auth", nil)
+	request.Header.Set("Authorization", "Bearer "+signTestJWT(t, jwt.SigningMethodHS256, []byte("test-secret"), "test-key", jwt.MapClaims{
+		"exp":   time.Now().Add(time.Hour).Unix(),
+		"scope": "pets:write",
+	}))
+	responseRecorder := httptest.NewRecorder()
+	handler.ServeHTTP(responseRecorder, request)
+
+	assert.Equal(t, 403, responseRecorder.Code)
+	assert.Equal(t, "you don't have permission to do this", getTestProblemTitle(t, responseRecorder))
+	assert.Equal(
+		t,
+		[]string{
+			`Bearer realm="Test Spec", scope="pets:read", error="insufficient_scope", ` +
+				`error_description="The access token does not grant the required scopes"`,
+		},
+		responseRecorder.Result().Header.Values("WWW-Authenticate"),
+	)
+}
+
+func TestGetSecurityRequirementsErr(t *testing.T) {
+	unknownErr := errors.New("unknown error")
+	testCases := map[string]struct {
+		errs         []error
+		expectedType ErrorAtRequest
+	}{
+		"all missing":     {[]error{ErrCredentialsMissing, ErrCredentialsMissing}, ErrorAuthCredentialsMissing{}},
+		"any invalid":     {[]error{ErrCredentialsMissing, ErrCredentialsInvalid}, ErrorAuthCredentialsInvalid{}},
+		"scope over all":  {[]error{ErrCredentialsInvalid, ErrorAuthInsufficientScope{}}, ErrorAuthInsufficientScope{}},
+		"unknown errors":  {[]error{ErrCredentialsMissing, unknownErr}, ErrorAuthNoMatchingScheme{}},
+		"not implemented": {[]error{ErrorAuthSchemeNotImplemented{"test"}}, ErrorAuthNoMatchingScheme{}},
+	}
+	for name, testCase := range testCases {
+		t.Run(name, func(t *testing.T) {
+			errAtRequest := getSecurityRequirementsErr(&openapi3filter.SecurityRequirementsError{Errors: testCase.errs})
+			assert.IsType(t, testCase.expectedType, errAtRequest)
+		})
+	}
+}
+
+func TestQuoteAuthParam(t *testing.T) {
+	assert.Equal(t, `"my \"quoted\" realm \\ test"`, quoteAuthParam(`my "quoted" realm \ test`))
+}
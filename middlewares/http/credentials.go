@@ -0,0 +1,120 @@
+package firetail
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/subtle"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// A CredentialStore verifies the credentials read by the auth callbacks created by NewAPIKeyAuthCallback and NewBasicAuthCallback
+type CredentialStore interface {
+	// VerifyCredentials returns the name to which a secret belongs and true if the secret is valid, or false if it isn't. For HTTP basic
+	// auth, the username from the request is given and only its secret should be accepted. For API keys, the username is empty and a
+	// secret belonging to any name should be accepted
+	VerifyCredentials(username string, secret string) (string, bool)
+}
+
+// StaticCredentials is a CredentialStore of plaintext secrets, such as API keys or passwords, by the name to which they belong. Secrets
+// are compared in constant time
+type StaticCredentials map[string]string
+
+func (c StaticCredentials) VerifyCredentials(username string, secret string) (string, bool) {
+	if username != "" {
+		expectedSecret, hasUser := c[username]
+		// If there's no such user we still compare the secret, so the response time doesn't reveal which users exist
+		if secretsEqual(expectedSecret, secret) && hasUser {
+			return username, true
+		}
+		return "", false
+	}
+
+	// We compare the secret to every entry, rather than stopping at a match, so the response time doesn't reveal which entry matched
+	matchedName, matched := "", false
+	for name, expectedSecret := range c {
+		if secretsEqual(expectedSecret, secret) && !matched {
+			matchedName, matched = name, true
+		}
+	}
+	return matchedName, matched
+}
+
+// secretsEqual compares two secrets in constant time. They're hashed first so that the time taken doesn't reveal their lengths either
+func secretsEqual(expected string, actual string) bool {
+	expectedHash, actualHash := sha256.Sum256([]byte(expected)), sha256.Sum256([]byte(actual))
+	return subtle.ConstantTimeCompare(expectedHash[:], actualHash[:]) == 1
+}
+
+// BcryptCredentials is a CredentialStore of bcrypt hashes of secrets, such as API keys or passwords, by the name to which they belong.
+// Verifying an API key requires comparing it to every hash, so it's best suited to HTTP basic auth or small numbers of API keys
+type BcryptCredentials map[string]string
+
+func (c BcryptCredentials) VerifyCredentials(username string, secret string) (string, bool) {
+	if username != "" {
+		hash, hasUser := c[username]
+		if !hasUser {
+			// If there's no such user we still compare the secret to a hash, so the response time doesn't reveal which users exist
+			bcrypt.CompareHashAndPassword(getDummyBcryptHash(), []byte(secret))
+			return "", false
+		}
+		if bcrypt.CompareHashAndPassword([]byte(hash), []byte(secret)) != nil {
+			return "", false
+		}
+		return username, true
+	}
+
+	matchedName, matched := "", false
+	for name, hash := range c {
+		if bcrypt.CompareHashAndPassword([]byte(hash), []byte(secret)) == nil && !matched {
+			matchedName, matched = name, true
+		}
+	}
+	return matchedName, matched
+}
+
+var dummyBcryptHash []byte
+var dummyBcryptHashOnce sync.Once
+
+// getDummyBcryptHash returns a bcrypt hash of a random secret, generated once, for comparing secrets to when a user doesn't exist
+func getDummyBcryptHash() []byte {
+	dummyBcryptHashOnce.Do(func() {
+		dummyBcryptHash, _ = bcrypt.GenerateFromPassword([]byte("firetail-dummy-secret"), bcrypt.DefaultCost)
+	})
+	return dummyBcryptHash
+}
+
+// LoadHtpasswdFile reads a htpasswd-style file of "name:hash" lines into a BcryptCredentials. Blank lines and lines starting with "#" are
+// skipped. Only bcrypt hashes (e.g. from "htpasswd -B") are supported, as the other formats htpasswd can produce are too weak to be used
+func LoadHtpasswdFile(path string) (BcryptCredentials, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	credentials := BcryptCredentials{}
+	scanner := bufio.NewScanner(file)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, hash, found := strings.Cut(line, ":")
+		if !found || name == "" {
+			return nil, fmt.Errorf("%s:%d: expected a line of the form \"name:hash\"", path, lineNumber)
+		}
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return nil, fmt.Errorf("%s:%d: the hash for \"%s\" is not a bcrypt hash: %w", path, lineNumber, name, err)
+		}
+		credentials[name] = hash
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return credentials, nil
+}
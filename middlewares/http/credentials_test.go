@@ -0,0 +1,183 @@
+package firetail
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/getkin/kin-openapi/openapi3"
+	"github.com/getkin/kin-openapi/openapi3filter"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func getTestBcryptHash(t *testing.T, secret string) string {
+	hash, err := bcrypt.GenerateFromPassword([]byte(secret), bcrypt.MinCost)
+	require.Nil(t, err)
+	return string(hash)
+}
+
+func callTestAuthCallback(callback openapi3filter.AuthenticationFunc, scheme *openapi3.SecurityScheme, request *http.Request) error {
+	return callback(context.Background(), &openapi3filter.AuthenticationInput{
+		RequestValidationInput: &openapi3filter.RequestValidationInput{Request: request},
+		SecuritySchemeName:     "TestAuth",
+		SecurityScheme:         scheme,
+	})
+}
+
+func TestStaticCredentials(t *testing.T) {
+	credentials := StaticCredentials{"alice": "alice-secret", "bob": "bob-secret"}
+
+	name, valid := credentials.VerifyCredentials("alice", "alice-secret")
+	assert.True(t, valid)
+	assert.Equal(t, "alice", name)
+
+	_, valid = credentials.VerifyCredentials("alice", "bob-secret")
+	assert.False(t, valid)
+	_, valid = credentials.VerifyCredentials("carol", "")
+	assert.False(t, valid)
+
+	name, valid = credentials.VerifyCredentials("", "bob-secret")
+	assert.True(t, valid)
+	assert.Equal(t, "bob", name)
+
+	_, valid = credentials.VerifyCredentials("", "carol-secret")
+	assert.False(t, valid)
+}
+
+func TestBcryptCredentials(t *testing.T) {
+	credentials := BcryptCredentials{"alice": getTestBcryptHash(t, "alice-secret"), "bob": getTestBcryptHash(t, "bob-secret")}
+
+	name, valid := credentials.VerifyCredentials("alice", "alice-secret")
+	assert.True(t, valid)
+	assert.Equal(t, "alice", name)
+
+	_, valid = credentials.VerifyCredentials("alice", "bob-secret")
+	assert.False(t, valid)
+	_, valid = credentials.VerifyCredentials("carol", "alice-secret")
+	assert.False(t, valid)
+
+	name, valid = credentials.VerifyCredentials("", "bob-secret")
+	assert.True(t, valid)
+	assert.Equal(t, "bob", name)
+}
+
+func TestLoadHtpasswdFile(t *testing.T) {
+	htpasswdPath := filepath.Join(t.TempDir(), ".htpasswd")
+	htpasswd := "# Test users\nalice:" + getTestBcryptHash(t, "alice-secret") + "\n\nbob:" + getTestBcryptHash(t, "bob-secret") + "\n"
+	require.Nil(t, os.WriteFile(htpasswdPath, []byte(htpasswd), 0600))
+
+	credentials, err := LoadHtpasswdFile(htpasswdPath)
+	require.Nil(t, err)
+	assert.Len(t, credentials, 2)
+	_, valid := credentials.VerifyCredentials("bob", "bob-secret")
+	assert.True(t, valid)
+
+	require.Nil(t, os.WriteFile(htpasswdPath, []byte("alice:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=\n"), 0600))
+	_, err = LoadHtpasswdFile(htpasswdPath)
+	assert.NotNil(t, err)
+
+	_, err = LoadHtpasswdFile(filepath.Join(t.TempDir(), "missing"))
+	assert.NotNil(t, err)
+}
+
+func TestAPIKeyAuthCallback(t *testing.T) {
+	apiKeyAuthCallback := NewAPIKeyAuthCallback(StaticCredentials{"test-client": "valid-api-key"})
+
+	testCases := map[string]struct {
+		in         string
+		setAPIKey  func(r *http.Request, apiKey string)
+		apiKey     string
+		expectedIs error
+	}{
+		"valid header":   {"header", func(r *http.Request, apiKey string) { r.Header.Set("X-Api-Key", apiKey) }, "valid-api-key", nil},
+		"invalid header": {"header", func(r *http.Request, apiKey string) { r.Header.Set("X-Api-Key", apiKey) }, "invalid-api-key", ErrCredentialsInvalid},
+		"missing header": {"header", func(r *http.Request, apiKey string) {}, "", ErrCredentialsMissing},
+		"valid query": {"query", func(r *http.Request, apiKey string) {
+			r.URL.RawQuery = "X-Api-Key=" + apiKey
+		}, "valid-api-key", nil},
+		"invalid query": {"query", func(r *http.Request, apiKey string) {
+			r.URL.RawQuery = "X-Api-Key=" + apiKey
+		}, "invalid-api-key", ErrCredentialsInvalid},
+		"valid cookie": {"cookie", func(r *http.Request, apiKey string) {
+			r.AddCookie(&http.Cookie{Name: "X-Api-Key", Value: apiKey})
+		}, "valid-api-key", nil},
+		"missing cookie": {"cookie", func(r *http.Request, apiKey string) {}, "", ErrCredentialsMissing},
+	}
+	for name, testCase := range testCases {
+		t.Run(name, func(t *testing.T) {
+			request := httptest.NewRequest("GET", "/", nil)
+			testCase.setAPIKey(request, testCase.apiKey)
+			err := callTestAuthCallback(
+				apiKeyAuthCallback,
+				&openapi3.SecurityScheme{Type: "apiKey", In: testCase.in, Name: "X-Api-Key"},
+				request,
+			)
+			if testCase.expectedIs == nil {
+				assert.Nil(t, err)
+			} else {
+				assert.True(t, errors.Is(err, testCase.expectedIs))
+			}
+		})
+	}
+
+	err := callTestAuthCallback(apiKeyAuthCallback, &openapi3.SecurityScheme{Type: "http", Scheme: "basic"}, httptest.NewRequest("GET", "/", nil))
+	assert.NotNil(t, err)
+}
+
+func TestAPIKeyAuthCallbackInMiddleware(t *testing.T) {
+	apiKeyAuthCallback := NewAPIKeyAuthCallback(StaticCredentials{"test-client": "valid-api-key"})
+	middleware, err := GetMiddleware(&Options{
+		OpenapiSpecPath: "./test-spec.yaml",
+		AuthCallbacks: map[string]openapi3filter.AuthenticationFunc{
+			"ApiKeyAuth1": apiKeyAuthCallback,
+			"ApiKeyAuth2": apiKeyAuthCallback,
+		},
+		EnableRequestValidation: true,
+	})
+	require.Nil(t, err)
+	handler := middleware(healthHandler)
+
+	for apiKey, expectedCode := range map[string]int{"valid-api-key": 200, "invalid-api-key": 401} {
+		request := httptest.NewRequest(
+			"POST", "/implemented/1",
+			io.NopCloser(bytes.NewBuffer([]byte("{\"description\":\"test description\"}"))),
+		)
+		request.Header.Add("Content-Type", "application/json")
+		request.Header.Add("X-Api-Key", apiKey)
+		responseRecorder := httptest.NewRecorder()
+		handler.ServeHTTP(responseRecorder, request)
+		assert.Equal(t, expectedCode, responseRecorder.Code)
+	}
+}
+
+func TestBasicAuthCallback(t *testing.T) {
+	basicAuthCallback := NewBasicAuthCallback(BcryptCredentials{"alice": getTestBcryptHash(t, "alice-secret")})
+	scheme := &openapi3.SecurityScheme{Type: "http", Scheme: "basic"}
+
+	request := httptest.NewRequest("GET", "/", nil)
+	request.SetBasicAuth("alice", "alice-secret")
+	assert.Nil(t, callTestAuthCallback(basicAuthCallback, scheme, request))
+
+	request = httptest.NewRequest("GET", "/", nil)
+	request.SetBasicAuth("alice", "wrong-secret")
+	assert.True(t, errors.Is(callTestAuthCallback(basicAuthCallback, scheme, request), ErrCredentialsInvalid))
+
+	request = httptest.NewRequest("GET", "/", nil)
+	request.SetBasicAuth("bob", "alice-secret")
+	assert.True(t, errors.Is(callTestAuthCallback(basicAuthCallback, scheme, request), ErrCredentialsInvalid))
+
+	request = httptest.NewRequest("GET", "/", nil)
+	assert.True(t, errors.Is(callTestAuthCallback(basicAuthCallback, scheme, request), ErrCredentialsMissing))
+
+	request = httptest.NewRequest("GET", "/", nil)
+	request.SetBasicAuth("alice", "alice-secret")
+	assert.NotNil(t, callTestAuthCallback(basicAuthCallback, &openapi3.SecurityScheme{Type: "http", Scheme: "bearer"}, request))
+}
@@ -2,7 +2,10 @@ package firetail
 
 import (
 	"fmt"
+	"reflect"
+	"strings"
 
+	"github.com/FireTail-io/firetail-go-lib/logging"
 	"github.com/getkin/kin-openapi/openapi3filter"
 )
 
@@ -36,6 +39,11 @@ type ErrorAtRequest interface {
 	Title() string
 }
 
+// getErrorType returns the name of the type of an ErrorAtRequest, e.g. "ErrorRequestBodyInvalid", as used in logs, spans & metrics
+func getErrorType(errAtRequest ErrorAtRequest) string {
+	return reflect.TypeOf(errAtRequest).Name()
+}
+
 // ErrorAtRequestUnspecified is used to wrap errors that are returned at request time, but aren't able to be broken down into more useful information
 type ErrorAtRequestUnspecified struct {
 	Err error
@@ -125,6 +133,29 @@ func (e ErrorRequestContentTypeInvalid) Error() string {
 	return fmt.Sprintf("the path for \"%s\" in your appspec does not support content type \"%s\"", e.RequestedRoute, e.RequestedContentType)
 }
 
+// ErrorNotAcceptable is used when EnforceAcceptHeader is enabled and none of the media types a request's Accept header accepts are
+// declared for the responses of the operation it matched in the OpenAPI spec
+type ErrorNotAcceptable struct {
+	RequestedAccept     string   // The Accept header of the request
+	RequestedRoute      string   // The route in the OpenAPI spec which the request matched
+	AvailableMediaTypes []string // The media types declared for the responses of the route's operation
+}
+
+func (e ErrorNotAcceptable) StatusCode() int {
+	return 406
+}
+
+func (e ErrorNotAcceptable) Title() string {
+	return fmt.Sprintf("the resource \"%s\" can't respond with any of the content types you accept", e.RequestedRoute)
+}
+
+func (e ErrorNotAcceptable) Error() string {
+	return fmt.Sprintf(
+		"the path for \"%s\" in your appspec doesn't have a response with any of the content types accepted by \"%s\": \"%s\"",
+		e.RequestedRoute, e.RequestedAccept, strings.Join(e.AvailableMediaTypes, "\", \""),
+	)
+}
+
 // ErrorRequestQueryParamsInvalid is used when the query params of a request don't conform to the schema in the OpenAPI spec
 type ErrorRequestQueryParamsInvalid struct {
 	Err error
@@ -159,6 +190,23 @@ func (e ErrorRequestPathParamsInvalid) Error() string {
 	return fmt.Sprintf("the request's path parameters did not match your appspec: %s", e.Err.Error())
 }
 
+// ErrorRequestCookieParamsInvalid is used when the cookie params of a request don't conform to the schema in the OpenAPI spec
+type ErrorRequestCookieParamsInvalid struct {
+	Err error
+}
+
+func (e ErrorRequestCookieParamsInvalid) StatusCode() int {
+	return 400
+}
+
+func (e ErrorRequestCookieParamsInvalid) Title() string {
+	return "something's wrong with your cookies"
+}
+
+func (e ErrorRequestCookieParamsInvalid) Error() string {
+	return fmt.Sprintf("the request's cookie parameters did not match your appspec: %s", e.Err.Error())
+}
+
 // ErrorRequestBodyInvalid is used when the body of a request doesn't conform to the schema in the OpenAPI spec
 type ErrorRequestBodyInvalid struct {
 	Err error
@@ -176,9 +224,50 @@ func (e ErrorRequestBodyInvalid) Error() string {
 	return fmt.Sprintf("the request's body did not match your appspec: %s", e.Err.Error())
 }
 
+// ErrorRequestInvalid is used when ReportAllErrors is enabled and a request fails to validate against the OpenAPI spec, to report all of
+// the errors found in its path, query, header & cookie params and its body at once rather than just the first
+type ErrorRequestInvalid struct {
+	Errs   []ErrorAtRequest  // The errors that occurred, e.g. an ErrorRequestQueryParamsInvalid & an ErrorRequestBodyInvalid, in the order they were found
+	Issues []ValidationIssue // The individual fields of the request which didn't conform to the spec, across all of the Errs
+}
+
+func (e ErrorRequestInvalid) StatusCode() int {
+	if len(e.Errs) == 0 {
+		return 400
+	}
+	return e.Errs[0].StatusCode()
+}
+
+func (e ErrorRequestInvalid) Title() string {
+	if len(e.Errs) == 1 {
+		return e.Errs[0].Title()
+	}
+	return "something's wrong with your request"
+}
+
+func (e ErrorRequestInvalid) Error() string {
+	errString := "the request did not match your appspec: "
+	for i, err := range e.Errs {
+		errString += err.Error()
+		if i < len(e.Errs)-1 {
+			errString += "; "
+		}
+	}
+	return errString
+}
+
+// ValidationIssue describes a single field of a request which didn't conform to the OpenAPI spec
+type ValidationIssue struct {
+	Location logging.ValidationLocation `json:"location" xml:"location"`                   // The part of the request in which the field is, e.g. request.body
+	Pointer  string                     `json:"pointer,omitempty" xml:"pointer,omitempty"` // A JSON pointer to the field within the location; for parameters, the first token is the parameter name
+	Keyword  string                     `json:"keyword,omitempty" xml:"keyword,omitempty"` // The schema keyword which the field failed to satisfy, e.g. required, enum or maxLength
+	Detail   string                     `json:"detail" xml:"detail"`                       // A description of what's wrong with the field
+}
+
 // ErrorAuthNoMatchingSchema is used when a request doesn't satisfy any of the securitySchemes corresponding to the route that the request matched in the OpenAPI spec
 type ErrorAuthNoMatchingScheme struct {
-	Err *openapi3filter.SecurityRequirementsError
+	Err        *openapi3filter.SecurityRequirementsError
+	Challenges []string // The WWW-Authenticate challenges for the security schemes of the route, which the default ErrCallback sends
 }
 
 func (e ErrorAuthNoMatchingScheme) StatusCode() int {
@@ -200,6 +289,70 @@ func (e ErrorAuthNoMatchingScheme) Error() string {
 	return errString
 }
 
+// ErrorAuthCredentialsMissing is used when a request doesn't include credentials for any of the securitySchemes corresponding to the route
+// that the request matched in the OpenAPI spec, which auth callbacks indicate by returning errors wrapping ErrCredentialsMissing
+type ErrorAuthCredentialsMissing struct {
+	Err        *openapi3filter.SecurityRequirementsError
+	Challenges []string // The WWW-Authenticate challenges for the security schemes of the route, which the default ErrCallback sends
+}
+
+func (e ErrorAuthCredentialsMissing) StatusCode() int {
+	return 401
+}
+
+func (e ErrorAuthCredentialsMissing) Title() string {
+	return "you need to authenticate to do this"
+}
+
+func (e ErrorAuthCredentialsMissing) Error() string {
+	return fmt.Sprintf("the request did not include credentials for any of the security requirements in your appspec: %s", e.Err.Error())
+}
+
+// ErrorAuthCredentialsInvalid is used when a request includes credentials for the securitySchemes corresponding to the route that the
+// request matched in the OpenAPI spec, but they couldn't be verified, which auth callbacks indicate by returning errors wrapping
+// ErrCredentialsInvalid
+type ErrorAuthCredentialsInvalid struct {
+	Err        *openapi3filter.SecurityRequirementsError
+	Challenges []string // The WWW-Authenticate challenges for the security schemes of the route, which the default ErrCallback sends
+}
+
+func (e ErrorAuthCredentialsInvalid) StatusCode() int {
+	return 401
+}
+
+func (e ErrorAuthCredentialsInvalid) Title() string {
+	return "your credentials are invalid"
+}
+
+func (e ErrorAuthCredentialsInvalid) Error() string {
+	return fmt.Sprintf("the request's credentials did not satisfy the security requirements in your appspec: %s", e.Err.Error())
+}
+
+// ErrorAuthInsufficientScope is used when a request's credentials satisfy a security scheme corresponding to the route that the request
+// matched in the OpenAPI spec, but don't grant all of the scopes the security requirement lists for it. Auth callbacks return it, e.g. via
+// EnforceScopes, and the middleware passes it to the ErrCallback in place of an ErrorAuthNoMatchingScheme
+type ErrorAuthInsufficientScope struct {
+	SecuritySchemeName string
+	RequiredScopes     []string
+	MissingScopes      []string
+	Challenges         []string // The WWW-Authenticate challenge for the security scheme, which the default ErrCallback sends
+}
+
+func (e ErrorAuthInsufficientScope) StatusCode() int {
+	return 403
+}
+
+func (e ErrorAuthInsufficientScope) Title() string {
+	return "you don't have permission to do this"
+}
+
+func (e ErrorAuthInsufficientScope) Error() string {
+	return fmt.Sprintf(
+		"the credentials for the security scheme \"%s\" do not grant the scopes required by your appspec, missing: %s",
+		e.SecuritySchemeName, strings.Join(e.MissingScopes, ", "),
+	)
+}
+
 // ErrorAuthSchemaNotImplemented is used when a request is made to a path that has a security scheme requirement that has not been implemented in the application
 type ErrorAuthSchemeNotImplemented struct {
 	MissingScheme string
@@ -209,12 +362,11 @@ func (e ErrorAuthSchemeNotImplemented) Error() string {
 	return fmt.Sprintf("the security scheme \"%s\" from your appspec has not been implemented in the application", e.MissingScheme)
 }
 
-// ErrorResponseHeadersInvalid is used when any of the headers of a response don't conform to the schema in the OpenAPI spec
-// Currently not implemented as the underlying kin-openapi module doesn't perform response header validation.
-// See the open issue here: https://github.com/getkin/kin-openapi/issues/201
-// TODO: Open source contribution to kin-openapi?
+// ErrorResponseHeadersInvalid is used when any of the headers of a response declared in the OpenAPI spec are required but missing, or
+// don't conform to their schema. The Content-Type header is ignored, as the OpenAPI spec requires
 type ErrorResponseHeadersInvalid struct {
-	Err error
+	Err     error                 // An openapi3.MultiError of the Headers
+	Headers []ResponseHeaderError // Each of the headers which failed to validate, in alphabetical order of their names
 }
 
 func (e ErrorResponseHeadersInvalid) StatusCode() int {
@@ -229,6 +381,29 @@ func (e ErrorResponseHeadersInvalid) Error() string {
 	return fmt.Sprintf("the response's headers did not match your appspec: %s", e.Err.Error())
 }
 
+// ErrorResponseContentTypeInvalid is used when the Content-Type header of a response isn't one of the media types declared for its
+// status code in the OpenAPI spec
+type ErrorResponseContentTypeInvalid struct {
+	RespondedContentType string   // The Content-Type header of the response, which may be empty
+	RespondedStatusCode  int      // The status code of the response
+	AllowedContentTypes  []string // The media types declared for the status code in the OpenAPI spec, in alphabetical order
+}
+
+func (e ErrorResponseContentTypeInvalid) StatusCode() int {
+	return 500
+}
+
+func (e ErrorResponseContentTypeInvalid) Title() string {
+	return "internal server error"
+}
+
+func (e ErrorResponseContentTypeInvalid) Error() string {
+	return fmt.Sprintf(
+		"the response's content type \"%s\" is not one of those your appspec allows for a %d response: \"%s\"",
+		e.RespondedContentType, e.RespondedStatusCode, strings.Join(e.AllowedContentTypes, "\", \""),
+	)
+}
+
 // ErrorResponseHeadersInvalid is used when the body of a response doesn't conform to the schema in the OpenAPI spec
 type ErrorResponseBodyInvalid struct {
 	Err error
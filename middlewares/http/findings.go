@@ -0,0 +1,177 @@
+package firetail
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/FireTail-io/firetail-go-lib/logging"
+	"github.com/getkin/kin-openapi/openapi3"
+	"github.com/getkin/kin-openapi/openapi3filter"
+)
+
+// getValidationFindings breaks an ErrorAtRequest down into the findings recorded in the log entry: one for each issue returned by
+// getValidationIssues
+func getValidationFindings(errAtRequest ErrorAtRequest, blocked bool) []logging.ValidationFinding {
+	// An ErrorRequestInvalid is made up of other errors, each of which is recorded in its own findings under its own type
+	if errRequestInvalid, isErrRequestInvalid := errAtRequest.(ErrorRequestInvalid); isErrRequestInvalid {
+		findings := []logging.ValidationFinding{}
+		for _, err := range errRequestInvalid.Errs {
+			findings = append(findings, getValidationFindings(err, blocked)...)
+		}
+		return findings
+	}
+
+	findings := []logging.ValidationFinding{}
+	for _, issue := range getValidationIssues(errAtRequest) {
+		finding := logging.ValidationFinding{
+			Type:     getErrorType(errAtRequest),
+			Title:    errAtRequest.Title(),
+			Message:  issue.Detail,
+			Blocked:  blocked,
+			Location: issue.Location,
+			Pointer:  issue.Pointer,
+			Keyword:  issue.Keyword,
+		}
+		if finding.Message == "" {
+			finding.Message = errAtRequest.Error()
+		}
+		findings = append(findings, finding)
+	}
+	return findings
+}
+
+// getValidationIssues breaks an ErrorAtRequest down into one issue for each schema error the kin-openapi validator found, or a single
+// issue with an empty Detail if it doesn't contain any
+func getValidationIssues(errAtRequest ErrorAtRequest) []ValidationIssue {
+	baseIssue := ValidationIssue{Location: getValidationLocation(errAtRequest)}
+
+	// Response headers are validated by us rather than kin-openapi, so we know exactly which of them failed to validate
+	if errHeadersInvalid, isErrHeadersInvalid := errAtRequest.(ErrorResponseHeadersInvalid); isErrHeadersInvalid && len(errHeadersInvalid.Headers) > 0 {
+		issues := []ValidationIssue{}
+		for _, headerErr := range errHeadersInvalid.Headers {
+			headerPointer := getJSONPointer([]string{headerErr.Name})
+			schemaErrs := getSchemaErrors(headerErr.Err, headerPointer)
+			if len(schemaErrs) == 0 {
+				issues = append(issues, ValidationIssue{Location: baseIssue.Location, Pointer: headerPointer, Detail: headerErr.Error()})
+			}
+			for _, schemaErr := range schemaErrs {
+				issues = append(issues, ValidationIssue{
+					Location: baseIssue.Location,
+					Pointer:  schemaErr.pointer,
+					Keyword:  schemaErr.err.SchemaField,
+					Detail:   schemaErr.err.Reason,
+				})
+			}
+		}
+		return issues
+	}
+
+	var underlyingErr error
+	switch err := errAtRequest.(type) {
+	case ErrorRequestHeadersInvalid:
+		underlyingErr = err.Err
+	case ErrorRequestQueryParamsInvalid:
+		underlyingErr = err.Err
+	case ErrorRequestPathParamsInvalid:
+		underlyingErr = err.Err
+	case ErrorRequestCookieParamsInvalid:
+		underlyingErr = err.Err
+	case ErrorRequestBodyInvalid:
+		underlyingErr = err.Err
+	case ErrorResponseHeadersInvalid:
+		underlyingErr = err.Err
+	case ErrorResponseBodyInvalid:
+		underlyingErr = err.Err
+	}
+	if underlyingErr == nil {
+		return []ValidationIssue{baseIssue}
+	}
+
+	issues := []ValidationIssue{}
+	for _, schemaErr := range getSchemaErrors(underlyingErr, "") {
+		issues = append(issues, ValidationIssue{
+			Location: baseIssue.Location,
+			Pointer:  schemaErr.pointer,
+			Keyword:  schemaErr.err.SchemaField,
+			Detail:   schemaErr.err.Reason,
+		})
+	}
+	if len(issues) == 0 {
+		// Errors such as a parameter failing to parse don't contain any schema errors, but we can still point to the parameter
+		var requestErr *openapi3filter.RequestError
+		if errors.As(underlyingErr, &requestErr) && requestErr.Parameter != nil {
+			baseIssue.Pointer = getJSONPointer([]string{requestErr.Parameter.Name})
+		}
+		return []ValidationIssue{baseIssue}
+	}
+	return issues
+}
+
+// getValidationLocation returns the part of the request or response to which an ErrorAtRequest relates
+func getValidationLocation(errAtRequest ErrorAtRequest) logging.ValidationLocation {
+	switch errAtRequest.(type) {
+	case ErrorRouteNotFound, ErrorUnsupportedMethod:
+		return logging.RequestRouteLocation
+	case ErrorRequestHeadersInvalid, ErrorRequestContentTypeInvalid, ErrorNotAcceptable:
+		return logging.RequestHeaderLocation
+	case ErrorRequestQueryParamsInvalid:
+		return logging.RequestQueryLocation
+	case ErrorRequestPathParamsInvalid:
+		return logging.RequestPathLocation
+	case ErrorRequestCookieParamsInvalid:
+		return logging.RequestCookieLocation
+	case ErrorRequestBodyInvalid:
+		return logging.RequestBodyLocation
+	case ErrorAuthNoMatchingScheme, ErrorAuthCredentialsMissing, ErrorAuthCredentialsInvalid, ErrorAuthInsufficientScope:
+		return logging.RequestSecurityLocation
+	case ErrorResponseStatusCodeInvalid:
+		return logging.ResponseStatusLocation
+	case ErrorResponseHeadersInvalid, ErrorResponseContentTypeInvalid:
+		return logging.ResponseHeaderLocation
+	case ErrorResponseBodyInvalid:
+		return logging.ResponseBodyLocation
+	default:
+		return logging.UnknownLocation
+	}
+}
+
+// A schema error found within an error returned by the kin-openapi validator, and a JSON pointer to the value which caused it
+type pointedSchemaError struct {
+	err     *openapi3.SchemaError
+	pointer string
+}
+
+// getSchemaErrors recursively collects the schema errors within an error returned by the kin-openapi validator. Errors relating to a
+// parameter have their pointers prefixed with the parameter's name
+func getSchemaErrors(err error, pointerPrefix string) []pointedSchemaError {
+	switch err := err.(type) {
+	case nil:
+		return nil
+	case *openapi3.SchemaError:
+		return []pointedSchemaError{{err, pointerPrefix + getJSONPointer(err.JSONPointer())}}
+	case openapi3.MultiError:
+		schemaErrs := []pointedSchemaError{}
+		for _, err := range err {
+			schemaErrs = append(schemaErrs, getSchemaErrors(err, pointerPrefix)...)
+		}
+		return schemaErrs
+	case *openapi3filter.RequestError:
+		if err.Parameter != nil {
+			pointerPrefix += getJSONPointer([]string{err.Parameter.Name})
+		}
+		return getSchemaErrors(err.Err, pointerPrefix)
+	case *openapi3filter.ResponseError:
+		return getSchemaErrors(err.Err, pointerPrefix)
+	default:
+		return getSchemaErrors(errors.Unwrap(err), pointerPrefix)
+	}
+}
+
+// getJSONPointer joins the reference tokens of an RFC6901 JSON pointer, escaping any "~" or "/" characters within them
+func getJSONPointer(tokens []string) string {
+	pointer := ""
+	for _, token := range tokens {
+		pointer += "/" + strings.ReplaceAll(strings.ReplaceAll(token, "~", "~0"), "/", "~1")
+	}
+	return pointer
+}
@@ -0,0 +1,515 @@
+package firetail
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/getkin/kin-openapi/openapi3filter"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// JWTOptions is the configuration for an auth callback created by NewJWTAuthCallback. At least one of Keys, JWKSPath or JWKSURL must be set,
+// and JWKSPath and JWKSURL can't both be set
+type JWTOptions struct {
+	// Keys is an optional static set of keys, by their key ID, with which the signatures of tokens can be verified. Keys may be an
+	// *rsa.PublicKey, *ecdsa.PublicKey or ed25519.PublicKey, or a []byte secret for HMAC signatures. If a token has no key ID and there's
+	// only one key, that key is used
+	Keys map[string]interface{}
+
+	// JWKSPath is an optional path to a JSON Web Key Set file containing the keys with which the signatures of tokens can be verified. The
+	// file is re-read every JWKSRefreshInterval, and when a token is signed with a key ID which isn't in it, so keys can be rotated by
+	// replacing the file
+	JWKSPath string
+
+	// JWKSURL is an optional URL from which a JSON Web Key Set can be fetched containing the keys with which the signatures of tokens can
+	// be verified, such as the jwks_uri of an OpenID Connect provider. The key set is cached, and re-fetched every JWKSRefreshInterval
+	// and when a token is signed with a key ID which isn't in it, so that keys can be rotated
+	JWKSURL string
+
+	// JWKSHTTPClient is an optional http.Client used to fetch the JWKSURL. If unset, a client with a 30 second timeout is used
+	JWKSHTTPClient *http.Client
+
+	// JWKSRefreshInterval is how often the key set from the JWKSPath or JWKSURL is refreshed. The default value is 1 hour
+	JWKSRefreshInterval time.Duration
+
+	// JWKSMinRefreshInterval is the minimum time between refreshes of the key set when tokens are signed with key IDs which aren't in it,
+	// which prevents clients from causing the key set to be fetched on every request. The default value is 1 minute
+	JWKSMinRefreshInterval time.Duration
+
+	// JWKSErrCallback is an optional callback which is given the errors that occur whilst loading the key set from the JWKSPath or
+	// JWKSURL, such as failures to refresh it or keys in it which can't be used & are skipped. If unset, they're logged
+	JWKSErrCallback func(error)
+
+	// Issuer is an optional value which, if set, the "iss" claim of tokens must equal
+	Issuer string
+
+	// Audience is an optional value which, if set, the "aud" claim of tokens must contain
+	Audience string
+
+	// ValidMethods is an optional list of the signing algorithms which tokens may use, e.g. "RS256". If unset, all of the RSA, RSA-PSS,
+	// ECDSA, EdDSA and HMAC algorithms are allowed; a token can only be verified with a key of the type its algorithm requires
+	ValidMethods []string
+
+	// Leeway is an optional duration by which the "exp", "nbf" and "iat" claims may be out, to allow for clock skew
+	Leeway time.Duration
+
+	// AllowMissingExpiry is an optional flag which, if set to true, allows tokens without an "exp" claim. By default, they're rejected
+	AllowMissingExpiry bool
+
+	// ScopesClaim is the name of the claim from which the scopes granted by tokens are read, which may be a space-delimited string or an
+	// array of strings. Tokens which don't grant all of the scopes a security requirement lists are rejected with an
+	// ErrorAuthInsufficientScope. The default value is "scope"
+	ScopesClaim string
+
+	// TenantClaim is an optional name of a claim from which the tenant of the Principal recorded for tokens is read, e.g. "tid"
+	TenantClaim string
+}
+
+// The key under which the claims of a verified JWT are stored in the request's context
+type jwtClaimsKey struct{}
+
+// JWTClaims returns the claims of the JWT verified by an auth callback created by NewJWTAuthCallback, from the context of a request which
+// the middleware has validated. If no JWT was verified, the second return value is false
+func JWTClaims(ctx context.Context) (map[string]interface{}, bool) {
+	claims, ok := ctx.Value(jwtClaimsKey{}).(map[string]interface{})
+	return claims, ok
+}
+
+// NewJWTAuthCallback returns an auth callback, for use in the AuthCallbacks option, which verifies a JWT given as a bearer token in the
+// Authorization header of a request against the keys in the options. It can be used for security schemes of type http with the bearer
+// scheme, oauth2 or openIdConnect. The token's signature, "exp" & "nbf" claims, and "iss" & "aud" claims if an Issuer and Audience are
+// configured, are all checked, as are the scopes the security requirement lists for the scheme. The claims of a verified token are
+// available to the next handler via JWTClaims, and its "sub" claim & granted scopes are recorded as its Principal
+func NewJWTAuthCallback(options JWTOptions) (openapi3filter.AuthenticationFunc, error) {
+	if len(options.Keys) == 0 && options.JWKSPath == "" && options.JWKSURL == "" {
+		return nil, ErrorInvalidConfiguration{errors.New("a JWT auth callback requires Keys, a JWKSPath or a JWKSURL")}
+	}
+	if options.JWKSPath != "" && options.JWKSURL != "" {
+		return nil, ErrorInvalidConfiguration{errors.New("a JWT auth callback can't have both a JWKSPath and a JWKSURL")}
+	}
+
+	keys := &jwtKeySource{
+		staticKeys:         options.Keys,
+		jwksPath:           options.JWKSPath,
+		jwksURL:            options.JWKSURL,
+		httpClient:         options.JWKSHTTPClient,
+		refreshInterval:    options.JWKSRefreshInterval,
+		minRefreshInterval: options.JWKSMinRefreshInterval,
+		errCallback:        options.JWKSErrCallback,
+	}
+	if keys.httpClient == nil {
+		keys.httpClient = &http.Client{Timeout: 30 * time.Second}
+	}
+	if keys.refreshInterval <= 0 {
+		keys.refreshInterval = time.Hour
+	}
+	if keys.minRefreshInterval <= 0 {
+		keys.minRefreshInterval = time.Minute
+	}
+	if keys.errCallback == nil {
+		keys.errCallback = func(err error) {
+			log.Println("Error loading JWKS: ", err)
+		}
+	}
+
+	// We load the JWKS file up front so that a bad path is reported at startup. JWKS URLs are fetched on first use instead, in case the
+	// provider isn't reachable yet
+	if keys.jwksPath != "" {
+		jwksKeys, err := keys.load(context.Background())
+		if err != nil {
+			return nil, ErrorInvalidConfiguration{err}
+		}
+		keys.jwksKeys = jwksKeys
+		keys.lastRefresh = time.Now()
+	}
+
+	validMethods := options.ValidMethods
+	if len(validMethods) == 0 {
+		validMethods = []string{
+			"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512", "EdDSA", "HS256", "HS384", "HS512",
+		}
+	}
+	parserOptions := []jwt.ParserOption{jwt.WithValidMethods(validMethods), jwt.WithLeeway(options.Leeway)}
+	if options.Issuer != "" {
+		parserOptions = append(parserOptions, jwt.WithIssuer(options.Issuer))
+	}
+	if options.Audience != "" {
+		parserOptions = append(parserOptions, jwt.WithAudience(options.Audience))
+	}
+	if !options.AllowMissingExpiry {
+		parserOptions = append(parserOptions, jwt.WithExpirationRequired())
+	}
+	parser := jwt.NewParser(parserOptions...)
+
+	scopesClaim := options.ScopesClaim
+	if scopesClaim == "" {
+		scopesClaim = "scope"
+	}
+
+	return func(ctx context.Context, ai *openapi3filter.AuthenticationInput) error {
+		if ai.SecurityScheme != nil && !isBearerSecurityScheme(ai.SecurityScheme.Type, ai.SecurityScheme.Scheme) {
+			return fmt.Errorf("the security scheme \"%s\" doesn't use bearer tokens", ai.SecuritySchemeName)
+		}
+
+		token, hasToken := getBearerToken(ai.RequestValidationInput.Request)
+		if !hasToken {
+			return fmt.Errorf("%w: no bearer token supplied for \"%s\"", ErrCredentialsMissing, ai.SecuritySchemeName)
+		}
+
+		claims := jwt.MapClaims{}
+		_, err := parser.ParseWithClaims(token, claims, func(token *jwt.Token) (interface{}, error) {
+			keyID, _ := token.Header["kid"].(string)
+			return keys.getKey(ctx, keyID, token.Method.Alg())
+		})
+		if err != nil {
+			return fmt.Errorf("%w: invalid bearer token supplied for \"%s\": %s", ErrCredentialsInvalid, ai.SecuritySchemeName, err.Error())
+		}
+
+		grantedScopes := getScopesFromClaim(claims, scopesClaim)
+		if err := EnforceScopes(ai, grantedScopes); err != nil {
+			return err
+		}
+
+		setAuthContextValue(ctx, jwtClaimsKey{}, map[string]interface{}(claims))
+		principal := Principal{Scopes: grantedScopes, SecuritySchemeName: ai.SecuritySchemeName}
+		principal.Subject, _ = claims["sub"].(string)
+		if options.TenantClaim != "" {
+			principal.Tenant, _ = claims[options.TenantClaim].(string)
+		}
+		SetPrincipal(ctx, principal)
+		return nil
+	}, nil
+}
+
+// isBearerSecurityScheme returns true if a security scheme of the given type & HTTP authentication scheme uses bearer tokens
+func isBearerSecurityScheme(schemeType string, scheme string) bool {
+	switch schemeType {
+	case "oauth2", "openIdConnect":
+		return true
+	case "http":
+		return strings.EqualFold(scheme, "bearer")
+	default:
+		return false
+	}
+}
+
+// getBearerToken returns the bearer token from the Authorization header of a request, if it has one
+func getBearerToken(r *http.Request) (string, bool) {
+	authScheme, token, found := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !found || !strings.EqualFold(authScheme, "bearer") || strings.TrimSpace(token) == "" {
+		return "", false
+	}
+	return strings.TrimSpace(token), true
+}
+
+// jwksRefreshTimeout is how long a refresh of a JWKS may take. Refreshes are shared by all the requests waiting on them, so they aren't
+// cancelled with the context of the request which started them
+const jwksRefreshTimeout = 30 * time.Second
+
+// jwtKeySource finds the keys with which JWTs' signatures should be verified, from a static set of keys and/or a cached JWKS
+type jwtKeySource struct {
+	staticKeys         map[string]interface{}
+	jwksPath           string
+	jwksURL            string
+	httpClient         *http.Client
+	refreshInterval    time.Duration
+	minRefreshInterval time.Duration
+	errCallback        func(error)
+	mutex              sync.Mutex         // Guards jwksKeys, lastRefresh, lastFailure & refreshDone; it isn't held whilst the JWKS is loaded
+	jwksKeys           map[string]jwksKey // The keys from the JWKS, by their key ID
+	lastRefresh        time.Time          // When the JWKS was last refreshed successfully
+	lastFailure        time.Time          // When a refresh of the JWKS last failed
+	refreshDone        chan struct{}      // Closed when the refresh in progress finishes, or nil if there's no refresh in progress
+}
+
+// jwksKey is a key from a JWKS, with the algorithm its JWK says it's to be used with, if it says
+type jwksKey struct {
+	key interface{}
+	alg string
+}
+
+// getKey returns the key with the given key ID for verifying a token signed with the given algorithm, refreshing the JWKS if it's due to
+// be refreshed or doesn't contain the key. Whilst the JWKS is being refreshed, requests carry on using the previously loaded keys, unless
+// they need a key which isn't in them
+func (s *jwtKeySource) getKey(ctx context.Context, keyID string, alg string) (interface{}, error) {
+	if key := findKey(s.staticKeys, keyID); key != nil {
+		return key, nil
+	}
+	if s.jwksPath == "" && s.jwksURL == "" {
+		return nil, fmt.Errorf("no key found with ID \"%s\"", keyID)
+	}
+
+	s.refreshIfDue(s.refreshInterval)
+	key := s.findJWKSKey(keyID)
+	if key == nil {
+		// The key may have been rotated since we last refreshed, so we refresh again unless we've only just done so, and wait for the
+		// refresh to finish
+		if refreshInProgress := s.refreshIfDue(s.minRefreshInterval); refreshInProgress != nil {
+			select {
+			case <-refreshInProgress:
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+		key = s.findJWKSKey(keyID)
+	}
+	if key == nil {
+		return nil, fmt.Errorf("no key found with ID \"%s\"", keyID)
+	}
+
+	// If the JWK says which algorithm its key is for, tokens signed with any other algorithm mustn't be verified with it
+	if key.alg != "" && key.alg != alg {
+		return nil, fmt.Errorf("the key with ID \"%s\" is for the %s algorithm, not %s", keyID, key.alg, alg)
+	}
+	return key.key, nil
+}
+
+// findJWKSKey returns the key with the given ID from the most recently loaded JWKS. If the key ID is empty and there's only one key, that
+// key is returned
+func (s *jwtKeySource) findJWKSKey(keyID string) *jwksKey {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if key, hasKey := s.jwksKeys[keyID]; hasKey {
+		return &key
+	}
+	if keyID == "" && len(s.jwksKeys) == 1 {
+		for _, key := range s.jwksKeys {
+			return &key
+		}
+	}
+	return nil
+}
+
+// refreshIfDue starts refreshing the JWKS in the background if it was last refreshed at least the given interval ago, unless a refresh
+// failed within the last minRefreshInterval. It returns a channel which is closed when the refresh in progress finishes, or nil if there's
+// no refresh in progress
+func (s *jwtKeySource) refreshIfDue(interval time.Duration) <-chan struct{} {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.refreshDone != nil {
+		return s.refreshDone
+	}
+	if time.Since(s.lastRefresh) < interval || time.Since(s.lastFailure) < s.minRefreshInterval {
+		return nil
+	}
+	refreshDone := make(chan struct{})
+	s.refreshDone = refreshDone
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), jwksRefreshTimeout)
+		defer cancel()
+		keys, err := s.load(ctx)
+
+		s.mutex.Lock()
+		if err == nil {
+			s.jwksKeys = keys
+			s.lastRefresh = time.Now()
+		} else {
+			s.lastFailure = time.Now()
+		}
+		s.refreshDone = nil
+		s.mutex.Unlock()
+		close(refreshDone)
+
+		if err != nil {
+			s.errCallback(fmt.Errorf("failed to refresh JWKS: %w", err))
+		}
+	}()
+	return refreshDone
+}
+
+// findKey returns the key with the given ID from a set of keys. If the key ID is empty and there's only one key, that key is returned
+func findKey(keys map[string]interface{}, keyID string) interface{} {
+	if key, hasKey := keys[keyID]; hasKey {
+		return key
+	}
+	if keyID == "" && len(keys) == 1 {
+		for _, key := range keys {
+			return key
+		}
+	}
+	return nil
+}
+
+// load reads the JWKS from its path or fetches it from its URL, and parses it
+func (s *jwtKeySource) load(ctx context.Context) (map[string]jwksKey, error) {
+	var jwksBytes []byte
+	var err error
+	if s.jwksPath != "" {
+		jwksBytes, err = os.ReadFile(s.jwksPath)
+	} else {
+		jwksBytes, err = s.fetchJWKS(ctx)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return parseJWKS(jwksBytes, s.errCallback)
+}
+
+func (s *jwtKeySource) fetchJWKS(ctx context.Context) ([]byte, error) {
+	request, err := http.NewRequestWithContext(ctx, "GET", s.jwksURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Accept", "application/json")
+	response, err := s.httpClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != 200 {
+		return nil, fmt.Errorf("fetching JWKS from %s returned status code %d", s.jwksURL, response.StatusCode)
+	}
+	return io.ReadAll(response.Body)
+}
+
+// A JSON Web Key, as defined in RFC7517, with the members needed for the key types we support
+type jsonWebKey struct {
+	KeyType string   `json:"kty"`
+	KeyID   string   `json:"kid"`
+	Use     string   `json:"use"`
+	KeyOps  []string `json:"key_ops"`
+	Alg     string   `json:"alg"`
+	Curve   string   `json:"crv"`
+	N       string   `json:"n"` // RSA modulus
+	E       string   `json:"e"` // RSA exponent
+	X       string   `json:"x"` // EC or OKP x coordinate
+	Y       string   `json:"y"` // EC y coordinate
+	K       string   `json:"k"` // Symmetric key
+}
+
+// parseJWKS parses a JSON Web Key Set into the keys it contains by their key ID, skipping any keys which aren't for signatures. Keys which
+// can't be used, e.g. because they're of an unsupported type or curve, are skipped & reported to keyErrCallback, so that one unusual key
+// published by an identity provider doesn't stop the others from being used. If no usable keys remain, an error is returned
+func parseJWKS(jwksBytes []byte, keyErrCallback func(error)) (map[string]jwksKey, error) {
+	var jwks struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := json.Unmarshal(jwksBytes, &jwks); err != nil {
+		return nil, fmt.Errorf("invalid JWKS: %w", err)
+	}
+	keys := map[string]jwksKey{}
+	for _, jwk := range jwks.Keys {
+		if !jwk.isForSignatures() {
+			continue
+		}
+		key, err := jwk.key()
+		if err != nil {
+			keyErrCallback(fmt.Errorf("skipping unusable key \"%s\" in JWKS: %w", jwk.KeyID, err))
+			continue
+		}
+		keys[jwk.KeyID] = jwksKey{key, jwk.Alg}
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("JWKS contains no usable signing keys")
+	}
+	return keys, nil
+}
+
+// isForSignatures returns false if the JWK's "use", "key_ops" or "alg" members say it's for something other than verifying signatures, such
+// as encryption. Keys which don't say what they're for are assumed to be usable for signatures
+func (jwk jsonWebKey) isForSignatures() bool {
+	if jwk.Use != "" && jwk.Use != "sig" {
+		return false
+	}
+	if len(jwk.KeyOps) > 0 {
+		canVerify := false
+		for _, keyOp := range jwk.KeyOps {
+			canVerify = canVerify || keyOp == "verify"
+		}
+		if !canVerify {
+			return false
+		}
+	}
+	if jwk.Alg != "" && jwt.GetSigningMethod(jwk.Alg) == nil {
+		// An algorithm which isn't a signing method, e.g. RSA-OAEP, means the key is for encryption
+		return false
+	}
+	return true
+}
+
+// key returns the key described by the JWK, in the form golang-jwt expects for its type
+func (jwk jsonWebKey) key() (interface{}, error) {
+	switch jwk.KeyType {
+	case "RSA":
+		n, err := decodeJWKBigInt(jwk.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeJWKBigInt(jwk.E)
+		if err != nil {
+			return nil, err
+		}
+		if !e.IsInt64() || e.Int64() > int64(^uint32(0)>>1) {
+			return nil, errors.New("RSA exponent is too large")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+
+	case "EC":
+		var curve elliptic.Curve
+		switch jwk.Curve {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve \"%s\"", jwk.Curve)
+		}
+		x, err := decodeJWKBigInt(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeJWKBigInt(jwk.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+
+	case "OKP":
+		if jwk.Curve != "Ed25519" {
+			return nil, fmt.Errorf("unsupported curve \"%s\"", jwk.Curve)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid Ed25519 public key size")
+		}
+		return ed25519.PublicKey(x), nil
+
+	case "oct":
+		return base64.RawURLEncoding.DecodeString(jwk.K)
+
+	default:
+		return nil, fmt.Errorf("unsupported key type \"%s\"", jwk.KeyType)
+	}
+}
+
+func decodeJWKBigInt(value string) (*big.Int, error) {
+	valueBytes, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, err
+	}
+	if len(valueBytes) == 0 {
+		return nil, errors.New("missing key parameter")
+	}
+	return new(big.Int).SetBytes(valueBytes), nil
+}
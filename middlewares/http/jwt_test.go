@@ -0,0 +1,483 @@
+package firetail
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/getkin/kin-openapi/openapi3"
+	"github.com/getkin/kin-openapi/openapi3filter"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func signTestJWT(t *testing.T, method jwt.SigningMethod, key interface{}, keyID string, claims jwt.MapClaims) string {
+	token := jwt.NewWithClaims(method, claims)
+	if keyID != "" {
+		token.Header["kid"] = keyID
+	}
+	signedToken, err := token.SignedString(key)
+	require.Nil(t, err)
+	return signedToken
+}
+
+func getTestRSAJWK(keyID string, key *rsa.PublicKey) map[string]string {
+	return map[string]string{
+		"kty": "RSA",
+		"kid": keyID,
+		"use": "sig",
+		"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+		"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+	}
+}
+
+func getTestECJWK(keyID string, key *ecdsa.PublicKey) map[string]string {
+	size := (key.Curve.Params().BitSize + 7) / 8
+	return map[string]string{
+		"kty": "EC",
+		"kid": keyID,
+		"crv": key.Curve.Params().Name,
+		"x":   base64.RawURLEncoding.EncodeToString(key.X.FillBytes(make([]byte, size))),
+		"y":   base64.RawURLEncoding.EncodeToString(key.Y.FillBytes(make([]byte, size))),
+	}
+}
+
+func getTestJWKS(t *testing.T, keys ...map[string]string) []byte {
+	jwks, err := json.Marshal(map[string]interface{}{"keys": keys})
+	require.Nil(t, err)
+	return jwks
+}
+
+func callTestJWTAuthCallback(callback openapi3filter.AuthenticationFunc, token string) error {
+	request := httptest.NewRequest("GET", "/bearer-auth", nil)
+	if token != "" {
+		request.Header.Set("Authorization", "Bearer "+token)
+	}
+	return callback(context.Background(), &openapi3filter.AuthenticationInput{
+		RequestValidationInput: &openapi3filter.RequestValidationInput{Request: request},
+		SecuritySchemeName:     "BearerAuth",
+		SecurityScheme:         &openapi3.SecurityScheme{Type: "http", Scheme: "bearer"},
+	})
+}
+
+func TestNewJWTAuthCallbackRequiresKeys(t *testing.T) {
+	_, err := NewJWTAuthCallback(JWTOptions{})
+	require.NotNil(t, err)
+	assert.IsType(t, ErrorInvalidConfiguration{}, err)
+}
+
+func TestNewJWTAuthCallbackRejectsJWKSPathAndURL(t *testing.T) {
+	_, err := NewJWTAuthCallback(JWTOptions{JWKSPath: "./jwks.json", JWKSURL: "https://auth.example.com/.well-known/jwks.json"})
+	require.NotNil(t, err)
+	assert.IsType(t, ErrorInvalidConfiguration{}, err)
+}
+
+func TestNewJWTAuthCallbackWithMissingJWKSFile(t *testing.T) {
+	_, err := NewJWTAuthCallback(JWTOptions{JWKSPath: filepath.Join(t.TempDir(), "missing.json")})
+	require.NotNil(t, err)
+	assert.IsType(t, ErrorInvalidConfiguration{}, err)
+}
+
+func TestJWTAuthCallbackPassesClaimsToHandler(t *testing.T) {
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.Nil(t, err)
+	jwtAuthCallback, err := NewJWTAuthCallback(JWTOptions{
+		Keys:        map[string]interface{}{"test-key": &privateKey.PublicKey},
+		Issuer:      "https://issuer.example.com",
+		Audience:    "test-api",
+		TenantClaim: "tid",
+	})
+	require.Nil(t, err)
+
+	middleware, err := GetMiddleware(&Options{
+		OpenapiSpecPath:         "./test-spec.yaml",
+		AuthCallbacks:           map[string]openapi3filter.AuthenticationFunc{"BearerAuth": jwtAuthCallback},
+		DebugErrs:               true,
+		EnableRequestValidation: true,
+	})
+	require.Nil(t, err)
+	var handlerClaims map[string]interface{}
+	var handlerHasClaims bool
+	var handlerPrincipal Principal
+	handler := middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handlerClaims, handlerHasClaims = JWTClaims(r.Context())
+		handlerPrincipal, _ = GetPrincipal(r.Context())
+		w.WriteHeader(200)
+	}))
+
+	token := signTestJWT(t, jwt.SigningMethodRS256, privateKey, "test-key", jwt.MapClaims{
+		"sub":   "test-subject",
+		"tid":   "test-tenant",
+		"scope": "pets:read",
+		"iss":   "https://issuer.example.com",
+		"aud":   "test-api",
+		"exp":   time.Now().Add(time.Hour).Unix(),
+	})
+	request := httptest.NewRequest("GET", "/bearer-auth", nil)
+	request.Header.Set("Authorization", "Bearer "+token)
+	responseRecorder := httptest.NewRecorder()
+	handler.ServeHTTP(responseRecorder, request)
+
+	assert.Equal(t, 200, responseRecorder.Code)
+	require.True(t, handlerHasClaims)
+	assert.Equal(t, "test-subject", handlerClaims["sub"])
+	assert.Equal(t, Principal{
+		Subject:            "test-subject",
+		Tenant:             "test-tenant",
+		Scopes:             []string{"pets:read"},
+		SecuritySchemeName: "BearerAuth",
+	}, handlerPrincipal)
+
+	request = httptest.NewRequest("GET", "/bearer-auth", nil)
+	responseRecorder = httptest.NewRecorder()
+	handler.ServeHTTP(responseRecorder, request)
+	assert.Equal(t, 401, responseRecorder.Code)
+}
+
+func TestJWTAuthCallbackRejectsInvalidTokens(t *testing.T) {
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.Nil(t, err)
+	otherPrivateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.Nil(t, err)
+	jwtAuthCallback, err := NewJWTAuthCallback(JWTOptions{
+		Keys:     map[string]interface{}{"test-key": &privateKey.PublicKey},
+		Issuer:   "https://issuer.example.com",
+		Audience: "test-api",
+	})
+	require.Nil(t, err)
+
+	validClaims := func() jwt.MapClaims {
+		return jwt.MapClaims{
+			"iss": "https://issuer.example.com",
+			"aud": "test-api",
+			"exp": time.Now().Add(time.Hour).Unix(),
+		}
+	}
+	withClaim := func(key string, value interface{}) jwt.MapClaims {
+		claims := validClaims()
+		if value == nil {
+			delete(claims, key)
+		} else {
+			claims[key] = value
+		}
+		return claims
+	}
+
+	testCases := map[string]string{
+		"expired":        signTestJWT(t, jwt.SigningMethodRS256, privateKey, "test-key", withClaim("exp", time.Now().Add(-time.Hour).Unix())),
+		"not yet valid":  signTestJWT(t, jwt.SigningMethodRS256, privateKey, "test-key", withClaim("nbf", time.Now().Add(time.Hour).Unix())),
+		"missing expiry": signTestJWT(t, jwt.SigningMethodRS256, privateKey, "test-key", withClaim("exp", nil)),
+		"wrong issuer":   signTestJWT(t, jwt.SigningMethodRS256, privateKey, "test-key", withClaim("iss", "https://other.example.com")),
+		"wrong audience": signTestJWT(t, jwt.SigningMethodRS256, privateKey, "test-key", withClaim("aud", "other-api")),
+		"wrong key":      signTestJWT(t, jwt.SigningMethodRS256, otherPrivateKey, "test-key", validClaims()),
+		"unknown key ID": signTestJWT(t, jwt.SigningMethodRS256, privateKey, "other-key", validClaims()),
+		"wrong method":   signTestJWT(t, jwt.SigningMethodHS256, []byte("secret"), "test-key", validClaims()),
+		"malformed":      "not-a-jwt",
+	}
+	for name, token := range testCases {
+		t.Run(name, func(t *testing.T) {
+			err := callTestJWTAuthCallback(jwtAuthCallback, token)
+			require.NotNil(t, err)
+			assert.True(t, errors.Is(err, ErrCredentialsInvalid))
+		})
+	}
+
+	err = callTestJWTAuthCallback(jwtAuthCallback, "")
+	require.NotNil(t, err)
+	assert.True(t, errors.Is(err, ErrCredentialsMissing))
+
+	assert.Nil(t, callTestJWTAuthCallback(jwtAuthCallback, signTestJWT(t, jwt.SigningMethodRS256, privateKey, "test-key", validClaims())))
+}
+
+func TestJWTAuthCallbackWithJWKSFile(t *testing.T) {
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(t, err)
+	jwksPath := filepath.Join(t.TempDir(), "jwks.json")
+	require.Nil(t, os.WriteFile(jwksPath, getTestJWKS(t, getTestECJWK("test-key", &privateKey.PublicKey)), 0600))
+
+	jwtAuthCallback, err := NewJWTAuthCallback(JWTOptions{JWKSPath: jwksPath})
+	require.Nil(t, err)
+
+	claims := jwt.MapClaims{"exp": time.Now().Add(time.Hour).Unix()}
+	assert.Nil(t, callTestJWTAuthCallback(jwtAuthCallback, signTestJWT(t, jwt.SigningMethodES256, privateKey, "test-key", claims)))
+	// A token without a key ID can be verified, as there's only one key in the JWKS
+	assert.Nil(t, callTestJWTAuthCallback(jwtAuthCallback, signTestJWT(t, jwt.SigningMethodES256, privateKey, "", claims)))
+}
+
+func TestJWTAuthCallbackSkipsUnusableJWKs(t *testing.T) {
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(t, err)
+	encryptionKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.Nil(t, err)
+	encryptionJWK := getTestRSAJWK("encryption-key", &encryptionKey.PublicKey)
+	delete(encryptionJWK, "use")
+	encryptionJWK["alg"] = "RSA-OAEP"
+
+	jwksPath := filepath.Join(t.TempDir(), "jwks.json")
+	require.Nil(t, os.WriteFile(jwksPath, getTestJWKS(
+		t,
+		map[string]string{"kty": "unsupported", "kid": "unsupported-type"},
+		map[string]string{"kty": "EC", "kid": "unsupported-curve", "crv": "secp256k1", "x": "AA", "y": "AA"},
+		encryptionJWK,
+		getTestECJWK("test-key", &privateKey.PublicKey),
+	), 0600))
+
+	jwksErrs := []error{}
+	jwtAuthCallback, err := NewJWTAuthCallback(JWTOptions{
+		JWKSPath:        jwksPath,
+		JWKSErrCallback: func(err error) { jwksErrs = append(jwksErrs, err) },
+	})
+	require.Nil(t, err)
+
+	// The unsupported keys are reported, but the encryption key is skipped silently as it was never meant to be used for signatures
+	assert.Len(t, jwksErrs, 2)
+	claims := jwt.MapClaims{"exp": time.Now().Add(time.Hour).Unix()}
+	assert.Nil(t, callTestJWTAuthCallback(jwtAuthCallback, signTestJWT(t, jwt.SigningMethodES256, privateKey, "test-key", claims)))
+	// The key ID can still be omitted, as there's only one usable key
+	assert.Nil(t, callTestJWTAuthCallback(jwtAuthCallback, signTestJWT(t, jwt.SigningMethodES256, privateKey, "", claims)))
+}
+
+func TestNewJWTAuthCallbackWithNoUsableJWKs(t *testing.T) {
+	jwksPath := filepath.Join(t.TempDir(), "jwks.json")
+	require.Nil(t, os.WriteFile(jwksPath, getTestJWKS(t, map[string]string{"kty": "unsupported", "kid": "unsupported-type"}), 0600))
+
+	_, err := NewJWTAuthCallback(JWTOptions{JWKSPath: jwksPath, JWKSErrCallback: func(error) {}})
+	require.NotNil(t, err)
+	assert.IsType(t, ErrorInvalidConfiguration{}, err)
+}
+
+func TestJWTAuthCallbackWithJWKSURLRotation(t *testing.T) {
+	firstPrivateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.Nil(t, err)
+	secondPrivateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.Nil(t, err)
+
+	var jwksMutex sync.Mutex
+	jwks := getTestJWKS(t, getTestRSAJWK("first-key", &firstPrivateKey.PublicKey))
+	fetchCount := 0
+	jwksServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		jwksMutex.Lock()
+		defer jwksMutex.Unlock()
+		fetchCount++
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(jwks)
+	}))
+	defer jwksServer.Close()
+
+	jwtAuthCallback, err := NewJWTAuthCallback(JWTOptions{
+		JWKSURL:                jwksServer.URL,
+		JWKSMinRefreshInterval: time.Nanosecond,
+	})
+	require.Nil(t, err)
+
+	claims := jwt.MapClaims{"exp": time.Now().Add(time.Hour).Unix()}
+	firstToken := signTestJWT(t, jwt.SigningMethodRS256, firstPrivateKey, "first-key", claims)
+	assert.Nil(t, callTestJWTAuthCallback(jwtAuthCallback, firstToken))
+	assert.Nil(t, callTestJWTAuthCallback(jwtAuthCallback, firstToken))
+	jwksMutex.Lock()
+	assert.Equal(t, 1, fetchCount)
+
+	// Rotate the keys; a token signed with the new key should cause the JWKS to be fetched again
+	jwks = getTestJWKS(t, getTestRSAJWK("second-key", &secondPrivateKey.PublicKey))
+	jwksMutex.Unlock()
+	secondToken := signTestJWT(t, jwt.SigningMethodRS256, secondPrivateKey, "second-key", claims)
+	assert.Nil(t, callTestJWTAuthCallback(jwtAuthCallback, secondToken))
+	jwksMutex.Lock()
+	assert.Equal(t, 2, fetchCount)
+	jwksMutex.Unlock()
+
+	// The first key is no longer in the JWKS
+	err = callTestJWTAuthCallback(jwtAuthCallback, firstToken)
+	require.NotNil(t, err)
+	assert.True(t, errors.Is(err, ErrCredentialsInvalid))
+}
+
+func TestJWTAuthCallbackUsesCachedKeysDuringRefresh(t *testing.T) {
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.Nil(t, err)
+	jwks := getTestJWKS(t, getTestRSAJWK("test-key", &privateKey.PublicKey))
+
+	// Every fetch after the first blocks until the test is done
+	var fetchCount int32
+	releaseFetches := make(chan struct{})
+	jwksServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&fetchCount, 1) > 1 {
+			<-releaseFetches
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(jwks)
+	}))
+	defer jwksServer.Close()
+	defer close(releaseFetches)
+
+	jwtAuthCallback, err := NewJWTAuthCallback(JWTOptions{
+		JWKSURL:             jwksServer.URL,
+		JWKSRefreshInterval: time.Millisecond,
+	})
+	require.Nil(t, err)
+
+	token := signTestJWT(t, jwt.SigningMethodRS256, privateKey, "test-key", jwt.MapClaims{"exp": time.Now().Add(time.Hour).Unix()})
+	require.Nil(t, callTestJWTAuthCallback(jwtAuthCallback, token))
+
+	// Once the refresh interval has passed, the next request starts a refresh which blocks
+	time.Sleep(2 * time.Millisecond)
+	go callTestJWTAuthCallback(jwtAuthCallback, token)
+	require.Eventually(t, func() bool { return atomic.LoadInt32(&fetchCount) == 2 }, time.Second, time.Millisecond)
+
+	// Other requests should carry on using the cached keys rather than waiting for it
+	verified := make(chan error)
+	go func() { verified <- callTestJWTAuthCallback(jwtAuthCallback, token) }()
+	select {
+	case err := <-verified:
+		assert.Nil(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("verifying a token with a cached key waited for the JWKS to be refreshed")
+	}
+	assert.Equal(t, int32(2), atomic.LoadInt32(&fetchCount))
+}
+
+func TestJWTAuthCallbackRefreshIsNotCancelledWithRequest(t *testing.T) {
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.Nil(t, err)
+	jwks := getTestJWKS(t, getTestRSAJWK("test-key", &privateKey.PublicKey))
+
+	// The JWKS can't be fetched until the test releases it
+	var fetchCount int32
+	releaseFetch := make(chan struct{})
+	jwksServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&fetchCount, 1)
+		<-releaseFetch
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(jwks)
+	}))
+	defer jwksServer.Close()
+
+	jwtAuthCallback, err := NewJWTAuthCallback(JWTOptions{JWKSURL: jwksServer.URL})
+	require.Nil(t, err)
+	token := signTestJWT(t, jwt.SigningMethodRS256, privateKey, "test-key", jwt.MapClaims{"exp": time.Now().Add(time.Hour).Unix()})
+
+	// The first request gives up waiting for the JWKS to be fetched, as if its client disconnected
+	ctx, cancel := context.WithCancel(context.Background())
+	request := httptest.NewRequest("GET", "/bearer-auth", nil)
+	request.Header.Set("Authorization", "Bearer "+token)
+	authResult := make(chan error)
+	go func() {
+		authResult <- jwtAuthCallback(ctx, &openapi3filter.AuthenticationInput{
+			RequestValidationInput: &openapi3filter.RequestValidationInput{Request: request},
+			SecuritySchemeName:     "BearerAuth",
+			SecurityScheme:         &openapi3.SecurityScheme{Type: "http", Scheme: "bearer"},
+		})
+	}()
+	require.Eventually(t, func() bool { return atomic.LoadInt32(&fetchCount) == 1 }, time.Second, time.Millisecond)
+	cancel()
+	assert.NotNil(t, <-authResult)
+
+	// The fetch it started shouldn't have been cancelled with it, so once it completes the keys can be used without fetching them again
+	close(releaseFetch)
+	assert.Nil(t, callTestJWTAuthCallback(jwtAuthCallback, token))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&fetchCount))
+}
+
+func TestJWTAuthCallbackRejectsKeysForOtherAlgorithms(t *testing.T) {
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.Nil(t, err)
+	jwk := getTestRSAJWK("test-key", &privateKey.PublicKey)
+	jwk["alg"] = "RS256"
+	jwksPath := filepath.Join(t.TempDir(), "jwks.json")
+	require.Nil(t, os.WriteFile(jwksPath, getTestJWKS(t, jwk), 0600))
+
+	jwtAuthCallback, err := NewJWTAuthCallback(JWTOptions{JWKSPath: jwksPath})
+	require.Nil(t, err)
+
+	claims := jwt.MapClaims{"exp": time.Now().Add(time.Hour).Unix()}
+	assert.Nil(t, callTestJWTAuthCallback(jwtAuthCallback, signTestJWT(t, jwt.SigningMethodRS256, privateKey, "test-key", claims)))
+
+	// The JWK says the key is only for RS256, so a token signed with the same key using PS256 should be rejected
+	err = callTestJWTAuthCallback(jwtAuthCallback, signTestJWT(t, jwt.SigningMethodPS256, privateKey, "test-key", claims))
+	require.NotNil(t, err)
+	assert.True(t, errors.Is(err, ErrCredentialsInvalid))
+}
+
+func TestJWTAuthCallbackEnforcesScopes(t *testing.T) {
+	secret := []byte("test-secret")
+	jwtAuthCallback, err := NewJWTAuthCallback(JWTOptions{Keys: map[string]interface{}{"test-key": secret}})
+	require.Nil(t, err)
+
+	middleware, err := GetMiddleware(&Options{
+		OpenapiSpecPath:         "./test-spec.yaml",
+		AuthCallbacks:           map[string]openapi3filter.AuthenticationFunc{"OAuth2Auth": jwtAuthCallback},
+		DebugErrs:               true,
+		EnableRequestValidation: true,
+	})
+	require.Nil(t, err)
+	handler := middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+	}))
+
+	testCases := map[string]struct {
+		scope        interface{}
+		expectedCode int
+	}{
+		"granted":           {"pets:write pets:read", 200},
+		"granted as array":  {[]string{"pets:read"}, 200},
+		"not granted":       {"pets:write", 403},
+		"no scopes granted": {nil, 403},
+	}
+	for name, testCase := range testCases {
+		t.Run(name, func(t *testing.T) {
+			claims := jwt.MapClaims{"exp": time.Now().Add(time.Hour).Unix()}
+			if testCase.scope != nil {
+				claims["scope"] = testCase.scope
+			}
+			request := httptest.NewRequest("GET", "/oauth2-auth", nil)
+			request.Header.Set("Authorization", "Bearer "+signTestJWT(t, jwt.SigningMethodHS256, secret, "test-key", claims))
+			responseRecorder := httptest.NewRecorder()
+			handler.ServeHTTP(responseRecorder, request)
+			assert.Equal(t, testCase.expectedCode, responseRecorder.Code)
+		})
+	}
+
+	// A request without a token is unauthenticated rather than forbidden
+	request := httptest.NewRequest("GET", "/oauth2-auth", nil)
+	responseRecorder := httptest.NewRecorder()
+	handler.ServeHTTP(responseRecorder, request)
+	assert.Equal(t, 401, responseRecorder.Code)
+}
+
+func TestJWTAuthCallbackWithCustomScopesClaim(t *testing.T) {
+	secret := []byte("test-secret")
+	jwtAuthCallback, err := NewJWTAuthCallback(JWTOptions{Keys: map[string]interface{}{"test-key": secret}, ScopesClaim: "scp"})
+	require.Nil(t, err)
+
+	request := httptest.NewRequest("GET", "/oauth2-auth", nil)
+	request.Header.Set("Authorization", "Bearer "+signTestJWT(t, jwt.SigningMethodHS256, secret, "test-key", jwt.MapClaims{
+		"exp":   time.Now().Add(time.Hour).Unix(),
+		"scope": "pets:read",
+		"scp":   []string{"pets:write"},
+	}))
+	err = jwtAuthCallback(context.Background(), &openapi3filter.AuthenticationInput{
+		RequestValidationInput: &openapi3filter.RequestValidationInput{Request: request},
+		SecuritySchemeName:     "OAuth2Auth",
+		SecurityScheme:         &openapi3.SecurityScheme{Type: "oauth2"},
+		Scopes:                 []string{"pets:read"},
+	})
+	require.NotNil(t, err)
+	require.IsType(t, ErrorAuthInsufficientScope{}, err)
+	assert.Equal(t, []string{"pets:read"}, err.(ErrorAuthInsufficientScope).MissingScopes)
+	assert.Equal(t, 403, err.(ErrorAuthInsufficientScope).StatusCode())
+}
@@ -0,0 +1,152 @@
+package firetail
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/FireTail-io/firetail-go-lib/logging"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// metrics holds the Prometheus metrics updated by the middleware. A nil *metrics is valid, and doesn't record anything
+type metrics struct {
+	requests           *prometheus.CounterVec
+	handlerDuration    *prometheus.HistogramVec
+	validationDuration *prometheus.HistogramVec
+}
+
+// newMetrics creates the middleware's metrics & registers them, along with a collector for the stats of its logger, on the provided
+// registerer. If the registerer is nil, nil is returned
+func newMetrics(registerer prometheus.Registerer, loggerStats func() logging.BatchLoggerStats) (*metrics, error) {
+	if registerer == nil {
+		return nil, nil
+	}
+
+	newMetrics := &metrics{
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "firetail",
+			Name:      "requests_total",
+			Help:      "The number of requests handled by the firetail middleware, by route, method, status code & the type of the ErrorAtRequest, if any",
+		}, []string{"route", "method", "status_code", "error_type"}),
+		handlerDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "firetail",
+			Name:      "handler_duration_seconds",
+			Help:      "The time taken by the handler wrapped by the firetail middleware to handle a request, by route & method",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"route", "method"}),
+		validationDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "firetail",
+			Name:      "validation_duration_seconds",
+			Help:      "The time taken by the firetail middleware to validate requests & responses, by route, method & stage (request or response)",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"route", "method", "stage"}),
+	}
+
+	for _, collector := range []prometheus.Collector{
+		newMetrics.requests,
+		newMetrics.handlerDuration,
+		newMetrics.validationDuration,
+		newLoggerCollector(loggerStats),
+	} {
+		if err := registerer.Register(collector); err != nil {
+			return nil, ErrorInvalidConfiguration{err}
+		}
+	}
+
+	return newMetrics, nil
+}
+
+// observeRequest counts a request which has been handled. errAtRequest should be nil if the request didn't result in an ErrorAtRequest
+func (m *metrics) observeRequest(route string, method string, statusCode int, errAtRequest ErrorAtRequest) {
+	if m == nil {
+		return
+	}
+	errorType := ""
+	if errAtRequest != nil {
+		errorType = getErrorType(errAtRequest)
+	}
+	m.requests.WithLabelValues(route, getMethodLabel(method), strconv.Itoa(statusCode), errorType).Inc()
+}
+
+func (m *metrics) observeHandlerDuration(route string, method string, duration time.Duration) {
+	if m == nil {
+		return
+	}
+	m.handlerDuration.WithLabelValues(route, getMethodLabel(method)).Observe(duration.Seconds())
+}
+
+// observeValidationDuration records the time taken to validate a request or response; the stage should be "request" or "response"
+func (m *metrics) observeValidationDuration(route string, method string, stage string, duration time.Duration) {
+	if m == nil {
+		return
+	}
+	m.validationDuration.WithLabelValues(route, getMethodLabel(method), stage).Observe(duration.Seconds())
+}
+
+// standardMethods are the HTTP methods which are used as the values of our metrics' method labels as they are
+var standardMethods = map[string]bool{
+	"CONNECT": true, "DELETE": true, "GET": true, "HEAD": true, "OPTIONS": true, "PATCH": true, "POST": true, "PUT": true, "TRACE": true,
+}
+
+// getMethodLabel returns the value of the method label for a request method. Clients can send any method they like, so methods outside
+// the standard set are all labelled "_OTHER" to stop them creating an unbounded number of series
+func getMethodLabel(method string) string {
+	if standardMethods[method] {
+		return method
+	}
+	return "_OTHER"
+}
+
+// loggerCollector is a prometheus.Collector which reports the stats of the middleware's logger each time it's scraped
+type loggerCollector struct {
+	stats            func() logging.BatchLoggerStats
+	queueLength      *prometheus.Desc
+	queueCapacity    *prometheus.Desc
+	enqueuedEntries  *prometheus.Desc
+	droppedEntries   *prometheus.Desc
+	discardedEntries *prometheus.Desc
+	batchesCreated   *prometheus.Desc
+	batchesSent      *prometheus.Desc
+	batchesFailed    *prometheus.Desc
+	retries          *prometheus.Desc
+}
+
+func newLoggerCollector(stats func() logging.BatchLoggerStats) *loggerCollector {
+	newDesc := func(name string, help string) *prometheus.Desc {
+		return prometheus.NewDesc(prometheus.BuildFQName("firetail", "logger", name), help, nil, nil)
+	}
+	return &loggerCollector{
+		stats:            stats,
+		queueLength:      newDesc("queue_length", "The number of log entries waiting in the firetail logger's queue"),
+		queueCapacity:    newDesc("queue_capacity", "The maximum number of log entries the firetail logger's queue can hold"),
+		enqueuedEntries:  newDesc("enqueued_entries_total", "The number of log entries which have been added to the firetail logger's queue"),
+		droppedEntries:   newDesc("dropped_entries_total", "The number of log entries which were dropped because the firetail logger's queue was full"),
+		discardedEntries: newDesc("discarded_entries_total", "The number of log entries which were discarded by the firetail logger because they couldn't be marshalled or were too large"),
+		batchesCreated:   newDesc("batches_created_total", "The number of batches of log entries created by the firetail logger"),
+		batchesSent:      newDesc("batches_sent_total", "The number of batches of log entries sent to the Firetail logging API"),
+		batchesFailed:    newDesc("batches_failed_total", "The number of batches of log entries which failed to send to the Firetail logging API after all of their retries"),
+		retries:          newDesc("retries_total", "The number of times sending a batch of log entries to the Firetail logging API was retried"),
+	}
+}
+
+func (c *loggerCollector) Describe(descs chan<- *prometheus.Desc) {
+	for _, desc := range []*prometheus.Desc{
+		c.queueLength, c.queueCapacity, c.enqueuedEntries, c.droppedEntries, c.discardedEntries, c.batchesCreated, c.batchesSent,
+		c.batchesFailed, c.retries,
+	} {
+		descs <- desc
+	}
+}
+
+func (c *loggerCollector) Collect(metrics chan<- prometheus.Metric) {
+	stats := c.stats()
+	metrics <- prometheus.MustNewConstMetric(c.queueLength, prometheus.GaugeValue, float64(stats.QueueLength))
+	metrics <- prometheus.MustNewConstMetric(c.queueCapacity, prometheus.GaugeValue, float64(stats.QueueCapacity))
+	metrics <- prometheus.MustNewConstMetric(c.enqueuedEntries, prometheus.CounterValue, float64(stats.EnqueuedEntries))
+	metrics <- prometheus.MustNewConstMetric(c.droppedEntries, prometheus.CounterValue, float64(stats.DroppedEntries))
+	metrics <- prometheus.MustNewConstMetric(c.discardedEntries, prometheus.CounterValue, float64(stats.DiscardedEntries))
+	metrics <- prometheus.MustNewConstMetric(c.batchesCreated, prometheus.CounterValue, float64(stats.BatchesCreated))
+	metrics <- prometheus.MustNewConstMetric(c.batchesSent, prometheus.CounterValue, float64(stats.BatchesSent))
+	metrics <- prometheus.MustNewConstMetric(c.batchesFailed, prometheus.CounterValue, float64(stats.BatchesFailed))
+	metrics <- prometheus.MustNewConstMetric(c.retries, prometheus.CounterValue, float64(stats.Retries))
+}
@@ -8,7 +8,7 @@ import (
 	"io/ioutil"
 	"net"
 	"net/http"
-	"net/http/httptest"
+	"sort"
 	"strings"
 	"time"
 
@@ -17,10 +17,60 @@ import (
 	"github.com/getkin/kin-openapi/openapi3filter"
 	"github.com/getkin/kin-openapi/routers"
 	"github.com/getkin/kin-openapi/routers/gorillamux"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 )
 
+// Middleware is a firetail middleware created with NewMiddleware. Unlike the func returned by GetMiddleware, it can be used to flush or close
+// the logger to which it sends its log entries, which should be done when your application shuts down so that no logs are lost
+type Middleware struct {
+	handler     func(next http.Handler) http.Handler
+	batchLogger batchLogger
+	metrics     *metrics
+}
+
+// batchLogger is the subset of the methods of the logger returned by logging.NewBatchLogger which are used by the Middleware
+type batchLogger interface {
+	Enqueue(*logging.LogEntry)
+	Flush(context.Context) error
+	Close(context.Context) error
+	Stats() logging.BatchLoggerStats
+}
+
+// Handler wraps the next http.Handler in the firetail middleware
+func (m *Middleware) Handler(next http.Handler) http.Handler {
+	return m.handler(next)
+}
+
+// Flush sends all of the log entries the middleware has created so far, and waits for them to be sent or the context to expire
+func (m *Middleware) Flush(ctx context.Context) error {
+	return m.batchLogger.Flush(ctx)
+}
+
+// Close sends all of the log entries the middleware has created so far, and waits for them to be sent or the context to expire. Any log
+// entries created after the middleware has been closed will be dropped, so it should only be closed once your server has been shut down
+func (m *Middleware) Close(ctx context.Context) error {
+	return m.batchLogger.Close(ctx)
+}
+
+// LoggerStats returns a snapshot of the stats of the logger to which the middleware sends its log entries
+func (m *Middleware) LoggerStats() logging.BatchLoggerStats {
+	return m.batchLogger.Stats()
+}
+
 // GetMiddleware creates & returns a firetail middleware. Errs if the openapi spec can't be found, validated, or loaded into a gorillamux router.
 func GetMiddleware(options *Options) (func(next http.Handler) http.Handler, error) {
+	middleware, err := NewMiddleware(options)
+	if err != nil {
+		return nil, err
+	}
+	return middleware.Handler, nil
+}
+
+// NewMiddleware creates & returns a firetail Middleware. Errs if the openapi spec can't be found, validated, or loaded into a gorillamux router.
+func NewMiddleware(options *Options) (*Middleware, error) {
 	options.setDefaults() // Fill in any defaults where apropriate
 
 	// Load in our appspec, validate it & create a router from it if we have an appspec to load
@@ -43,23 +93,65 @@ func GetMiddleware(options *Options) (func(next http.Handler) http.Handler, erro
 	if options.MaxLogAge > 0 {
 		maxLogAge = options.MaxLogAge
 	}
-	batchLogger := logging.NewBatchLogger(logging.BatchLoggerOptions{
-		MaxBatchSize:  maxBatchSize,
-		MaxLogAge:     maxLogAge,
-		BatchCallback: options.LogBatchCallback,
-		LogApiKey:     options.LogsApiToken,
-		LogApiUrl:     options.LogsApiUrl,
-	})
-
-	middleware := func(next http.Handler) http.Handler {
+	batchLoggerOptions := logging.BatchLoggerOptions{
+		MaxBatchSize:   maxBatchSize,
+		MaxLogAge:      maxLogAge,
+		QueueCapacity:  options.LogQueueCapacity,
+		OverflowPolicy: options.LogQueueOverflowPolicy,
+		BatchCallback:  options.LogBatchCallback,
+		LogApiKey:      options.LogsApiToken,
+		LogApiUrl:      options.LogsApiUrl,
+		SpoolDirectory: options.LogSpoolDirectory,
+		SpoolMaxSize:   options.LogSpoolMaxSize,
+		SpoolMaxAge:    options.LogSpoolMaxAge,
+		HTTPClient:     options.LogHTTPClient,
+		RequestSigner:  options.LogRequestSigner,
+		Compressor:     options.LogCompressor,
+		RetryPolicy:    options.LogRetryPolicy,
+		ErrCallback:    options.LogErrCallback,
+	}
+	// If there are any additional sinks, logs are written to them alongside the LogBatchCallback, or the Firetail logging API if there's no
+	// LogBatchCallback
+	if len(options.LogSinks) > 0 {
+		var primarySink logging.Sink
+		if options.LogBatchCallback != nil {
+			primarySink = logging.NewCallbackSink(options.LogBatchCallback)
+			batchLoggerOptions.BatchCallback = nil
+		} else {
+			primarySink = logging.NewFiretailSink(batchLoggerOptions)
+		}
+		batchLoggerOptions.Sink = logging.NewFanOutSink(append([]logging.Sink{primarySink}, options.LogSinks...)...)
+	}
+	batchLogger := logging.NewBatchLogger(batchLoggerOptions)
+
+	// Create & register our metrics if we've been given a registerer
+	metrics, err := newMetrics(options.MetricsRegisterer, batchLogger.Stats)
+	if err != nil {
+		batchLogger.Close(context.Background())
+		return nil, err
+	}
+
+	tracer := options.TracerProvider.Tracer(tracerName)
+
+	handler := func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// Start a server span for the request, continuing any trace propagated by the client. It's named after the request method
+			// for now, and renamed once we know the route
+			ctx := options.TracePropagator.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+			ctx, serverSpan := tracer.Start(ctx, r.Method, trace.WithSpanKind(trace.SpanKindServer), trace.WithAttributes(
+				attribute.String("http.request.method", r.Method),
+				attribute.String("url.path", r.URL.Path),
+			))
+			defer serverSpan.End()
+			r = r.WithContext(ctx)
+
 			// Create a LogEntry populated with everything we know right now
 			ip, _, err := net.SplitHostPort(r.RemoteAddr)
 			if err != nil {
 				ip = strings.TrimSuffix(strings.TrimPrefix(r.RemoteAddr[:strings.LastIndex(r.RemoteAddr, ":")], "["), "]")
 			}
 			logEntry := logging.LogEntry{
-				Version:     logging.The100Alpha,
+				Version:     logging.The120Alpha,
 				DateCreated: time.Now().UnixMilli(),
 				Request: logging.Request{
 					HTTPProtocol: logging.HTTPProtocol(r.Proto),
@@ -74,36 +166,74 @@ func GetMiddleware(options *Options) (func(next http.Handler) http.Handler, erro
 			} else {
 				logEntry.Request.URI = "http://" + r.Host + r.URL.RequestURI()
 			}
+			// Without a TracerProvider, the span isn't recorded & its context is just the one propagated by the client, so we only record
+			// the client's trace ID; the span ID would be the client's span, not ours
+			if spanContext := serverSpan.SpanContext(); spanContext.IsValid() {
+				logEntry.TraceID = spanContext.TraceID().String()
+				if serverSpan.IsRecording() {
+					logEntry.SpanID = spanContext.SpanID().String()
+				}
+			}
+
+			// Create a Firetail responseWriter so we can access the response body, status code etc. for logging & validation later
+			localResponseWriter := newResponseWriter(w, options.StreamingContentTypes, options.MaxStreamedBodyLogSize)
 
-			// Create a Firetail ResponseWriter so we can access the response body, status code etc. for logging & validation later
-			localResponseWriter := httptest.NewRecorder()
+			// When an ErrorAtRequest occurs, we record it on the server span & in the log entry, and keep hold of the first for our metrics.
+			// Then, unless we're in monitor-only mode and the request can continue regardless, we pass it to the ErrCallback to write a
+			// response & return true to indicate the request has been blocked. Auth failures are blocked even in monitor-only mode, unless
+			// MonitorOnlyAuth is set, so that monitor-only mode doesn't silently disable the AuthCallbacks
+			var handledErr ErrorAtRequest
+			monitorOnly := options.MonitorOnly // We'll update this once we know the operation, if it's set to monitor-only
+			handleErr := func(errAtRequest ErrorAtRequest, canContinue bool) bool {
+				if handledErr == nil {
+					handledErr = errAtRequest
+				}
+				blocked := !monitorOnly || !canContinue || (!options.MonitorOnlyAuth && isAuthFailure(errAtRequest))
+				recordErrAtRequest(serverSpan, errAtRequest)
+				logEntry.ValidationFindings = append(logEntry.ValidationFindings, getValidationFindings(errAtRequest, blocked)...)
+				if blocked {
+					options.ErrCallback(errAtRequest, localResponseWriter, r)
+				}
+				return blocked
+			}
+
+			// The route in the openapi spec to which the request was made, used to label our metrics, if we can find one
+			routePath := ""
 
 			// No matter what happens, read the response from the local response writer, enqueue the log entry & publish the response that was written to the ResponseWriter
 			defer func() {
 				logEntry.Response = logging.Response{
-					StatusCode: int64(localResponseWriter.Code),
-					Body:       string(localResponseWriter.Body.Bytes()),
-					Headers:    localResponseWriter.Result().Header,
+					StatusCode: int64(localResponseWriter.statusCode),
+					Body:       localResponseWriter.body.String(),
+					Headers:    localResponseWriter.sentHeader().Clone(),
+					BodySize:   localResponseWriter.bytesWritten,
+				}
+
+				// If the connection was hijacked then no response was written by the server, so we shouldn't log one
+				if localResponseWriter.hijacked {
+					logEntry.Response = logging.Response{Hijacked: true}
+				} else {
+					serverSpan.SetAttributes(attribute.Int("http.response.status_code", localResponseWriter.statusCode))
+					if localResponseWriter.statusCode >= 500 {
+						serverSpan.SetStatus(codes.Error, http.StatusText(localResponseWriter.statusCode))
+					}
 				}
 
+				metrics.observeRequest(routePath, r.Method, localResponseWriter.statusCode, handledErr)
+
 				// Remember to sanitise the log entry before enqueueing it!
 				logEntry = options.LogEntrySanitiser(logEntry)
 
 				batchLogger.Enqueue(&logEntry)
 
-				for key, vals := range localResponseWriter.HeaderMap {
-					for _, val := range vals {
-						w.Header().Add(key, val)
-					}
-				}
-				w.WriteHeader(localResponseWriter.Code)
-				w.Write(localResponseWriter.Body.Bytes())
+				localResponseWriter.commit()
 			}()
 
 			// Read in the request body so we can log it & replace r.Body with a new copy for the next http.Handler to read from
 			requestBody, err := ioutil.ReadAll(r.Body)
 			if err != nil {
-				options.ErrCallback(ErrorAtRequestUnspecified{err}, localResponseWriter, r)
+				// We can't pass the request on without its body, so this blocks the request even in monitor-only mode
+				handleErr(ErrorAtRequestUnspecified{err}, false)
 				return
 			}
 			r.Body = io.NopCloser(bytes.NewBuffer(requestBody))
@@ -115,27 +245,41 @@ func GetMiddleware(options *Options) (func(next http.Handler) http.Handler, erro
 			var route *routers.Route
 			var pathParams map[string]string
 			if router != nil && (options.EnableRequestValidation || options.EnableResponseValidation) {
+				_, routeLookupSpan := tracer.Start(ctx, "route lookup")
+				var routeErr ErrorAtRequest
 				route, pathParams, err = router.FindRoute(r)
 				if options.AllowUndefinedRoutes && err == routers.ErrPathNotFound {
 					// If the router couldn't find the path & undefined routes are allowed, fallback to using the request path as the resource
 					logEntry.Request.Resource = r.URL.Path
 				} else if err == routers.ErrMethodNotAllowed {
-					options.ErrCallback(ErrorUnsupportedMethod{r.URL.Path, r.Method}, localResponseWriter, r)
-					return
+					routeErr = ErrorUnsupportedMethod{r.URL.Path, r.Method}
 				} else if err == routers.ErrPathNotFound {
-					options.ErrCallback(ErrorRouteNotFound{r.URL.Path}, localResponseWriter, r)
-					return
+					routeErr = ErrorRouteNotFound{r.URL.Path}
 				} else if err != nil {
-					options.ErrCallback(ErrorAtRequestUnspecified{err}, localResponseWriter, r)
-					return
+					routeErr = ErrorAtRequestUnspecified{err}
 				} else {
-					// We now know the resource that was requested, so we can fill it into our log entry
+					// We now know the resource that was requested, so we can fill it into our log entry & name our server span after it
 					logEntry.Request.Resource = route.Path
+					logEntry.Request.Route = route.Path
+					logEntry.Request.PathParams = pathParams
+					if route.Operation != nil {
+						logEntry.Request.OperationID = route.Operation.OperationID
+					}
+					routePath = route.Path
+					monitorOnly = monitorOnly || isMonitorOnlyOperation(options.MonitorOnlyOperations, route)
+					serverSpan.SetName(r.Method + " " + route.Path)
+					serverSpan.SetAttributes(attribute.String("http.route", route.Path))
+				}
+				endSpan(routeLookupSpan, routeErr)
+				if routeErr != nil && handleErr(routeErr, true) {
+					return
 				}
 			}
 
 			// If it has been enabled, and we were able to determine the route and path params, validate the request against the openapi spec
 			if options.EnableRequestValidation && route != nil && pathParams != nil {
+				requestValidationCtx, requestValidationSpan := tracer.Start(ctx, "request validation")
+				requestAuth := &authState{}
 				requestValidationInput := &openapi3filter.RequestValidationInput{
 					Request:    r,
 					PathParams: pathParams,
@@ -146,105 +290,118 @@ func GetMiddleware(options *Options) (func(next http.Handler) http.Handler, erro
 							if !hasAuthCallback {
 								return ErrorAuthSchemeNotImplemented{ai.SecuritySchemeName}
 							}
-							return authCallback(ctx, ai)
+							return requestAuth.authenticate(ctx, ai, authCallback)
 						},
+						MultiError: options.ReportAllErrors,
 					},
 				}
-				err = openapi3filter.ValidateRequest(context.Background(), requestValidationInput)
-				if err != nil {
-					// If the err is an openapi3filter RequestError, we can extract more information from the err...
-					if err, isRequestErr := err.(*openapi3filter.RequestError); isRequestErr {
-						// TODO: Using strings.Contains is janky here and may break - should replace with something more reliable
-						// See the following open issue on the kin-openapi repo: https://github.com/getkin/kin-openapi/issues/477
-						// TODO: Open source contribution to kin-openapi?
-						if strings.Contains(err.Reason, "header Content-Type has unexpected value") {
-							options.ErrCallback(ErrorRequestContentTypeInvalid{r.Header.Get("Content-Type"), route.Path}, localResponseWriter, r)
-							return
-						}
-						if strings.Contains(err.Error(), "body has an error") {
-							options.ErrCallback(ErrorRequestBodyInvalid{err}, localResponseWriter, r)
-							return
-						}
-						if strings.Contains(err.Error(), "header has an error") {
-							options.ErrCallback(ErrorRequestHeadersInvalid{err}, localResponseWriter, r)
-							return
-						}
-						if strings.Contains(err.Error(), "query has an error") {
-							options.ErrCallback(ErrorRequestQueryParamsInvalid{err}, localResponseWriter, r)
-							return
-						}
-						if strings.Contains(err.Error(), "path has an error") {
-							options.ErrCallback(ErrorRequestPathParamsInvalid{err}, localResponseWriter, r)
-							return
-						}
-					}
+				var requestErr ErrorAtRequest
+				validationStartTime := time.Now()
+				if err := openapi3filter.ValidateRequest(requestValidationCtx, requestValidationInput); err != nil {
+					requestErr = addAuthChallenges(
+						getRequestValidationErr(err, r, route), route, options.AuthRealm, requestAuth.invalidCredentialsSchemes(),
+					)
+				}
+				metrics.observeValidationDuration(routePath, r.Method, "request", time.Since(validationStartTime))
+				endSpan(requestValidationSpan, requestErr)
+
+				// Record who made the request if an auth callback authenticated them, even if the request is going to be blocked. Only the
+				// values from the security requirement which passed are used, not those of any which partially authenticated the request
+				authValues := requestAuth.passedValues(route)
+				if principal, hasPrincipal := authValues[principalKey{}].(Principal); hasPrincipal {
+					logEntry.Identity = getIdentity(principal)
+				}
 
-					// If the validation fails due to a security requirement, we pass a SecurityRequirementsError to the ErrCallback
-					if err, isSecurityErr := err.(*openapi3filter.SecurityRequirementsError); isSecurityErr {
-						options.ErrCallback(ErrorAuthNoMatchingScheme{err}, localResponseWriter, r)
+				if requestErr != nil && handleErr(requestErr, true) {
+					return
+				}
+
+				// Pass on any values the auth callbacks stored, such as the claims of a verified JWT, to the next handler
+				ctx = withAuthValues(ctx, authValues)
+				r = r.WithContext(ctx)
+			}
+
+			// If we know the route, negotiate the media type of the response from those declared in the spec so the handler can use it
+			if route != nil {
+				if responseMediaTypes := getResponseMediaTypes(route); len(responseMediaTypes) > 0 {
+					accept := r.Header.Get("Accept")
+					if mediaType := negotiateMediaType(accept, responseMediaTypes); mediaType != "" {
+						ctx = context.WithValue(ctx, negotiatedMediaTypeKey{}, mediaType)
+						r = r.WithContext(ctx)
+					} else if options.EnforceAcceptHeader && handleErr(ErrorNotAcceptable{accept, route.Path, responseMediaTypes}, true) {
 						return
 					}
+				}
+			}
 
-					// Else, we just use a non-specific ValidationError error
-					options.ErrCallback(ErrorAtRequestUnspecified{err}, localResponseWriter, r)
-					return
+			// If the route is one which should be streamed, the response will be passed straight through to w as it's written
+			for _, streamingRoute := range options.StreamingRoutes {
+				if streamingRoute == logEntry.Request.Resource {
+					localResponseWriter.streamAll = true
+					break
 				}
 			}
 
 			// Serve the next handler down the chain & take note of the execution time
-			chainResponseWriter := httptest.NewRecorder()
+			handlerCtx, handlerSpan := tracer.Start(ctx, "handler")
 			startTime := time.Now()
-			next.ServeHTTP(chainResponseWriter, r)
-			logEntry.ExecutionTime = float64(time.Since(startTime)) / 1000000.0
+			next.ServeHTTP(localResponseWriter.withOptionalInterfaces(), r.WithContext(handlerCtx))
+			executionTime := time.Since(startTime)
+			logEntry.ExecutionTime = float64(executionTime) / 1000000.0
+			handlerSpan.End()
+			metrics.observeHandlerDuration(routePath, r.Method, executionTime)
 
-			// If it has been enabled, and we were able to determine the route and path params, validate the response against the openapi spec
-			if options.EnableResponseValidation && route != nil && pathParams != nil {
+			// If it has been enabled, and we were able to determine the route and path params, validate the response against the openapi spec.
+			// If the response was streamed or the connection was hijacked, there's no response left for us to validate.
+			if options.EnableResponseValidation && route != nil && pathParams != nil && !localResponseWriter.streaming && !localResponseWriter.hijacked {
+				responseValidationCtx, responseValidationSpan := tracer.Start(ctx, "response validation")
 				responseValidationInput := &openapi3filter.ResponseValidationInput{
 					RequestValidationInput: &openapi3filter.RequestValidationInput{
 						Request:    r,
 						PathParams: pathParams,
 						Route:      route,
 					},
-					Status: chainResponseWriter.Result().StatusCode,
-					Header: chainResponseWriter.Header(),
+					Status: localResponseWriter.statusCode,
+					Header: localResponseWriter.sentHeader(),
 					Options: &openapi3filter.Options{
 						IncludeResponseStatus: true,
 					},
 				}
-				responseBytes, err := ioutil.ReadAll(chainResponseWriter.Result().Body)
-				if err != nil {
-					options.ErrCallback(ErrorResponseBodyInvalid{err}, localResponseWriter, r)
-					return
+				responseValidationInput.SetBodyBytes(localResponseWriter.body.Bytes())
+				var responseErr ErrorAtRequest
+				validationStartTime := time.Now()
+				// We validate the response headers ourselves first, as kin-openapi either doesn't validate them or stops at the first which fails
+				responseErr = validateResponseHeaders(route, localResponseWriter.statusCode, localResponseWriter.sentHeader())
+				if responseErr == nil {
+					// If the Content-Type only matches one declared in the spec by its suffix, e.g. application/problem+json for
+					// application/json, kin-openapi needs to be told to treat it as the declared media type
+					var declaredMediaType string
+					declaredMediaType, responseErr = validateResponseContentType(route, localResponseWriter.statusCode, localResponseWriter.sentHeader())
+					if declaredMediaType != "" {
+						responseValidationInput.Header = localResponseWriter.sentHeader().Clone()
+						responseValidationInput.Header.Set("Content-Type", declaredMediaType)
+					}
 				}
-				responseValidationInput.SetBodyBytes(responseBytes)
-				err = openapi3filter.ValidateResponse(context.Background(), responseValidationInput)
-				if err != nil {
-					if responseError, isResponseError := err.(*openapi3filter.ResponseError); isResponseError {
-						if responseError.Reason == "response body doesn't match the schema" {
-							options.ErrCallback(ErrorResponseBodyInvalid{responseError}, localResponseWriter, r)
-							return
-						} else if responseError.Reason == "status is not supported" {
-							options.ErrCallback(ErrorResponseStatusCodeInvalid{responseError.Input.Status}, localResponseWriter, r)
-							return
-						}
+				if responseErr == nil {
+					if err := openapi3filter.ValidateResponse(responseValidationCtx, responseValidationInput); err != nil {
+						responseErr = getResponseValidationErr(err, responseValidationInput)
 					}
-					options.ErrCallback(ErrorAtRequestUnspecified{err}, localResponseWriter, r)
-					return
 				}
-			}
-
-			// If the response written down the chain passed all of the enabled validation, we can now write it to our localResponseWriter
-			for key, vals := range chainResponseWriter.HeaderMap {
-				for _, val := range vals {
-					localResponseWriter.Header().Add(key, val)
+				metrics.observeValidationDuration(routePath, r.Method, "response", time.Since(validationStartTime))
+				endSpan(responseValidationSpan, responseErr)
+				if responseErr != nil {
+					// The response that was written down the chain failed to validate, so unless we're in monitor-only mode we discard it &
+					// write an error response in its place
+					if !monitorOnly {
+						localResponseWriter.reset()
+					}
+					handleErr(responseErr, true)
 				}
 			}
-			localResponseWriter.WriteHeader(chainResponseWriter.Code)
-			localResponseWriter.Write(chainResponseWriter.Body.Bytes())
 		})
 	}
 
-	return middleware, nil
+	return &Middleware{handler, batchLogger, metrics}, nil
 }
 
 func getRouter(options *Options) (routers.Router, error) {
@@ -283,3 +440,165 @@ func getRouter(options *Options) (routers.Router, error) {
 
 	return router, nil
 }
+
+// getRequestValidationErr converts an error returned by openapi3filter.ValidateRequest into an ErrorAtRequest, classifying it by the
+// parameter or request body it relates to rather than by its message
+func getRequestValidationErr(err error, r *http.Request, route *routers.Route) ErrorAtRequest {
+	// If ReportAllErrors is enabled we get a MultiError, the contents of which we classify individually & then collect together
+	if multiErr, isMultiErr := err.(openapi3.MultiError); isMultiErr {
+		errRequestInvalid := ErrorRequestInvalid{}
+		for _, err := range multiErr {
+			errAtRequest := getRequestValidationErr(err, r, route)
+			errRequestInvalid.Errs = append(errRequestInvalid.Errs, errAtRequest)
+			for _, issue := range getValidationIssues(errAtRequest) {
+				if issue.Detail == "" {
+					issue.Detail = errAtRequest.Title()
+				}
+				errRequestInvalid.Issues = append(errRequestInvalid.Issues, issue)
+			}
+		}
+		return errRequestInvalid
+	}
+
+	// If the err is an openapi3filter RequestError, it'll tell us which parameter or the request body failed to validate...
+	var requestErr *openapi3filter.RequestError
+	if errors.As(err, &requestErr) {
+		if requestErr.Parameter != nil {
+			switch requestErr.Parameter.In {
+			case openapi3.ParameterInHeader:
+				return ErrorRequestHeadersInvalid{requestErr}
+			case openapi3.ParameterInQuery:
+				return ErrorRequestQueryParamsInvalid{requestErr}
+			case openapi3.ParameterInPath:
+				return ErrorRequestPathParamsInvalid{requestErr}
+			case openapi3.ParameterInCookie:
+				return ErrorRequestCookieParamsInvalid{requestErr}
+			}
+		}
+		if requestErr.RequestBody != nil {
+			// If the request body has content types defined & none of them match the request's Content-Type, then it's the Content-Type
+			// that's wrong rather than the body itself. A missing body, with or without a Content-Type, is a 400
+			contentType := r.Header.Get("Content-Type")
+			if !errors.Is(requestErr.Err, openapi3filter.ErrInvalidRequired) &&
+				len(requestErr.RequestBody.Content) > 0 && requestErr.RequestBody.Content.Get(contentType) == nil {
+				return ErrorRequestContentTypeInvalid{contentType, route.Path}
+			}
+			return ErrorRequestBodyInvalid{requestErr}
+		}
+	}
+
+	// If the validation fails due to a security requirement, we classify it by the errors the auth callbacks returned
+	var securityErr *openapi3filter.SecurityRequirementsError
+	if errors.As(err, &securityErr) {
+		return getSecurityRequirementsErr(securityErr)
+	}
+
+	// Else, we just use a non-specific ValidationError error
+	return ErrorAtRequestUnspecified{err}
+}
+
+// getSecurityRequirementsErr classifies a SecurityRequirementsError by the errors the auth callbacks returned for each of the security
+// requirements. If the request's credentials satisfied a security scheme but lacked the scopes required for it, they're authenticated but
+// forbidden; otherwise, if any of its credentials were invalid, they're invalid; and if all of its credentials were missing, they're
+// missing. If the auth callbacks' errors don't say which, e.g. because they're custom callbacks, we use an ErrorAuthNoMatchingScheme
+func getSecurityRequirementsErr(securityErr *openapi3filter.SecurityRequirementsError) ErrorAtRequest {
+	anyInvalid, allMissing := false, len(securityErr.Errors) > 0
+	for _, schemeErr := range securityErr.Errors {
+		var scopeErr ErrorAuthInsufficientScope
+		if errors.As(schemeErr, &scopeErr) {
+			return scopeErr
+		}
+		anyInvalid = anyInvalid || errors.Is(schemeErr, ErrCredentialsInvalid)
+		allMissing = allMissing && errors.Is(schemeErr, ErrCredentialsMissing)
+	}
+	switch {
+	case anyInvalid:
+		return ErrorAuthCredentialsInvalid{Err: securityErr}
+	case allMissing:
+		return ErrorAuthCredentialsMissing{Err: securityErr}
+	default:
+		return ErrorAuthNoMatchingScheme{Err: securityErr}
+	}
+}
+
+// getResponseValidationErr converts an error returned by openapi3filter.ValidateResponse into an ErrorAtRequest, classifying it by
+// whether the spec defines a response for the status code & the type of the underlying error rather than by its message
+func getResponseValidationErr(err error, input *openapi3filter.ResponseValidationInput) ErrorAtRequest {
+	var responseErr *openapi3filter.ResponseError
+	if !errors.As(err, &responseErr) {
+		return ErrorAtRequestUnspecified{err}
+	}
+
+	// If there's neither a response for the status code nor a default response in the spec, then it's the status code that's wrong
+	responses := input.RequestValidationInput.Route.Operation.Responses
+	if responses.Get(input.Status) == nil && responses.Default() == nil {
+		return ErrorResponseStatusCodeInvalid{input.Status}
+	}
+
+	// If there's content declared for the status code but none of it matches the Content-Type, then it's the Content-Type that's wrong
+	responseRef := responses.Get(input.Status)
+	if responseRef == nil {
+		responseRef = responses.Default()
+	}
+	contentType := input.Header.Get("Content-Type")
+	if responseErr.Err == nil && responseRef.Value != nil && len(responseRef.Value.Content) > 0 && responseRef.Value.Content.Get(contentType) == nil {
+		allowedContentTypes := []string{}
+		for allowedContentType := range responseRef.Value.Content {
+			allowedContentTypes = append(allowedContentTypes, allowedContentType)
+		}
+		sort.Strings(allowedContentTypes)
+		return ErrorResponseContentTypeInvalid{contentType, input.Status, allowedContentTypes}
+	}
+
+	// Otherwise, the body failed to validate if it couldn't be decoded or didn't match its schema
+	var parseErr *openapi3filter.ParseError
+	var schemaErr *openapi3.SchemaError
+	var multiErr openapi3.MultiError
+	if errors.As(responseErr.Err, &parseErr) || errors.As(responseErr.Err, &schemaErr) || errors.As(responseErr.Err, &multiErr) {
+		return ErrorResponseBodyInvalid{responseErr}
+	}
+
+	return ErrorAtRequestUnspecified{err}
+}
+
+// isMonitorOnlyOperation returns true if the operation of the route is in the list of monitor-only operations, either by its operationId
+// or in the form "METHOD /path"
+func isMonitorOnlyOperation(monitorOnlyOperations []string, route *routers.Route) bool {
+	for _, monitorOnlyOperation := range monitorOnlyOperations {
+		if route.Operation != nil && route.Operation.OperationID != "" && monitorOnlyOperation == route.Operation.OperationID {
+			return true
+		}
+		if monitorOnlyOperation == route.Method+" "+route.Path {
+			return true
+		}
+	}
+	return false
+}
+
+// isAuthFailure returns true if an ErrorAtRequest, or any of the errors in an ErrorRequestInvalid, is a failure to authenticate the
+// request using the AuthCallbacks. If none of the security requirements could be checked because their schemes have no AuthCallbacks,
+// the middleware isn't enforcing auth for the operation, so that isn't an auth failure
+func isAuthFailure(errAtRequest ErrorAtRequest) bool {
+	switch err := errAtRequest.(type) {
+	case ErrorAuthCredentialsMissing, ErrorAuthCredentialsInvalid, ErrorAuthInsufficientScope:
+		return true
+	case ErrorAuthNoMatchingScheme:
+		if err.Err == nil {
+			return true
+		}
+		for _, schemeErr := range err.Err.Errors {
+			var notImplementedErr ErrorAuthSchemeNotImplemented
+			if !errors.As(schemeErr, &notImplementedErr) {
+				return true
+			}
+		}
+		return false
+	case ErrorRequestInvalid:
+		for _, subErr := range err.Errs {
+			if isAuthFailure(subErr) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -1,13 +1,19 @@
 package firetail
 
 import (
+	"bufio"
 	"bytes"
 	"context"
+	"encoding/json"
+	"encoding/xml"
 	"errors"
 	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -16,9 +22,17 @@ import (
 	"github.com/FireTail-io/firetail-go-lib/logging"
 	"github.com/getkin/kin-openapi/openapi3"
 	"github.com/getkin/kin-openapi/openapi3filter"
+	"github.com/prometheus/client_golang/prometheus"
+	promtestutil "github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/sbabiv/xml2map"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
 )
 
 //go:embed test-spec.yaml
@@ -175,11 +189,11 @@ func TestRequestToInvalidRoute(t *testing.T) {
 	require.Contains(t, responseRecorder.HeaderMap, "Content-Type")
 	require.GreaterOrEqual(t, len(responseRecorder.HeaderMap["Content-Type"]), 1)
 	assert.Len(t, responseRecorder.HeaderMap["Content-Type"], 1)
-	assert.Equal(t, "application/json", responseRecorder.HeaderMap["Content-Type"][0])
+	assert.Equal(t, "application/problem+json", responseRecorder.HeaderMap["Content-Type"][0])
 
 	respBody, err := io.ReadAll(responseRecorder.Body)
 	require.Nil(t, err)
-	assert.Equal(t, "{\"code\":404,\"title\":\"the resource \\\"/not-implemented\\\" could not be found\",\"detail\":\"a path for \\\"/not-implemented\\\" could not be found in your appspec\"}", string(respBody))
+	assert.Equal(t, "{\"type\":\"about:blank\",\"title\":\"the resource \\\"/not-implemented\\\" could not be found\",\"status\":404,\"detail\":\"a path for \\\"/not-implemented\\\" could not be found in your appspec\",\"instance\":\"/not-implemented\"}", string(respBody))
 }
 
 func TestRequestToInvalidRouteWithAllowUndefinedRoutesEnabled(t *testing.T) {
@@ -225,11 +239,11 @@ func TestDebugErrsDisabled(t *testing.T) {
 	require.Contains(t, responseRecorder.HeaderMap, "Content-Type")
 	require.GreaterOrEqual(t, len(responseRecorder.HeaderMap["Content-Type"]), 1)
 	assert.Len(t, responseRecorder.HeaderMap["Content-Type"], 1)
-	assert.Equal(t, "application/json", responseRecorder.HeaderMap["Content-Type"][0])
+	assert.Equal(t, "application/problem+json", responseRecorder.HeaderMap["Content-Type"][0])
 
 	respBody, err := io.ReadAll(responseRecorder.Body)
 	require.Nil(t, err)
-	assert.Equal(t, "{\"code\":404,\"title\":\"the resource \\\"/not-implemented\\\" could not be found\"}", string(respBody))
+	assert.Equal(t, "{\"type\":\"about:blank\",\"title\":\"the resource \\\"/not-implemented\\\" could not be found\",\"status\":404,\"instance\":\"/not-implemented\"}", string(respBody))
 }
 
 func TestRequestWithDisallowedMethod(t *testing.T) {
@@ -250,11 +264,11 @@ func TestRequestWithDisallowedMethod(t *testing.T) {
 	require.Contains(t, responseRecorder.HeaderMap, "Content-Type")
 	require.GreaterOrEqual(t, len(responseRecorder.HeaderMap["Content-Type"]), 1)
 	assert.Len(t, responseRecorder.HeaderMap["Content-Type"], 1)
-	assert.Equal(t, "application/json", responseRecorder.HeaderMap["Content-Type"][0])
+	assert.Equal(t, "application/problem+json", responseRecorder.HeaderMap["Content-Type"][0])
 
 	respBody, err := io.ReadAll(responseRecorder.Body)
 	require.Nil(t, err)
-	assert.Equal(t, "{\"code\":405,\"title\":\"the resource \\\"/implemented/1\\\" does not support the \\\"GET\\\" method\",\"detail\":\"the path for \\\"/implemented/1\\\" in your appspec does not support the method \\\"GET\\\"\"}", string(respBody))
+	assert.Equal(t, "{\"type\":\"about:blank\",\"title\":\"the resource \\\"/implemented/1\\\" does not support the \\\"GET\\\" method\",\"status\":405,\"detail\":\"the path for \\\"/implemented/1\\\" in your appspec does not support the method \\\"GET\\\"\",\"instance\":\"/implemented/1\"}", string(respBody))
 }
 
 func TestRequestWithInvalidHeader(t *testing.T) {
@@ -282,13 +296,13 @@ func TestRequestWithInvalidHeader(t *testing.T) {
 	require.Contains(t, responseRecorder.HeaderMap, "Content-Type")
 	require.GreaterOrEqual(t, len(responseRecorder.HeaderMap["Content-Type"]), 1)
 	assert.Len(t, responseRecorder.HeaderMap["Content-Type"], 1)
-	assert.Equal(t, "application/json", responseRecorder.HeaderMap["Content-Type"][0])
+	assert.Equal(t, "application/problem+json", responseRecorder.HeaderMap["Content-Type"][0])
 
 	respBody, err := io.ReadAll(responseRecorder.Body)
 	require.Nil(t, err)
 	assert.Equal(
 		t,
-		"{\"code\":400,\"title\":\"something's wrong with your request headers\",\"detail\":\"the request's headers did not match your appspec: parameter \\\"X-Test-Header\\\" in header has an error: value invalid: an invalid number: invalid syntax\"}",
+		"{\"type\":\"about:blank\",\"title\":\"something's wrong with your request headers\",\"status\":400,\"detail\":\"the request's headers did not match your appspec: parameter \\\"X-Test-Header\\\" in header has an error: value invalid: an invalid number: invalid syntax\",\"instance\":\"/implemented/1\"}",
 		string(respBody),
 	)
 }
@@ -317,17 +331,45 @@ func TestRequestWithInvalidQueryParam(t *testing.T) {
 	require.Contains(t, responseRecorder.HeaderMap, "Content-Type")
 	require.GreaterOrEqual(t, len(responseRecorder.HeaderMap["Content-Type"]), 1)
 	assert.Len(t, responseRecorder.HeaderMap["Content-Type"], 1)
-	assert.Equal(t, "application/json", responseRecorder.HeaderMap["Content-Type"][0])
+	assert.Equal(t, "application/problem+json", responseRecorder.HeaderMap["Content-Type"][0])
 
 	respBody, err := io.ReadAll(responseRecorder.Body)
 	require.Nil(t, err)
 	assert.Equal(
 		t,
-		"{\"code\":400,\"title\":\"something's wrong with your query parameters\",\"detail\":\"the request's query parameters did not match your appspec: parameter \\\"test-param\\\" in query has an error: value invalid: an invalid number: invalid syntax\"}",
+		"{\"type\":\"about:blank\",\"title\":\"something's wrong with your query parameters\",\"status\":400,\"detail\":\"the request's query parameters did not match your appspec: parameter \\\"test-param\\\" in query has an error: value invalid: an invalid number: invalid syntax\",\"instance\":\"/implemented/1\"}",
 		string(respBody),
 	)
 }
 
+func TestRequestWithInvalidCookieParam(t *testing.T) {
+	middleware, err := GetMiddleware(&Options{
+		OpenapiSpecPath:         "./test-spec.yaml",
+		AuthCallbacks:           authCallbacks,
+		DebugErrs:               true,
+		EnableRequestValidation: true,
+	})
+	require.Nil(t, err)
+	handler := middleware(healthHandler)
+	responseRecorder := httptest.NewRecorder()
+
+	request := httptest.NewRequest(
+		"POST", "/implemented/1",
+		io.NopCloser(bytes.NewBuffer([]byte("{\"description\":\"test description\"}"))),
+	)
+	request.Header.Add("Content-Type", "application/json")
+	request.Header.Add("X-Api-Key", "valid-api-key")
+	request.AddCookie(&http.Cookie{Name: "test-cookie", Value: "invalid"})
+	handler.ServeHTTP(responseRecorder, request)
+
+	assert.Equal(t, 400, responseRecorder.Code)
+
+	respBody, err := io.ReadAll(responseRecorder.Body)
+	require.Nil(t, err)
+	assert.Contains(t, string(respBody), "\"title\":\"something's wrong with your cookies\"")
+	assert.Contains(t, string(respBody), "the request's cookie parameters did not match your appspec: parameter \\\"test-cookie\\\" in cookie has an error")
+}
+
 func TestRequestWithInvalidPathParam(t *testing.T) {
 	middleware, err := GetMiddleware(&Options{
 		OpenapiSpecPath:         "./test-spec.yaml",
@@ -351,13 +393,13 @@ func TestRequestWithInvalidPathParam(t *testing.T) {
 	require.Contains(t, responseRecorder.HeaderMap, "Content-Type")
 	require.GreaterOrEqual(t, len(responseRecorder.HeaderMap["Content-Type"]), 1)
 	assert.Len(t, responseRecorder.HeaderMap["Content-Type"], 1)
-	assert.Equal(t, "application/json", responseRecorder.HeaderMap["Content-Type"][0])
+	assert.Equal(t, "application/problem+json", responseRecorder.HeaderMap["Content-Type"][0])
 
 	respBody, err := io.ReadAll(responseRecorder.Body)
 	require.Nil(t, err)
 	assert.Equal(
 		t,
-		"{\"code\":400,\"title\":\"something's wrong with your path parameters\",\"detail\":\"the request's path parameters did not match your appspec: parameter \\\"testparam\\\" in path has an error: value invalid-path-param: an invalid number: invalid syntax\"}",
+		"{\"type\":\"about:blank\",\"title\":\"something's wrong with your path parameters\",\"status\":400,\"detail\":\"the request's path parameters did not match your appspec: parameter \\\"testparam\\\" in path has an error: value invalid-path-param: an invalid number: invalid syntax\",\"instance\":\"/implemented/invalid-path-param\"}",
 		string(respBody),
 	)
 }
@@ -386,13 +428,13 @@ func TestRequestWithInvalidBody(t *testing.T) {
 	require.Contains(t, responseRecorder.HeaderMap, "Content-Type")
 	require.GreaterOrEqual(t, len(responseRecorder.HeaderMap["Content-Type"]), 1)
 	assert.Len(t, responseRecorder.HeaderMap["Content-Type"], 1)
-	assert.Equal(t, "application/json", responseRecorder.HeaderMap["Content-Type"][0])
+	assert.Equal(t, "application/problem+json", responseRecorder.HeaderMap["Content-Type"][0])
 
 	respBody, err := io.ReadAll(responseRecorder.Body)
 	require.Nil(t, err)
 	assert.Equal(
 		t,
-		"{\"code\":400,\"title\":\"something's wrong with your request body\",\"detail\":\"the request's body did not match your appspec: request body has an error: doesn't match the schema: Error at \\\"/description\\\": property \\\"description\\\" is missing\\nSchema:\\n  {\\n    \\\"additionalProperties\\\": false,\\n    \\\"properties\\\": {\\n      \\\"description\\\": {\\n        \\\"enum\\\": [\\n          \\\"test description\\\"\\n        ],\\n        \\\"type\\\": \\\"string\\\"\\n      }\\n    },\\n    \\\"required\\\": [\\n      \\\"description\\\"\\n    ],\\n    \\\"type\\\": \\\"object\\\"\\n  }\\n\\nValue:\\n  {}\\n\"}",
+		"{\"type\":\"about:blank\",\"title\":\"something's wrong with your request body\",\"status\":400,\"detail\":\"the request's body did not match your appspec: request body has an error: doesn't match the schema: Error at \\\"/description\\\": property \\\"description\\\" is missing\\nSchema:\\n  {\\n    \\\"additionalProperties\\\": false,\\n    \\\"properties\\\": {\\n      \\\"description\\\": {\\n        \\\"enum\\\": [\\n          \\\"test description\\\"\\n        ],\\n        \\\"type\\\": \\\"string\\\"\\n      }\\n    },\\n    \\\"required\\\": [\\n      \\\"description\\\"\\n    ],\\n    \\\"type\\\": \\\"object\\\"\\n  }\\n\\nValue:\\n  {}\\n\",\"instance\":\"/implemented/1\"}",
 		string(respBody),
 	)
 }
@@ -453,13 +495,13 @@ func TestRequestWithUnimplementedAuth(t *testing.T) {
 	require.Contains(t, responseRecorder.HeaderMap, "Content-Type")
 	require.GreaterOrEqual(t, len(responseRecorder.HeaderMap["Content-Type"]), 1)
 	assert.Len(t, responseRecorder.HeaderMap["Content-Type"], 1)
-	assert.Equal(t, "application/json", responseRecorder.HeaderMap["Content-Type"][0])
+	assert.Equal(t, "application/problem+json", responseRecorder.HeaderMap["Content-Type"][0])
 
 	respBody, err := io.ReadAll(responseRecorder.Body)
 	require.Nil(t, err)
 	assert.Equal(
 		t,
-		"{\"code\":401,\"title\":\"you're not authorized to do this\",\"detail\":\"the request did not satisfy the security requirements in your appspec: security requirements failed: the security scheme \\\"ApiKeyAuth1\\\" from your appspec has not been implemented in the application | the security scheme \\\"ApiKeyAuth2\\\" from your appspec has not been implemented in the application, errors: the security scheme \\\"ApiKeyAuth1\\\" from your appspec has not been implemented in the application, the security scheme \\\"ApiKeyAuth2\\\" from your appspec has not been implemented in the application\"}",
+		"{\"type\":\"about:blank\",\"title\":\"you're not authorized to do this\",\"status\":401,\"detail\":\"the request did not satisfy the security requirements in your appspec: security requirements failed: the security scheme \\\"ApiKeyAuth1\\\" from your appspec has not been implemented in the application | the security scheme \\\"ApiKeyAuth2\\\" from your appspec has not been implemented in the application, errors: the security scheme \\\"ApiKeyAuth1\\\" from your appspec has not been implemented in the application, the security scheme \\\"ApiKeyAuth2\\\" from your appspec has not been implemented in the application\",\"instance\":\"/implemented/1\"}",
 		string(respBody),
 	)
 }
@@ -487,13 +529,13 @@ func TestRequestWithMissingAuth(t *testing.T) {
 	require.Contains(t, responseRecorder.HeaderMap, "Content-Type")
 	require.GreaterOrEqual(t, len(responseRecorder.HeaderMap["Content-Type"]), 1)
 	assert.Len(t, responseRecorder.HeaderMap["Content-Type"], 1)
-	assert.Equal(t, "application/json", responseRecorder.HeaderMap["Content-Type"][0])
+	assert.Equal(t, "application/problem+json", responseRecorder.HeaderMap["Content-Type"][0])
 
 	respBody, err := io.ReadAll(responseRecorder.Body)
 	require.Nil(t, err)
 	assert.Equal(
 		t,
-		"{\"code\":401,\"title\":\"you're not authorized to do this\",\"detail\":\"the request did not satisfy the security requirements in your appspec: security requirements failed: invalid API key | invalid API key, errors: invalid API key, invalid API key\"}",
+		"{\"type\":\"about:blank\",\"title\":\"you're not authorized to do this\",\"status\":401,\"detail\":\"the request did not satisfy the security requirements in your appspec: security requirements failed: invalid API key | invalid API key, errors: invalid API key, invalid API key\",\"instance\":\"/implemented/1\"}",
 		string(respBody),
 	)
 }
@@ -522,13 +564,13 @@ func TestRequestWithInvalidAuth(t *testing.T) {
 	require.Contains(t, responseRecorder.HeaderMap, "Content-Type")
 	require.GreaterOrEqual(t, len(responseRecorder.HeaderMap["Content-Type"]), 1)
 	assert.Len(t, responseRecorder.HeaderMap["Content-Type"], 1)
-	assert.Equal(t, "application/json", responseRecorder.HeaderMap["Content-Type"][0])
+	assert.Equal(t, "application/problem+json", responseRecorder.HeaderMap["Content-Type"][0])
 
 	respBody, err := io.ReadAll(responseRecorder.Body)
 	require.Nil(t, err)
 	assert.Equal(
 		t,
-		"{\"code\":401,\"title\":\"you're not authorized to do this\",\"detail\":\"the request did not satisfy the security requirements in your appspec: security requirements failed: invalid API key | invalid API key, errors: invalid API key, invalid API key\"}",
+		"{\"type\":\"about:blank\",\"title\":\"you're not authorized to do this\",\"status\":401,\"detail\":\"the request did not satisfy the security requirements in your appspec: security requirements failed: invalid API key | invalid API key, errors: invalid API key, invalid API key\",\"instance\":\"/implemented/1\"}",
 		string(respBody),
 	)
 }
@@ -557,13 +599,13 @@ func TestInvalidResponseBody(t *testing.T) {
 	require.Contains(t, responseRecorder.HeaderMap, "Content-Type")
 	require.GreaterOrEqual(t, len(responseRecorder.HeaderMap["Content-Type"]), 1)
 	assert.Len(t, responseRecorder.HeaderMap["Content-Type"], 1)
-	assert.Equal(t, "application/json", responseRecorder.HeaderMap["Content-Type"][0])
+	assert.Equal(t, "application/problem+json", responseRecorder.HeaderMap["Content-Type"][0])
 
 	respBody, err := io.ReadAll(responseRecorder.Body)
 	require.Nil(t, err)
 	assert.Equal(
 		t,
-		"{\"code\":500,\"title\":\"internal server error\",\"detail\":\"the response's body did not match your appspec: response body doesn't match the schema: Error at \\\"/description\\\": value \\\"another test description\\\" is not one of the allowed values\\nSchema:\\n  {\\n    \\\"enum\\\": [\\n      \\\"test description\\\"\\n    ],\\n    \\\"type\\\": \\\"string\\\"\\n  }\\n\\nValue:\\n  \\\"another test description\\\"\\n\"}",
+		"{\"type\":\"about:blank\",\"title\":\"internal server error\",\"status\":500,\"detail\":\"the response's body did not match your appspec: response body doesn't match the schema: Error at \\\"/description\\\": value \\\"another test description\\\" is not one of the allowed values\\nSchema:\\n  {\\n    \\\"enum\\\": [\\n      \\\"test description\\\"\\n    ],\\n    \\\"type\\\": \\\"string\\\"\\n  }\\n\\nValue:\\n  \\\"another test description\\\"\\n\",\"instance\":\"/implemented/1\"}",
 		string(respBody),
 	)
 }
@@ -592,13 +634,13 @@ func TestInvalidResponseCode(t *testing.T) {
 	require.Contains(t, responseRecorder.HeaderMap, "Content-Type")
 	require.GreaterOrEqual(t, len(responseRecorder.HeaderMap["Content-Type"]), 1)
 	assert.Len(t, responseRecorder.HeaderMap["Content-Type"], 1)
-	assert.Equal(t, "application/json", responseRecorder.HeaderMap["Content-Type"][0])
+	assert.Equal(t, "application/problem+json", responseRecorder.HeaderMap["Content-Type"][0])
 
 	respBody, err := io.ReadAll(responseRecorder.Body)
 	require.Nil(t, err)
 	assert.Equal(
 		t,
-		"{\"code\":500,\"title\":\"internal server error\",\"detail\":\"the response's status code did not match your appspec: 201\"}",
+		"{\"type\":\"about:blank\",\"title\":\"internal server error\",\"status\":500,\"detail\":\"the response's status code did not match your appspec: 201\",\"instance\":\"/implemented/1\"}",
 		string(respBody),
 	)
 }
@@ -683,11 +725,51 @@ func TestUnexpectedContentType(t *testing.T) {
 	require.Contains(t, responseRecorder.HeaderMap, "Content-Type")
 	require.GreaterOrEqual(t, len(responseRecorder.HeaderMap["Content-Type"]), 1)
 	assert.Len(t, responseRecorder.HeaderMap["Content-Type"], 1)
-	assert.Equal(t, "application/json", responseRecorder.HeaderMap["Content-Type"][0])
+	assert.Equal(t, "application/problem+json", responseRecorder.HeaderMap["Content-Type"][0])
 
 	respBody, err := io.ReadAll(responseRecorder.Body)
 	require.Nil(t, err)
-	assert.Equal(t, "{\"code\":415,\"title\":\"the path for \\\"/implemented/{testparam}\\\" in your appspec does not support the content type \\\"text/plain\\\"\",\"detail\":\"the path for \\\"/implemented/{testparam}\\\" in your appspec does not support content type \\\"text/plain\\\"\"}", string(respBody))
+	assert.Equal(t, "{\"type\":\"about:blank\",\"title\":\"the path for \\\"/implemented/{testparam}\\\" in your appspec does not support the content type \\\"text/plain\\\"\",\"status\":415,\"detail\":\"the path for \\\"/implemented/{testparam}\\\" in your appspec does not support content type \\\"text/plain\\\"\",\"instance\":\"/implemented/1\"}", string(respBody))
+}
+
+func TestMissingBodyWithoutContentType(t *testing.T) {
+	middleware, err := GetMiddleware(&Options{
+		OpenapiSpecPath:         "./test-spec.yaml",
+		AuthCallbacks:           authCallbacks,
+		EnableRequestValidation: true,
+	})
+	require.Nil(t, err)
+	handler := middleware(healthHandler)
+	responseRecorder := httptest.NewRecorder()
+
+	request := httptest.NewRequest("POST", "/implemented/1", nil)
+	request.Header.Add("X-Api-Key", "valid-api-key")
+	handler.ServeHTTP(responseRecorder, request)
+
+	// The body is missing rather than of an unsupported content type, so it should be a 400 rather than a 415
+	assert.Equal(t, 400, responseRecorder.Code)
+	assert.Equal(t, "something's wrong with your request body", getTestProblemTitle(t, responseRecorder))
+}
+
+func TestBodyWithoutContentType(t *testing.T) {
+	middleware, err := GetMiddleware(&Options{
+		OpenapiSpecPath:         "./test-spec.yaml",
+		AuthCallbacks:           authCallbacks,
+		EnableRequestValidation: true,
+	})
+	require.Nil(t, err)
+	handler := middleware(healthHandler)
+	responseRecorder := httptest.NewRecorder()
+
+	request := httptest.NewRequest(
+		"POST", "/implemented/1",
+		io.NopCloser(bytes.NewBuffer([]byte("{\"description\":\"test description\"}"))),
+	)
+	request.Header.Add("X-Api-Key", "valid-api-key")
+	handler.ServeHTTP(responseRecorder, request)
+
+	// There's a body but no Content-Type, which doesn't match any of the content types the request body supports, so it should be a 415
+	assert.Equal(t, 415, responseRecorder.Code)
 }
 
 func TestCustomXMLDecoder(t *testing.T) {
@@ -724,3 +806,1245 @@ func TestCustomXMLDecoder(t *testing.T) {
 	require.Nil(t, err)
 	assert.Equal(t, "{\"description\":\"test description\"}", string(respBody))
 }
+
+func TestStreamingContentType(t *testing.T) {
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+	middleware, err := GetMiddleware(&Options{
+		StreamingContentTypes:  []string{"text/event-stream"},
+		MaxStreamedBodyLogSize: 16,
+		MaxLogAge:              time.Nanosecond,
+		LogBatchCallback: func(logs [][]byte) {
+			require.Equal(t, 1, len(logs))
+			logEntry, err := logging.UnmarshalLogEntry(logs[0])
+			require.Nil(t, err)
+			assert.Equal(t, "data: message 1\n", logEntry.Response.Body)
+			assert.Equal(t, int64(200), logEntry.Response.StatusCode)
+			assert.Equal(t, []string{"text/event-stream"}, logEntry.Response.Headers["Content-Type"])
+			wg.Done()
+		},
+	})
+	require.Nil(t, err)
+	responseRecorder := httptest.NewRecorder()
+	handler := middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Content-Type", "text/event-stream")
+		w.WriteHeader(200)
+		w.Write([]byte("data: message 1\n\n"))
+
+		// The first message should have reached the client before the handler has returned
+		assert.Equal(t, "data: message 1\n\n", responseRecorder.Body.String())
+
+		w.Write([]byte("data: message 2\n\n"))
+	}))
+
+	request := httptest.NewRequest("GET", "/events", nil)
+	handler.ServeHTTP(responseRecorder, request)
+
+	assert.Equal(t, 200, responseRecorder.Code)
+	assert.Equal(t, "text/event-stream", responseRecorder.Header().Get("Content-Type"))
+	assert.Equal(t, "data: message 1\n\ndata: message 2\n\n", responseRecorder.Body.String())
+
+	// Wait for the log callback to have been called & run its assertions
+	wg.Wait()
+}
+
+func TestStreamingRouteSkipsResponseValidation(t *testing.T) {
+	middleware, err := GetMiddleware(&Options{
+		OpenapiSpecPath:          "./test-spec.yaml",
+		AuthCallbacks:            authCallbacks,
+		EnableResponseValidation: true,
+		StreamingRoutes:          []string{"/implemented/{testparam}"},
+	})
+	require.Nil(t, err)
+	handler := middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Content-Type", "application/json")
+		w.WriteHeader(200)
+		w.Write([]byte("{\"description\":\"another test description\"}"))
+	}))
+	responseRecorder := httptest.NewRecorder()
+
+	request := httptest.NewRequest(
+		"POST", "/implemented/1",
+		io.NopCloser(bytes.NewBuffer([]byte("{\"description\":\"test description\"}"))),
+	)
+	request.Header.Add("Content-Type", "application/json")
+	request.Header.Add("X-Api-Key", "valid-api-key")
+	handler.ServeHTTP(responseRecorder, request)
+
+	assert.Equal(t, 200, responseRecorder.Code)
+
+	respBody, err := io.ReadAll(responseRecorder.Body)
+	require.Nil(t, err)
+	assert.Equal(t, "{\"description\":\"another test description\"}", string(respBody))
+}
+
+// hijackableResponseRecorder is a httptest.ResponseRecorder which also implements http.Hijacker, but not http.Flusher
+type hijackableResponseRecorder struct {
+	recorder *httptest.ResponseRecorder
+	hijacked bool
+}
+
+func (r *hijackableResponseRecorder) Header() http.Header         { return r.recorder.Header() }
+func (r *hijackableResponseRecorder) Write(b []byte) (int, error) { return r.recorder.Write(b) }
+func (r *hijackableResponseRecorder) WriteHeader(statusCode int)  { r.recorder.WriteHeader(statusCode) }
+
+func (r *hijackableResponseRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	r.hijacked = true
+	serverConn, clientConn := net.Pipe()
+	clientConn.Close()
+	return serverConn, bufio.NewReadWriter(bufio.NewReader(serverConn), bufio.NewWriter(serverConn)), nil
+}
+
+func TestFlusherIsPreserved(t *testing.T) {
+	middleware, err := GetMiddleware(&Options{
+		StreamingContentTypes: []string{"text/event-stream"},
+	})
+	require.Nil(t, err)
+	responseRecorder := httptest.NewRecorder()
+	handler := middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Content-Type", "text/event-stream")
+		w.Write([]byte("data: message 1\n\n"))
+
+		flusher, isFlusher := w.(http.Flusher)
+		require.True(t, isFlusher)
+		flusher.Flush()
+		assert.True(t, responseRecorder.Flushed)
+
+		// httptest.ResponseRecorder doesn't implement http.Hijacker, so neither should the writer we're given
+		_, isHijacker := w.(http.Hijacker)
+		assert.False(t, isHijacker)
+	}))
+
+	request := httptest.NewRequest("GET", "/events", nil)
+	handler.ServeHTTP(responseRecorder, request)
+
+	assert.Equal(t, 200, responseRecorder.Code)
+	assert.Equal(t, "data: message 1\n\n", responseRecorder.Body.String())
+}
+
+func TestStreamedHeadersChangedAfterWriteHeaderAreIgnored(t *testing.T) {
+	logEntries := make(chan logging.LogEntry, 1)
+	middleware, err := GetMiddleware(&Options{
+		MaxLogAge:             time.Nanosecond,
+		StreamingContentTypes: []string{"text/plain"},
+		LogBatchCallback: func(logs [][]byte) {
+			for _, log := range logs {
+				logEntry, err := logging.UnmarshalLogEntry(log)
+				require.Nil(t, err)
+				logEntries <- logEntry
+			}
+		},
+	})
+	require.Nil(t, err)
+	handler := middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("X-Before", "before")
+		w.WriteHeader(201)
+		w.Header().Set("X-After", "after")
+		w.Write([]byte("test body"))
+	}))
+	responseRecorder := httptest.NewRecorder()
+
+	handler.ServeHTTP(responseRecorder, httptest.NewRequest("GET", "/health", nil))
+
+	// As with net/http, headers set after a streamed response's headers have been sent shouldn't be sent or logged
+	response := responseRecorder.Result()
+	assert.Equal(t, 201, response.StatusCode)
+	assert.Equal(t, "before", response.Header.Get("X-Before"))
+	assert.Empty(t, response.Header.Get("X-After"))
+
+	logEntry := <-logEntries
+	assert.Equal(t, []string{"before"}, logEntry.Response.Headers["X-Before"])
+	assert.NotContains(t, logEntry.Response.Headers, "X-After")
+}
+
+func TestBufferedHeadersChangedAfterWriteHeaderAreSent(t *testing.T) {
+	logEntries := make(chan logging.LogEntry, 1)
+	middleware, err := GetMiddleware(&Options{
+		MaxLogAge: time.Nanosecond,
+		LogBatchCallback: func(logs [][]byte) {
+			for _, log := range logs {
+				logEntry, err := logging.UnmarshalLogEntry(log)
+				require.Nil(t, err)
+				logEntries <- logEntry
+			}
+		},
+	})
+	require.Nil(t, err)
+	handler := middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(201)
+		w.Header().Set("X-After", "after")
+		w.Write([]byte("test body"))
+	}))
+	responseRecorder := httptest.NewRecorder()
+
+	handler.ServeHTTP(responseRecorder, httptest.NewRequest("GET", "/health", nil))
+
+	// Buffered responses aren't sent until the handler returns, so headers set after WriteHeader should still be sent & logged
+	response := responseRecorder.Result()
+	assert.Equal(t, 201, response.StatusCode)
+	assert.Equal(t, "after", response.Header.Get("X-After"))
+
+	logEntry := <-logEntries
+	assert.Equal(t, []string{"after"}, logEntry.Response.Headers["X-After"])
+}
+
+func TestHijackedConnectionIsLogged(t *testing.T) {
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+	middleware, err := GetMiddleware(&Options{
+		MaxLogAge: time.Nanosecond,
+		LogBatchCallback: func(logs [][]byte) {
+			require.Equal(t, 1, len(logs))
+			logEntry, err := logging.UnmarshalLogEntry(logs[0])
+			require.Nil(t, err)
+			assert.True(t, logEntry.Response.Hijacked)
+			assert.Equal(t, int64(0), logEntry.Response.StatusCode)
+			wg.Done()
+		},
+	})
+	require.Nil(t, err)
+	handler := middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, isFlusher := w.(http.Flusher)
+		assert.False(t, isFlusher)
+
+		hijacker, isHijacker := w.(http.Hijacker)
+		require.True(t, isHijacker)
+		conn, _, err := hijacker.Hijack()
+		require.Nil(t, err)
+		conn.Close()
+	}))
+	responseRecorder := &hijackableResponseRecorder{recorder: httptest.NewRecorder()}
+
+	request := httptest.NewRequest("GET", "/websocket", nil)
+	handler.ServeHTTP(responseRecorder, request)
+
+	assert.True(t, responseRecorder.hijacked)
+	assert.False(t, responseRecorder.recorder.Flushed)
+	assert.Empty(t, responseRecorder.recorder.Body.Bytes())
+	assert.Empty(t, responseRecorder.recorder.Header())
+
+	// Wait for the log callback to have been called & run its assertions
+	wg.Wait()
+}
+
+func TestMiddlewareCloseSendsPendingLogs(t *testing.T) {
+	batches := make(chan [][]byte, 1)
+	middleware, err := NewMiddleware(&Options{
+		MaxLogAge: time.Minute,
+		LogBatchCallback: func(logs [][]byte) {
+			batches <- logs
+		},
+	})
+	require.Nil(t, err)
+	handler := middleware.Handler(healthHandler)
+	responseRecorder := httptest.NewRecorder()
+
+	request := httptest.NewRequest("GET", "/health", nil)
+	handler.ServeHTTP(responseRecorder, request)
+
+	assert.Equal(t, 200, responseRecorder.Code)
+
+	// The log entry won't be old enough to be sent for another minute, so it should only be sent when we close the middleware
+	assert.Equal(t, 0, len(batches))
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	require.Nil(t, middleware.Close(ctx))
+	require.Equal(t, 1, len(batches))
+
+	logs := <-batches
+	require.Equal(t, 1, len(logs))
+	logEntry, err := logging.UnmarshalLogEntry(logs[0])
+	require.Nil(t, err)
+	assert.Equal(t, "/health", logEntry.Request.Resource)
+	assert.Equal(t, uint64(1), middleware.LoggerStats().BatchesCreated)
+}
+
+func TestLogSinksWithLogBatchCallback(t *testing.T) {
+	var apiRequests int32
+	logsAPI := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&apiRequests, 1)
+	}))
+	defer logsAPI.Close()
+
+	batches := make(chan [][]byte, 1)
+	sinkBuffer := &bytes.Buffer{}
+	middleware, err := NewMiddleware(&Options{
+		LogsApiUrl: logsAPI.URL,
+		LogBatchCallback: func(logs [][]byte) {
+			batches <- logs
+		},
+		LogSinks: []logging.Sink{logging.NewWriterSink(sinkBuffer)},
+	})
+	require.Nil(t, err)
+	handler := middleware.Handler(healthHandler)
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/health", nil))
+	require.Nil(t, middleware.Close(context.Background()))
+
+	// The batch should go to the LogBatchCallback in place of the Firetail logging API, as well as the sink
+	require.Equal(t, 1, len(batches))
+	logs := <-batches
+	require.Equal(t, 1, len(logs))
+	assert.Equal(t, string(logs[0])+"\n", sinkBuffer.String())
+	assert.Equal(t, int32(0), atomic.LoadInt32(&apiRequests))
+}
+
+func TestTracingCreatesSpansAndLogsTraceIDs(t *testing.T) {
+	spanRecorder := tracetest.NewSpanRecorder()
+	batches := make(chan [][]byte, 1)
+	middleware, err := NewMiddleware(&Options{
+		OpenapiSpecPath:          "./test-spec.yaml",
+		AuthCallbacks:            authCallbacks,
+		EnableRequestValidation:  true,
+		EnableResponseValidation: true,
+		TracerProvider:           sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(spanRecorder)),
+		LogBatchCallback: func(logs [][]byte) {
+			batches <- logs
+		},
+	})
+	require.Nil(t, err)
+	handler := middleware.Handler(healthHandler)
+	responseRecorder := httptest.NewRecorder()
+
+	request := httptest.NewRequest(
+		"POST", "/implemented/1",
+		io.NopCloser(bytes.NewBuffer([]byte("{\"description\":\"test description\"}"))),
+	)
+	request.Header.Add("Content-Type", "application/json")
+	request.Header.Add("X-Api-Key", "valid-api-key")
+	handler.ServeHTTP(responseRecorder, request)
+
+	assert.Equal(t, 200, responseRecorder.Code)
+
+	spans := spanRecorder.Ended()
+	spanNames := []string{}
+	for _, span := range spans {
+		spanNames = append(spanNames, span.Name())
+	}
+	require.Equal(t, []string{"route lookup", "request validation", "handler", "response validation", "POST /implemented/{testparam}"}, spanNames)
+	serverSpan := spans[len(spans)-1]
+	assert.Equal(t, trace.SpanKindServer, serverSpan.SpanKind())
+	for _, childSpan := range spans[:len(spans)-1] {
+		assert.Equal(t, serverSpan.SpanContext().SpanID(), childSpan.Parent().SpanID())
+	}
+
+	require.Nil(t, middleware.Close(context.Background()))
+	require.Equal(t, 1, len(batches))
+	logs := <-batches
+	require.Equal(t, 1, len(logs))
+	logEntry, err := logging.UnmarshalLogEntry(logs[0])
+	require.Nil(t, err)
+	assert.Equal(t, serverSpan.SpanContext().TraceID().String(), logEntry.TraceID)
+	assert.Equal(t, serverSpan.SpanContext().SpanID().String(), logEntry.SpanID)
+}
+
+func TestPropagatedTraceIDLoggedWithoutTracerProvider(t *testing.T) {
+	batches := make(chan [][]byte, 1)
+	middleware, err := NewMiddleware(&Options{
+		OpenapiSpecPath: "./test-spec.yaml",
+		TracePropagator: propagation.TraceContext{},
+		LogBatchCallback: func(logs [][]byte) {
+			batches <- logs
+		},
+	})
+	require.Nil(t, err)
+	handler := middleware.Handler(healthHandler)
+	responseRecorder := httptest.NewRecorder()
+
+	request := httptest.NewRequest("GET", "/health", nil)
+	request.Header.Add("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	handler.ServeHTTP(responseRecorder, request)
+
+	require.Nil(t, middleware.Close(context.Background()))
+	require.Equal(t, 1, len(batches))
+	logs := <-batches
+	require.Equal(t, 1, len(logs))
+	logEntry, err := logging.UnmarshalLogEntry(logs[0])
+	require.Nil(t, err)
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", logEntry.TraceID)
+	assert.Empty(t, logEntry.SpanID)
+}
+
+func TestTracingRecordsValidationFailures(t *testing.T) {
+	spanRecorder := tracetest.NewSpanRecorder()
+	middleware, err := GetMiddleware(&Options{
+		OpenapiSpecPath:         "./test-spec.yaml",
+		AuthCallbacks:           authCallbacks,
+		EnableRequestValidation: true,
+		TracerProvider:          sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(spanRecorder)),
+	})
+	require.Nil(t, err)
+	handler := middleware(healthHandler)
+	responseRecorder := httptest.NewRecorder()
+
+	request := httptest.NewRequest(
+		"POST", "/implemented/invalid-path-param",
+		io.NopCloser(bytes.NewBuffer([]byte("{\"description\":\"test description\"}"))),
+	)
+	request.Header.Add("Content-Type", "application/json")
+	request.Header.Add("X-Api-Key", "valid-api-key")
+	handler.ServeHTTP(responseRecorder, request)
+
+	assert.Equal(t, 400, responseRecorder.Code)
+
+	spans := spanRecorder.Ended()
+	require.Len(t, spans, 3)
+	requestValidationSpan := spans[1]
+	assert.Equal(t, "request validation", requestValidationSpan.Name())
+	assert.Equal(t, codes.Error, requestValidationSpan.Status().Code)
+	require.Len(t, requestValidationSpan.Events(), 1)
+	event := requestValidationSpan.Events()[0]
+	assert.Equal(t, "firetail.error", event.Name)
+	assert.Contains(t, event.Attributes, attribute.String("firetail.error.type", "ErrorRequestPathParamsInvalid"))
+	assert.Contains(t, event.Attributes, attribute.Int("firetail.error.status_code", 400))
+
+	// 4xx responses shouldn't mark the server span as an error, but the failure should still be recorded on it
+	serverSpan := spans[2]
+	assert.Equal(t, codes.Unset, serverSpan.Status().Code)
+	require.Len(t, serverSpan.Events(), 1)
+	assert.Contains(t, serverSpan.Attributes(), attribute.Int("http.response.status_code", 400))
+}
+
+func TestMetricsAreRegisteredAndRecorded(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	middleware, err := NewMiddleware(&Options{
+		OpenapiSpecPath:         "./test-spec.yaml",
+		AuthCallbacks:           authCallbacks,
+		EnableRequestValidation: true,
+		MetricsRegisterer:       registry,
+		LogBatchCallback:        func(logs [][]byte) {},
+	})
+	require.Nil(t, err)
+	defer middleware.Close(context.Background())
+	handler := middleware.Handler(healthHandler)
+
+	for _, path := range []string{"/implemented/1", "/implemented/invalid-path-param", "/not-implemented"} {
+		request := httptest.NewRequest(
+			"POST", path,
+			io.NopCloser(bytes.NewBuffer([]byte("{\"description\":\"test description\"}"))),
+		)
+		request.Header.Add("Content-Type", "application/json")
+		request.Header.Add("X-Api-Key", "valid-api-key")
+		handler.ServeHTTP(httptest.NewRecorder(), request)
+	}
+
+	assert.Equal(t, float64(1), promtestutil.ToFloat64(middleware.metrics.requests.WithLabelValues("/implemented/{testparam}", "POST", "200", "")))
+	assert.Equal(t, float64(1), promtestutil.ToFloat64(middleware.metrics.requests.WithLabelValues("/implemented/{testparam}", "POST", "400", "ErrorRequestPathParamsInvalid")))
+	assert.Equal(t, float64(1), promtestutil.ToFloat64(middleware.metrics.requests.WithLabelValues("", "POST", "404", "ErrorRouteNotFound")))
+
+	// Non-standard methods shouldn't each get their own series
+	for _, method := range []string{"FOO", "BAR"} {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(method, "/not-implemented", nil))
+	}
+	assert.Equal(t, float64(2), promtestutil.ToFloat64(middleware.metrics.requests.WithLabelValues("", "_OTHER", "404", "ErrorRouteNotFound")))
+	assert.Equal(t, 1, promtestutil.CollectAndCount(middleware.metrics.handlerDuration))
+	assert.Equal(t, 1, promtestutil.CollectAndCount(middleware.metrics.validationDuration))
+
+	require.Nil(t, middleware.Flush(context.Background()))
+	assert.Nil(t, promtestutil.GatherAndCompare(registry, strings.NewReader(`
+# HELP firetail_logger_enqueued_entries_total The number of log entries which have been added to the firetail logger's queue
+# TYPE firetail_logger_enqueued_entries_total counter
+firetail_logger_enqueued_entries_total 5
+# HELP firetail_logger_queue_length The number of log entries waiting in the firetail logger's queue
+# TYPE firetail_logger_queue_length gauge
+firetail_logger_queue_length 0
+`), "firetail_logger_enqueued_entries_total", "firetail_logger_queue_length"))
+}
+
+func TestMetricsCannotBeRegisteredTwice(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	_, err := NewMiddleware(&Options{MetricsRegisterer: registry})
+	require.Nil(t, err)
+	_, err = NewMiddleware(&Options{MetricsRegisterer: registry})
+	assert.IsType(t, ErrorInvalidConfiguration{}, err)
+}
+
+func TestMonitorOnlyForwardsInvalidRequests(t *testing.T) {
+	batches := make(chan [][]byte, 1)
+	middleware, err := NewMiddleware(&Options{
+		OpenapiSpecPath:         "./test-spec.yaml",
+		AuthCallbacks:           authCallbacks,
+		EnableRequestValidation: true,
+		MonitorOnly:             true,
+		LogBatchCallback: func(logs [][]byte) {
+			batches <- logs
+		},
+	})
+	require.Nil(t, err)
+	handler := middleware.Handler(healthHandler)
+	responseRecorder := httptest.NewRecorder()
+
+	request := httptest.NewRequest(
+		"POST", "/implemented/invalid-path-param",
+		io.NopCloser(bytes.NewBuffer([]byte("{\"description\":\"test description\"}"))),
+	)
+	request.Header.Add("Content-Type", "application/json")
+	request.Header.Add("X-Api-Key", "valid-api-key")
+	handler.ServeHTTP(responseRecorder, request)
+
+	// The request should have made it to the handler despite its invalid path param
+	assert.Equal(t, 200, responseRecorder.Code)
+	respBody, err := io.ReadAll(responseRecorder.Body)
+	require.Nil(t, err)
+	assert.Equal(t, "{\"description\":\"test description\"}", string(respBody))
+
+	require.Nil(t, middleware.Close(context.Background()))
+	require.Equal(t, 1, len(batches))
+	logs := <-batches
+	require.Equal(t, 1, len(logs))
+	logEntry, err := logging.UnmarshalLogEntry(logs[0])
+	require.Nil(t, err)
+	require.Len(t, logEntry.ValidationFindings, 1)
+	assert.Equal(t, "ErrorRequestPathParamsInvalid", logEntry.ValidationFindings[0].Type)
+	assert.False(t, logEntry.ValidationFindings[0].Blocked)
+}
+
+func TestMonitorOnlyBlocksAuthFailures(t *testing.T) {
+	jwtAuthCallback, err := NewJWTAuthCallback(JWTOptions{Keys: map[string]interface{}{"test-key": []byte("test-secret")}})
+	require.Nil(t, err)
+	testCases := map[string]struct {
+		options      Options
+		expectedCode int
+	}{
+		"auth failures blocked": {
+			Options{MonitorOnly: true, AuthCallbacks: map[string]openapi3filter.AuthenticationFunc{"BearerAuth": jwtAuthCallback}},
+			401,
+		},
+		"auth failures blocked for monitor-only operation": {
+			Options{
+				MonitorOnlyOperations: []string{"GET /bearer-auth"},
+				AuthCallbacks:         map[string]openapi3filter.AuthenticationFunc{"BearerAuth": jwtAuthCallback},
+			},
+			401,
+		},
+		"auth failures monitored with MonitorOnlyAuth": {
+			Options{
+				MonitorOnly:     true,
+				MonitorOnlyAuth: true,
+				AuthCallbacks:   map[string]openapi3filter.AuthenticationFunc{"BearerAuth": jwtAuthCallback},
+			},
+			200,
+		},
+		"schemes without auth callbacks not enforced": {
+			Options{MonitorOnly: true},
+			200,
+		},
+	}
+	for name, testCase := range testCases {
+		t.Run(name, func(t *testing.T) {
+			options := testCase.options
+			options.OpenapiSpecPath = "./test-spec.yaml"
+			options.EnableRequestValidation = true
+			middleware, err := GetMiddleware(&options)
+			require.Nil(t, err)
+			handler := middleware(healthHandler)
+			responseRecorder := httptest.NewRecorder()
+
+			handler.ServeHTTP(responseRecorder, httptest.NewRequest("GET", "/bearer-auth", nil))
+			assert.Equal(t, testCase.expectedCode, responseRecorder.Code)
+		})
+	}
+}
+
+func TestMonitorOnlyOperationReturnsOriginalResponse(t *testing.T) {
+	batches := make(chan [][]byte, 1)
+	middleware, err := NewMiddleware(&Options{
+		OpenapiSpecPath:          "./test-spec.yaml",
+		AuthCallbacks:            authCallbacks,
+		EnableRequestValidation:  true,
+		EnableResponseValidation: true,
+		MonitorOnlyOperations:    []string{"POST /implemented/{testparam}"},
+		LogBatchCallback: func(logs [][]byte) {
+			batches <- logs
+		},
+	})
+	require.Nil(t, err)
+	handler := middleware.Handler(healthHandlerWithWrongResponseCode)
+	responseRecorder := httptest.NewRecorder()
+
+	request := httptest.NewRequest(
+		"POST", "/implemented/1",
+		io.NopCloser(bytes.NewBuffer([]byte("{\"description\":\"test description\"}"))),
+	)
+	request.Header.Add("Content-Type", "application/json")
+	request.Header.Add("X-Api-Key", "valid-api-key")
+	handler.ServeHTTP(responseRecorder, request)
+
+	// The response's status code isn't in the spec, but it should still be returned as the operation is monitor-only
+	assert.Equal(t, 201, responseRecorder.Code)
+	respBody, err := io.ReadAll(responseRecorder.Body)
+	require.Nil(t, err)
+	assert.Equal(t, "{\"description\":\"another test description\"}", string(respBody))
+
+	// Requests to other routes should still be blocked
+	responseRecorder = httptest.NewRecorder()
+	handler.ServeHTTP(responseRecorder, httptest.NewRequest("GET", "/not-implemented", nil))
+	assert.Equal(t, 404, responseRecorder.Code)
+
+	require.Nil(t, middleware.Close(context.Background()))
+	require.Equal(t, 1, len(batches))
+	logs := <-batches
+	require.Equal(t, 2, len(logs))
+	logEntry, err := logging.UnmarshalLogEntry(logs[0])
+	require.Nil(t, err)
+	require.Len(t, logEntry.ValidationFindings, 1)
+	assert.Equal(t, "ErrorResponseStatusCodeInvalid", logEntry.ValidationFindings[0].Type)
+	assert.False(t, logEntry.ValidationFindings[0].Blocked)
+	logEntry, err = logging.UnmarshalLogEntry(logs[1])
+	require.Nil(t, err)
+	require.Len(t, logEntry.ValidationFindings, 1)
+	assert.Equal(t, "ErrorRouteNotFound", logEntry.ValidationFindings[0].Type)
+	assert.True(t, logEntry.ValidationFindings[0].Blocked)
+}
+
+func TestLogEntryRecordsRouteAndFindings(t *testing.T) {
+	batches := make(chan [][]byte, 1)
+	middleware, err := NewMiddleware(&Options{
+		OpenapiSpecPath:         "./test-spec.yaml",
+		AuthCallbacks:           authCallbacks,
+		EnableRequestValidation: true,
+		LogBatchCallback: func(logs [][]byte) {
+			batches <- logs
+		},
+	})
+	require.Nil(t, err)
+	handler := middleware.Handler(healthHandler)
+	responseRecorder := httptest.NewRecorder()
+
+	request := httptest.NewRequest(
+		"POST", "/implemented/1",
+		io.NopCloser(bytes.NewBuffer([]byte("{\"description\":\"another test description\"}"))),
+	)
+	request.Header.Add("Content-Type", "application/json")
+	request.Header.Add("X-Api-Key", "valid-api-key")
+	handler.ServeHTTP(responseRecorder, request)
+	assert.Equal(t, 400, responseRecorder.Code)
+
+	require.Nil(t, middleware.Close(context.Background()))
+	require.Equal(t, 1, len(batches))
+	logs := <-batches
+	require.Equal(t, 1, len(logs))
+	logEntry, err := logging.UnmarshalLogEntry(logs[0])
+	require.Nil(t, err)
+
+	assert.Equal(t, logging.The120Alpha, logEntry.Version)
+	assert.Equal(t, "createImplemented", logEntry.Request.OperationID)
+	assert.Equal(t, "/implemented/{testparam}", logEntry.Request.Route)
+	assert.Equal(t, map[string]string{"testparam": "1"}, logEntry.Request.PathParams)
+
+	require.Len(t, logEntry.ValidationFindings, 1)
+	assert.Equal(t, "ErrorRequestBodyInvalid", logEntry.ValidationFindings[0].Type)
+	assert.Equal(t, logging.RequestBodyLocation, logEntry.ValidationFindings[0].Location)
+	assert.Equal(t, "/description", logEntry.ValidationFindings[0].Pointer)
+	assert.Equal(t, "enum", logEntry.ValidationFindings[0].Keyword)
+	assert.True(t, logEntry.ValidationFindings[0].Blocked)
+}
+
+func TestLogEntryPointsToInvalidParam(t *testing.T) {
+	batches := make(chan [][]byte, 1)
+	middleware, err := NewMiddleware(&Options{
+		OpenapiSpecPath:         "./test-spec.yaml",
+		AuthCallbacks:           authCallbacks,
+		EnableRequestValidation: true,
+		LogBatchCallback: func(logs [][]byte) {
+			batches <- logs
+		},
+	})
+	require.Nil(t, err)
+	handler := middleware.Handler(healthHandler)
+	responseRecorder := httptest.NewRecorder()
+
+	request := httptest.NewRequest(
+		"POST", "/implemented/invalid-path-param",
+		io.NopCloser(bytes.NewBuffer([]byte("{\"description\":\"test description\"}"))),
+	)
+	request.Header.Add("Content-Type", "application/json")
+	request.Header.Add("X-Api-Key", "valid-api-key")
+	handler.ServeHTTP(responseRecorder, request)
+	assert.Equal(t, 400, responseRecorder.Code)
+
+	require.Nil(t, middleware.Close(context.Background()))
+	require.Equal(t, 1, len(batches))
+	logs := <-batches
+	require.Equal(t, 1, len(logs))
+	logEntry, err := logging.UnmarshalLogEntry(logs[0])
+	require.Nil(t, err)
+	require.Len(t, logEntry.ValidationFindings, 1)
+	assert.Equal(t, logging.RequestPathLocation, logEntry.ValidationFindings[0].Location)
+	assert.Equal(t, "/testparam", logEntry.ValidationFindings[0].Pointer)
+}
+
+func TestGetJSONPointerEscapesTokens(t *testing.T) {
+	assert.Equal(t, "", getJSONPointer(nil))
+	assert.Equal(t, "/pets/0/a~1b/c~0d", getJSONPointer([]string{"pets", "0", "a/b", "c~d"}))
+}
+
+func TestReportAllErrors(t *testing.T) {
+	batches := make(chan [][]byte, 1)
+	middleware, err := NewMiddleware(&Options{
+		OpenapiSpecPath:         "./test-spec.yaml",
+		AuthCallbacks:           authCallbacks,
+		EnableRequestValidation: true,
+		ReportAllErrors:         true,
+		LogBatchCallback: func(logs [][]byte) {
+			batches <- logs
+		},
+	})
+	require.Nil(t, err)
+	handler := middleware.Handler(healthHandler)
+	responseRecorder := httptest.NewRecorder()
+
+	request := httptest.NewRequest(
+		"POST", "/implemented/1?test-param=invalid",
+		io.NopCloser(bytes.NewBuffer([]byte("{\"description\":\"another test description\"}"))),
+	)
+	request.Header.Add("Content-Type", "application/json")
+	request.Header.Add("X-Api-Key", "valid-api-key")
+	handler.ServeHTTP(responseRecorder, request)
+
+	assert.Equal(t, 400, responseRecorder.Code)
+
+	respBody, err := io.ReadAll(responseRecorder.Body)
+	require.Nil(t, err)
+	var errorResponse struct {
+		Status int               `json:"status"`
+		Title  string            `json:"title"`
+		Errors []ValidationIssue `json:"errors"`
+	}
+	require.Nil(t, json.Unmarshal(respBody, &errorResponse))
+	assert.Equal(t, 400, errorResponse.Status)
+	assert.Equal(t, "something's wrong with your request", errorResponse.Title)
+	require.Len(t, errorResponse.Errors, 2)
+	assert.Equal(t, logging.RequestQueryLocation, errorResponse.Errors[0].Location)
+	assert.Equal(t, "/test-param", errorResponse.Errors[0].Pointer)
+	assert.Equal(t, "something's wrong with your query parameters", errorResponse.Errors[0].Detail)
+	assert.Equal(t, logging.RequestBodyLocation, errorResponse.Errors[1].Location)
+	assert.Equal(t, "/description", errorResponse.Errors[1].Pointer)
+	assert.Equal(t, "enum", errorResponse.Errors[1].Keyword)
+	assert.NotEmpty(t, errorResponse.Errors[1].Detail)
+
+	// Each of the errors should be logged with its own type
+	require.Nil(t, middleware.Close(context.Background()))
+	require.Equal(t, 1, len(batches))
+	logs := <-batches
+	require.Equal(t, 1, len(logs))
+	logEntry, err := logging.UnmarshalLogEntry(logs[0])
+	require.Nil(t, err)
+	require.Len(t, logEntry.ValidationFindings, 2)
+	assert.Equal(t, "ErrorRequestQueryParamsInvalid", logEntry.ValidationFindings[0].Type)
+	assert.Equal(t, "ErrorRequestBodyInvalid", logEntry.ValidationFindings[1].Type)
+}
+
+func TestProblemTypeInstanceAndExtensions(t *testing.T) {
+	middleware, err := GetMiddleware(&Options{
+		OpenapiSpecPath:         "./test-spec.yaml",
+		EnableRequestValidation: true,
+		ErrTypeBaseURI:          "https://example.com/problems/",
+		ErrInstance: func(r *http.Request) string {
+			return "urn:request:" + r.Header.Get("X-Request-Id")
+		},
+		ErrExtensions: func(errAtRequest ErrorAtRequest, r *http.Request) map[string]interface{} {
+			return map[string]interface{}{"requestId": r.Header.Get("X-Request-Id"), "status": 200}
+		},
+	})
+	require.Nil(t, err)
+	handler := middleware(healthHandler)
+	responseRecorder := httptest.NewRecorder()
+
+	request := httptest.NewRequest("GET", "/not-implemented", nil)
+	request.Header.Add("X-Request-Id", "abc123")
+	handler.ServeHTTP(responseRecorder, request)
+
+	assert.Equal(t, 404, responseRecorder.Code)
+	assert.Equal(t, "application/problem+json", responseRecorder.Header().Get("Content-Type"))
+	respBody, err := io.ReadAll(responseRecorder.Body)
+	require.Nil(t, err)
+	// The status extension shouldn't replace the standard status member
+	assert.Equal(t, "{\"type\":\"https://example.com/problems/route-not-found\",\"title\":\"the resource \\\"/not-implemented\\\" could not be found\",\"status\":404,\"instance\":\"urn:request:abc123\",\"requestId\":\"abc123\"}", string(respBody))
+}
+
+func TestProblemNegotiatesPlainJSON(t *testing.T) {
+	middleware, err := GetMiddleware(&Options{
+		OpenapiSpecPath:         "./test-spec.yaml",
+		EnableRequestValidation: true,
+	})
+	require.Nil(t, err)
+	handler := middleware(healthHandler)
+	responseRecorder := httptest.NewRecorder()
+
+	request := httptest.NewRequest("GET", "/not-implemented", nil)
+	request.Header.Add("Accept", "application/json")
+	handler.ServeHTTP(responseRecorder, request)
+
+	assert.Equal(t, 404, responseRecorder.Code)
+	assert.Equal(t, "application/json", responseRecorder.Header().Get("Content-Type"))
+	assert.Equal(t, "Accept", responseRecorder.Header().Get("Vary"))
+	respBody, err := io.ReadAll(responseRecorder.Body)
+	require.Nil(t, err)
+	assert.Equal(t, "{\"type\":\"about:blank\",\"title\":\"the resource \\\"/not-implemented\\\" could not be found\",\"status\":404,\"instance\":\"/not-implemented\"}", string(respBody))
+}
+
+func TestProblemNegotiatesXML(t *testing.T) {
+	middleware, err := GetMiddleware(&Options{
+		OpenapiSpecPath:         "./test-spec.yaml",
+		EnableRequestValidation: true,
+		ErrExtensions: func(errAtRequest ErrorAtRequest, r *http.Request) map[string]interface{} {
+			return map[string]interface{}{"requestId": "abc123"}
+		},
+	})
+	require.Nil(t, err)
+	handler := middleware(healthHandler)
+	responseRecorder := httptest.NewRecorder()
+
+	request := httptest.NewRequest("GET", "/not-implemented", nil)
+	request.Header.Add("Accept", "application/json;q=0.5, application/problem+xml")
+	handler.ServeHTTP(responseRecorder, request)
+
+	assert.Equal(t, 404, responseRecorder.Code)
+	assert.Equal(t, "application/problem+xml", responseRecorder.Header().Get("Content-Type"))
+	respBody, err := io.ReadAll(responseRecorder.Body)
+	require.Nil(t, err)
+	assert.Equal(t, xml.Header+"<problem xmlns=\"urn:ietf:rfc:7807\"><type>about:blank</type><title>the resource &#34;/not-implemented&#34; could not be found</title><status>404</status><instance>/not-implemented</instance><requestId>abc123</requestId></problem>", string(respBody))
+}
+
+func TestProblemXMLWithPartiallyEncodableExtension(t *testing.T) {
+	middleware, err := GetMiddleware(&Options{
+		OpenapiSpecPath:         "./test-spec.yaml",
+		EnableRequestValidation: true,
+		ErrExtensions: func(errAtRequest ErrorAtRequest, r *http.Request) map[string]interface{} {
+			// The encoder can write the first field of this struct before it fails on the map
+			return map[string]interface{}{"summary": struct {
+				Name   string
+				Counts map[string]int
+			}{"test", map[string]int{"a": 1}}}
+		},
+	})
+	require.Nil(t, err)
+	handler := middleware(healthHandler)
+	responseRecorder := httptest.NewRecorder()
+
+	request := httptest.NewRequest("GET", "/not-implemented", nil)
+	request.Header.Add("Accept", "application/problem+xml")
+	handler.ServeHTTP(responseRecorder, request)
+
+	assert.Equal(t, 404, responseRecorder.Code)
+	respBody, err := io.ReadAll(responseRecorder.Body)
+	require.Nil(t, err)
+	assert.Contains(t, string(respBody), "<summary>{test map[a:1]}</summary></problem>")
+	var problem struct {
+		Summary string `xml:"summary"`
+	}
+	assert.Nil(t, xml.Unmarshal(respBody, &problem))
+	assert.Equal(t, "{test map[a:1]}", problem.Summary)
+}
+
+func TestProblemMarshalFailure(t *testing.T) {
+	middleware, err := GetMiddleware(&Options{
+		OpenapiSpecPath:         "./test-spec.yaml",
+		EnableRequestValidation: true,
+		ErrExtensions: func(errAtRequest ErrorAtRequest, r *http.Request) map[string]interface{} {
+			return map[string]interface{}{"unmarshallable": make(chan int)}
+		},
+	})
+	require.Nil(t, err)
+	handler := middleware(healthHandler)
+	responseRecorder := httptest.NewRecorder()
+
+	handler.ServeHTTP(responseRecorder, httptest.NewRequest("GET", "/not-implemented", nil))
+
+	assert.Equal(t, 500, responseRecorder.Code)
+	respBody, err := io.ReadAll(responseRecorder.Body)
+	require.Nil(t, err)
+	assert.Equal(t, "{\"type\":\"about:blank\",\"title\":\"internal server error\",\"status\":500}", string(respBody))
+}
+
+func TestNegotiateMediaType(t *testing.T) {
+	offers := []string{"application/problem+json", "application/json", "application/problem+xml", "application/xml"}
+	assert.Equal(t, "application/problem+json", negotiateMediaType("", offers))
+	assert.Equal(t, "application/problem+json", negotiateMediaType("*/*", offers))
+	assert.Equal(t, "application/problem+json", negotiateMediaType("application/*", offers))
+	assert.Equal(t, "application/xml", negotiateMediaType("application/xml", offers))
+	assert.Equal(t, "application/json", negotiateMediaType("application/*;q=0.1, application/json", offers))
+	assert.Equal(t, "application/problem+xml", negotiateMediaType("application/*, application/problem+json;q=0, application/json;q=0", offers))
+	assert.Equal(t, "", negotiateMediaType("text/html", offers))
+	assert.Equal(t, "", negotiateMediaType("application/json;q=0", []string{"application/json"}))
+
+	// An Accept header in which every media range is malformed should be treated as if it were absent
+	assert.Equal(t, "application/problem+json", negotiateMediaType("text, application/json;q=2, ;;", offers))
+	// ...but malformed media ranges alongside valid ones are just skipped
+	assert.Equal(t, "", negotiateMediaType("text, text/html", offers))
+}
+
+func TestValidResponseHeaders(t *testing.T) {
+	middleware, err := GetMiddleware(&Options{
+		OpenapiSpecPath:          "./test-spec.yaml",
+		EnableResponseValidation: true,
+	})
+	require.Nil(t, err)
+	handler := middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Rate-Limit", "10")
+		w.Header().Set("X-Mode", "fast")
+		w.WriteHeader(200)
+	}))
+	responseRecorder := httptest.NewRecorder()
+
+	handler.ServeHTTP(responseRecorder, httptest.NewRequest("GET", "/response-headers", nil))
+
+	assert.Equal(t, 200, responseRecorder.Code)
+	assert.Equal(t, "10", responseRecorder.Header().Get("X-Rate-Limit"))
+}
+
+func TestInvalidResponseHeaders(t *testing.T) {
+	var handledErr ErrorAtRequest
+	batches := make(chan [][]byte, 1)
+	middleware, err := NewMiddleware(&Options{
+		OpenapiSpecPath:          "./test-spec.yaml",
+		EnableResponseValidation: true,
+		ErrCallback: func(errAtRequest ErrorAtRequest, w http.ResponseWriter, r *http.Request) {
+			handledErr = errAtRequest
+			w.WriteHeader(errAtRequest.StatusCode())
+		},
+		LogBatchCallback: func(logs [][]byte) {
+			batches <- logs
+		},
+	})
+	require.Nil(t, err)
+	handler := middleware.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Mode", "medium")
+		w.WriteHeader(200)
+	}))
+	responseRecorder := httptest.NewRecorder()
+
+	handler.ServeHTTP(responseRecorder, httptest.NewRequest("GET", "/response-headers", nil))
+
+	assert.Equal(t, 500, responseRecorder.Code)
+	require.IsType(t, ErrorResponseHeadersInvalid{}, handledErr)
+	headerErrs := handledErr.(ErrorResponseHeadersInvalid).Headers
+	require.Len(t, headerErrs, 2)
+	assert.Equal(t, "X-Mode", headerErrs[0].Name)
+	assert.Equal(t, "doesn't match its schema", headerErrs[0].Reason)
+	assert.Equal(t, "X-Rate-Limit", headerErrs[1].Name)
+	assert.Equal(t, "is missing", headerErrs[1].Reason)
+	assert.Contains(t, handledErr.Error(), "the response's headers did not match your appspec: header \"X-Mode\" doesn't match its schema")
+
+	require.Nil(t, middleware.Close(context.Background()))
+	logs := <-batches
+	require.Equal(t, 1, len(logs))
+	logEntry, err := logging.UnmarshalLogEntry(logs[0])
+	require.Nil(t, err)
+	require.Len(t, logEntry.ValidationFindings, 2)
+	assert.Equal(t, logging.ResponseHeaderLocation, logEntry.ValidationFindings[0].Location)
+	assert.Equal(t, "/X-Mode", logEntry.ValidationFindings[0].Pointer)
+	assert.Equal(t, "enum", logEntry.ValidationFindings[0].Keyword)
+	assert.Equal(t, "/X-Rate-Limit", logEntry.ValidationFindings[1].Pointer)
+	assert.Equal(t, "header \"X-Rate-Limit\" is missing", logEntry.ValidationFindings[1].Message)
+}
+
+func TestDecodeHeaderValue(t *testing.T) {
+	integerSchema := openapi3.NewIntegerSchema()
+	value, err := decodeHeaderValue("42", integerSchema)
+	require.Nil(t, err)
+	assert.Equal(t, 42.0, value)
+	_, err = decodeHeaderValue("forty-two", integerSchema)
+	assert.NotNil(t, err)
+
+	value, err = decodeHeaderValue("1, 2,3", openapi3.NewArraySchema().WithItems(integerSchema))
+	require.Nil(t, err)
+	assert.Equal(t, []interface{}{1.0, 2.0, 3.0}, value)
+
+	value, err = decodeHeaderValue("enabled,true,name,test", openapi3.NewObjectSchema().WithProperty("enabled", openapi3.NewBoolSchema()))
+	require.Nil(t, err)
+	assert.Equal(t, map[string]interface{}{"enabled": true, "name": "test"}, value)
+	_, err = decodeHeaderValue("enabled", openapi3.NewObjectSchema())
+	assert.NotNil(t, err)
+}
+
+func TestInvalidResponseContentType(t *testing.T) {
+	middleware, err := GetMiddleware(&Options{
+		OpenapiSpecPath:          "./test-spec.yaml",
+		AuthCallbacks:            authCallbacks,
+		DebugErrs:                true,
+		EnableResponseValidation: true,
+	})
+	require.Nil(t, err)
+	handler := middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Content-Type", "text/html")
+		w.WriteHeader(200)
+		w.Write([]byte("<p>test description</p>"))
+	}))
+	responseRecorder := httptest.NewRecorder()
+
+	request := httptest.NewRequest(
+		"POST", "/implemented/1",
+		io.NopCloser(bytes.NewBuffer([]byte("{\"description\":\"test description\"}"))),
+	)
+	request.Header.Add("Content-Type", "application/json")
+	request.Header.Add("X-Api-Key", "valid-api-key")
+	handler.ServeHTTP(responseRecorder, request)
+
+	assert.Equal(t, 500, responseRecorder.Code)
+	respBody, err := io.ReadAll(responseRecorder.Body)
+	require.Nil(t, err)
+	assert.Equal(t, "{\"type\":\"about:blank\",\"title\":\"internal server error\",\"status\":500,\"detail\":\"the response's content type \\\"text/html\\\" is not one of those your appspec allows for a 200 response: \\\"application/json\\\"\",\"instance\":\"/implemented/1\"}", string(respBody))
+}
+
+func TestResponseContentTypeWithSuffix(t *testing.T) {
+	middleware, err := GetMiddleware(&Options{
+		OpenapiSpecPath:          "./test-spec.yaml",
+		AuthCallbacks:            authCallbacks,
+		EnableResponseValidation: true,
+	})
+	require.Nil(t, err)
+	handler := middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Content-Type", "application/vnd.test+json; charset=utf-8")
+		w.WriteHeader(200)
+		w.Write([]byte("{\"description\":\"test description\"}"))
+	}))
+	responseRecorder := httptest.NewRecorder()
+
+	request := httptest.NewRequest(
+		"POST", "/implemented/1",
+		io.NopCloser(bytes.NewBuffer([]byte("{\"description\":\"test description\"}"))),
+	)
+	request.Header.Add("Content-Type", "application/json")
+	request.Header.Add("X-Api-Key", "valid-api-key")
+	handler.ServeHTTP(responseRecorder, request)
+
+	// The response should be validated as JSON & returned with its original Content-Type
+	assert.Equal(t, 200, responseRecorder.Code)
+	assert.Equal(t, "application/vnd.test+json; charset=utf-8", responseRecorder.Header().Get("Content-Type"))
+}
+
+func TestMatchMediaType(t *testing.T) {
+	assert.Equal(t, mediaTypeMatch, matchMediaType("application/json", "application/json"))
+	assert.Equal(t, mediaTypeMatch, matchMediaType("application/json; charset=utf-8", "application/json"))
+	assert.Equal(t, mediaTypeMatch, matchMediaType("Application/JSON", "application/json"))
+	assert.Equal(t, mediaTypeMatch, matchMediaType("application/*", "application/xml"))
+	assert.Equal(t, mediaTypeMatch, matchMediaType("*/*", "text/html"))
+	assert.Equal(t, mediaTypeSuffixMatch, matchMediaType("application/json", "application/problem+json"))
+	assert.Equal(t, mediaTypeNoMatch, matchMediaType("application/json", "application/xml"))
+	assert.Equal(t, mediaTypeNoMatch, matchMediaType("application/json", "text/json"))
+	assert.Equal(t, mediaTypeNoMatch, matchMediaType("text/*", "application/json"))
+}
+
+func TestNotAcceptable(t *testing.T) {
+	middleware, err := GetMiddleware(&Options{
+		OpenapiSpecPath:         "./test-spec.yaml",
+		AuthCallbacks:           authCallbacks,
+		DebugErrs:               true,
+		EnableRequestValidation: true,
+		EnforceAcceptHeader:     true,
+	})
+	require.Nil(t, err)
+	handler := middleware(healthHandler)
+	responseRecorder := httptest.NewRecorder()
+
+	request := httptest.NewRequest(
+		"POST", "/implemented/1",
+		io.NopCloser(bytes.NewBuffer([]byte("{\"description\":\"test description\"}"))),
+	)
+	request.Header.Add("Content-Type", "application/json")
+	request.Header.Add("Accept", "text/html, application/json;q=0")
+	request.Header.Add("X-Api-Key", "valid-api-key")
+	handler.ServeHTTP(responseRecorder, request)
+
+	assert.Equal(t, 406, responseRecorder.Code)
+	respBody, err := io.ReadAll(responseRecorder.Body)
+	require.Nil(t, err)
+	assert.Equal(t, "{\"type\":\"about:blank\",\"title\":\"the resource \\\"/implemented/{testparam}\\\" can't respond with any of the content types you accept\",\"status\":406,\"detail\":\"the path for \\\"/implemented/{testparam}\\\" in your appspec doesn't have a response with any of the content types accepted by \\\"text/html, application/json;q=0\\\": \\\"application/json\\\"\",\"instance\":\"/implemented/1\"}", string(respBody))
+}
+
+func TestMalformedAcceptHeaderIsIgnored(t *testing.T) {
+	middleware, err := GetMiddleware(&Options{
+		OpenapiSpecPath:         "./test-spec.yaml",
+		AuthCallbacks:           authCallbacks,
+		EnableRequestValidation: true,
+		EnforceAcceptHeader:     true,
+	})
+	require.Nil(t, err)
+	handler := middleware(healthHandler)
+	responseRecorder := httptest.NewRecorder()
+
+	request := httptest.NewRequest(
+		"POST", "/implemented/1",
+		io.NopCloser(bytes.NewBuffer([]byte("{\"description\":\"test description\"}"))),
+	)
+	request.Header.Add("Content-Type", "application/json")
+	request.Header.Add("Accept", "not-a-media-type")
+	request.Header.Add("X-Api-Key", "valid-api-key")
+	handler.ServeHTTP(responseRecorder, request)
+
+	assert.Equal(t, 200, responseRecorder.Code)
+}
+
+func TestNegotiatedMediaType(t *testing.T) {
+	middleware, err := GetMiddleware(&Options{
+		OpenapiSpecPath:         "./test-spec.yaml",
+		AuthCallbacks:           authCallbacks,
+		EnableRequestValidation: true,
+		EnforceAcceptHeader:     true,
+	})
+	require.Nil(t, err)
+	var negotiatedMediaType string
+	var negotiated bool
+	handler := middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		negotiatedMediaType, negotiated = NegotiatedMediaType(r.Context())
+		healthHandler(w, r)
+	}))
+	responseRecorder := httptest.NewRecorder()
+
+	request := httptest.NewRequest(
+		"POST", "/implemented/1",
+		io.NopCloser(bytes.NewBuffer([]byte("{\"description\":\"test description\"}"))),
+	)
+	request.Header.Add("Content-Type", "application/json")
+	request.Header.Add("Accept", "text/html, application/*;q=0.5")
+	request.Header.Add("X-Api-Key", "valid-api-key")
+	handler.ServeHTTP(responseRecorder, request)
+
+	assert.Equal(t, 200, responseRecorder.Code)
+	assert.True(t, negotiated)
+	assert.Equal(t, "application/json", negotiatedMediaType)
+}
+
+func TestPrincipalRecordedInContextAndLogEntry(t *testing.T) {
+	batches := make(chan [][]byte, 1)
+	middleware, err := NewMiddleware(&Options{
+		OpenapiSpecPath: "./test-spec.yaml",
+		AuthCallbacks: map[string]openapi3filter.AuthenticationFunc{
+			"BearerAuth": func(ctx context.Context, ai *openapi3filter.AuthenticationInput) error {
+				SetPrincipal(ctx, Principal{
+					Subject:            "test-subject",
+					Tenant:             "test-tenant",
+					Scopes:             []string{"pets:read"},
+					SecuritySchemeName: ai.SecuritySchemeName,
+				})
+				return nil
+			},
+		},
+		EnableRequestValidation: true,
+		LogBatchCallback: func(logs [][]byte) {
+			batches <- logs
+		},
+	})
+	require.Nil(t, err)
+	var handlerPrincipal Principal
+	var handlerHasPrincipal bool
+	handler := middleware.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handlerPrincipal, handlerHasPrincipal = GetPrincipal(r.Context())
+		w.WriteHeader(200)
+	}))
+	responseRecorder := httptest.NewRecorder()
+
+	request := httptest.NewRequest("GET", "/bearer-auth", nil)
+	handler.ServeHTTP(responseRecorder, request)
+	assert.Equal(t, 200, responseRecorder.Code)
+
+	expectedPrincipal := Principal{
+		Subject:            "test-subject",
+		Tenant:             "test-tenant",
+		Scopes:             []string{"pets:read"},
+		SecuritySchemeName: "BearerAuth",
+	}
+	require.True(t, handlerHasPrincipal)
+	assert.Equal(t, expectedPrincipal, handlerPrincipal)
+
+	require.Nil(t, middleware.Close(context.Background()))
+	require.Equal(t, 1, len(batches))
+	logs := <-batches
+	require.Equal(t, 1, len(logs))
+	logEntry, err := logging.UnmarshalLogEntry(logs[0])
+	require.Nil(t, err)
+
+	require.NotNil(t, logEntry.Identity)
+	assert.Equal(t, logging.Identity{
+		Subject:        "test-subject",
+		Tenant:         "test-tenant",
+		Scopes:         []string{"pets:read"},
+		SecurityScheme: "BearerAuth",
+	}, *logEntry.Identity)
+}
+
+func TestNoPrincipalFromFailedSecurityRequirement(t *testing.T) {
+	batches := make(chan [][]byte, 1)
+	middleware, err := NewMiddleware(&Options{
+		OpenapiSpecPath: "./test-spec.yaml",
+		AuthCallbacks: map[string]openapi3filter.AuthenticationFunc{
+			"ApiKeyAuth1": NewAPIKeyAuthCallback(StaticCredentials{"api-key-subject": "valid-api-key"}),
+			"BasicAuth":   NewBasicAuthCallback(StaticCredentials{"basic-subject": "basic-secret"}),
+			"BearerAuth": func(ctx context.Context, ai *openapi3filter.AuthenticationInput) error {
+				return nil
+			},
+		},
+		EnableRequestValidation: true,
+		LogBatchCallback: func(logs [][]byte) {
+			batches <- logs
+		},
+	})
+	require.Nil(t, err)
+	var handlerHasPrincipal bool
+	handler := middleware.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, handlerHasPrincipal = GetPrincipal(r.Context())
+		w.WriteHeader(200)
+	}))
+	responseRecorder := httptest.NewRecorder()
+
+	// The API key authenticates the first requirement's first scheme, but it fails as there are no basic auth credentials. The request
+	// passes the second requirement, whose callback records no principal, so the API key's principal shouldn't be used
+	request := httptest.NewRequest("GET", "/api-key-and-basic-or-bearer-auth", nil)
+	request.Header.Add("X-Api-Key", "valid-api-key")
+	handler.ServeHTTP(responseRecorder, request)
+	assert.Equal(t, 200, responseRecorder.Code)
+	assert.False(t, handlerHasPrincipal)
+
+	require.Nil(t, middleware.Close(context.Background()))
+	require.Equal(t, 1, len(batches))
+	logs := <-batches
+	require.Equal(t, 1, len(logs))
+	logEntry, err := logging.UnmarshalLogEntry(logs[0])
+	require.Nil(t, err)
+	assert.Nil(t, logEntry.Identity)
+}
+
+func TestPrincipalFromPassedSecurityRequirement(t *testing.T) {
+	middleware, err := GetMiddleware(&Options{
+		OpenapiSpecPath: "./test-spec.yaml",
+		AuthCallbacks: map[string]openapi3filter.AuthenticationFunc{
+			"ApiKeyAuth1": NewAPIKeyAuthCallback(StaticCredentials{"api-key-subject": "valid-api-key"}),
+			"BasicAuth":   NewBasicAuthCallback(StaticCredentials{"basic-subject": "basic-secret"}),
+		},
+		EnableRequestValidation: true,
+	})
+	require.Nil(t, err)
+	var handlerPrincipal Principal
+	handler := middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handlerPrincipal, _ = GetPrincipal(r.Context())
+		w.WriteHeader(200)
+	}))
+	responseRecorder := httptest.NewRecorder()
+
+	// Both schemes of the first requirement pass, so the principal recorded last, by the BasicAuth callback, is used
+	request := httptest.NewRequest("GET", "/api-key-and-basic-or-bearer-auth", nil)
+	request.Header.Add("X-Api-Key", "valid-api-key")
+	request.SetBasicAuth("basic-subject", "basic-secret")
+	handler.ServeHTTP(responseRecorder, request)
+	assert.Equal(t, 200, responseRecorder.Code)
+	assert.Equal(t, Principal{Subject: "basic-subject", SecuritySchemeName: "BasicAuth"}, handlerPrincipal)
+}
+
+func TestNoPrincipalWithoutAuth(t *testing.T) {
+	middleware, err := GetMiddleware(&Options{
+		OpenapiSpecPath: "./test-spec.yaml",
+	})
+	require.Nil(t, err)
+	var handlerHasPrincipal bool
+	handler := middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, handlerHasPrincipal = GetPrincipal(r.Context())
+		w.WriteHeader(200)
+	}))
+	responseRecorder := httptest.NewRecorder()
+
+	request := httptest.NewRequest("GET", "/response-headers", nil)
+	handler.ServeHTTP(responseRecorder, request)
+	assert.False(t, handlerHasPrincipal)
+}
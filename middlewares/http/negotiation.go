@@ -0,0 +1,136 @@
+package firetail
+
+import (
+	"context"
+	"mime"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/getkin/kin-openapi/routers"
+)
+
+// The key under which the media type negotiated for a request is stored in its context
+type negotiatedMediaTypeKey struct{}
+
+// NegotiatedMediaType returns the media type, from those declared for the responses of the operation in the OpenAPI spec, which the
+// request's Accept header prefers. The handler should use it as the Content-Type of its response. If no media type could be negotiated,
+// because the request didn't match an operation, the operation doesn't declare any response content, or none of it is acceptable, the
+// second return value is false. If the spec declares a media range (e.g. "application/*") it may be returned as is
+func NegotiatedMediaType(ctx context.Context) (string, bool) {
+	mediaType, ok := ctx.Value(negotiatedMediaTypeKey{}).(string)
+	return mediaType, ok
+}
+
+// getResponseMediaTypes returns all of the media types declared for the responses of a route's operation in the OpenAPI spec, with those
+// declared for 2XX responses first, each in alphabetical order
+func getResponseMediaTypes(route *routers.Route) []string {
+	successMediaTypes, otherMediaTypes := map[string]bool{}, map[string]bool{}
+	for statusCode, responseRef := range route.Operation.Responses {
+		if responseRef == nil || responseRef.Value == nil {
+			continue
+		}
+		for mediaType := range responseRef.Value.Content {
+			if strings.HasPrefix(statusCode, "2") {
+				successMediaTypes[mediaType] = true
+			} else {
+				otherMediaTypes[mediaType] = true
+			}
+		}
+	}
+	mediaTypes := sortedKeys(successMediaTypes)
+	for _, mediaType := range sortedKeys(otherMediaTypes) {
+		if !successMediaTypes[mediaType] {
+			mediaTypes = append(mediaTypes, mediaType)
+		}
+	}
+	return mediaTypes
+}
+
+func sortedKeys(set map[string]bool) []string {
+	keys := []string{}
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// A media range from an Accept header, e.g. "application/*;q=0.5"
+type acceptRange struct {
+	mediaType string  // The type, e.g. "application", or "*"
+	subtype   string  // The subtype, e.g. "json", or "*"
+	q         float64 // The quality value, between 0 and 1
+}
+
+// parseAccept parses the media ranges in an Accept header, skipping any which are malformed
+func parseAccept(accept string) []acceptRange {
+	acceptRanges := []acceptRange{}
+	for _, part := range strings.Split(accept, ",") {
+		mediaRange, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		mediaType, subtype, found := strings.Cut(mediaRange, "/")
+		if !found {
+			continue
+		}
+		q := 1.0
+		if qParam, hasQ := params["q"]; hasQ {
+			if q, err = strconv.ParseFloat(qParam, 64); err != nil || q < 0 || q > 1 {
+				continue
+			}
+		}
+		acceptRanges = append(acceptRanges, acceptRange{mediaType, subtype, q})
+	}
+	return acceptRanges
+}
+
+// getAcceptQuality returns the quality value the media ranges give a media type, taken from the most specific range matching it, or 0
+// if none of them match it. The media type may itself be a media range, e.g. "application/*", in which case it matches any media range
+// which intersects with it
+func getAcceptQuality(acceptRanges []acceptRange, mediaType string) float64 {
+	mediaType = strings.TrimSpace(strings.Split(mediaType, ";")[0])
+	offerType, offerSubtype, _ := strings.Cut(strings.ToLower(mediaType), "/")
+	quality, specificity := 0.0, -1
+	for _, acceptRange := range acceptRanges {
+		rangeSpecificity := 0
+		switch {
+		case acceptRange.mediaType == offerType && acceptRange.subtype == offerSubtype:
+			rangeSpecificity = 2
+		case acceptRange.mediaType == offerType && acceptRange.subtype == "*":
+			rangeSpecificity = 1
+		case acceptRange.mediaType == "*" && acceptRange.subtype == "*":
+			rangeSpecificity = 0
+		case offerType == "*" || (offerType == acceptRange.mediaType && offerSubtype == "*"):
+			// The offer is a media range which contains the accepted media type
+			rangeSpecificity = 0
+		default:
+			continue
+		}
+		if rangeSpecificity > specificity {
+			quality, specificity = acceptRange.q, rangeSpecificity
+		}
+	}
+	return quality
+}
+
+// negotiateMediaType returns the offer which an Accept header gives the highest quality value, preferring earlier offers when they're
+// equally acceptable. If the Accept header is empty, or all of its media ranges are malformed, it's treated as if it were absent & the
+// first offer is returned; if none of the offers are acceptable, an empty string is returned
+func negotiateMediaType(accept string, offers []string) string {
+	acceptRanges := parseAccept(accept)
+	if len(acceptRanges) == 0 {
+		if len(offers) == 0 {
+			return ""
+		}
+		return offers[0]
+	}
+	bestOffer, bestQuality := "", 0.0
+	for _, offer := range offers {
+		if quality := getAcceptQuality(acceptRanges, offer); quality > bestQuality {
+			bestOffer, bestQuality = offer, quality
+		}
+	}
+	return bestOffer
+}
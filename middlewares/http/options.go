@@ -1,12 +1,15 @@
 package firetail
 
 import (
-	"encoding/json"
 	"net/http"
 	"time"
 
 	"github.com/FireTail-io/firetail-go-lib/logging"
 	"github.com/getkin/kin-openapi/openapi3filter"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // Options is an options struct used when creating a Firetail middleware (GetMiddleware)
@@ -34,28 +37,109 @@ type Options struct {
 	// to a file on disk
 	LogBatchCallback func([][]byte)
 
+	// LogSinks is an optional list of sinks to which each batch of log entries will be written in addition to the LogBatchCallback, or the
+	// Firetail logging API if there's no LogBatchCallback, such as a logging.FileSink to keep a local audit trail. Each batch is written to
+	// all of them concurrently, so a sink which fails doesn't affect the others, but the next batch isn't written until they've all returned,
+	// so a slow sink delays the others
+	LogSinks []logging.Sink
+
 	// MaxBatchSize is the maximum size of a logging batch in bytes which will be passed to the LogBatchCallback, or the default callback
-	// if it is used.
+	// if it is used. This is the size of the batch before it is compressed by the LogCompressor, if one is set.
 	MaxBatchSize int
 
 	// MaxLogAge is the maximum age of the oldest log in a batch which will be passed to the LogBatchCallback, or the default callback if
 	// it is used.
 	MaxLogAge time.Duration
 
+	// LogQueueCapacity is the maximum number of log entries which can be waiting to be batched before the LogQueueOverflowPolicy is
+	// applied. The default value is 1024
+	LogQueueCapacity int
+
+	// LogQueueOverflowPolicy determines what happens when a log entry is created while the log queue is full. The default policy,
+	// logging.BlockOnOverflow, will hold up the response until there is space in the queue; logging.DropNewestOnOverflow and
+	// logging.DropOldestOnOverflow will instead drop a log entry so that the response is never delayed
+	LogQueueOverflowPolicy logging.OverflowPolicy
+
+	// LogSpoolDirectory is an optional directory in which the default LogBatchCallback will persist batches of log entries that it fails
+	// to send to the Firetail logging API. They are then replayed with an exponential backoff until the API can be reached again, including
+	// after your application has been restarted. If unset, batches which can't be sent are dropped
+	LogSpoolDirectory string
+
+	// LogSpoolMaxSize is the maximum total size in bytes of the batches held in the LogSpoolDirectory, beyond which the oldest are dropped.
+	// The default value is 64MB
+	LogSpoolMaxSize int64
+
+	// LogSpoolMaxAge is the maximum age of a batch held in the LogSpoolDirectory, after which it is dropped. The default value is 24 hours
+	LogSpoolMaxAge time.Duration
+
+	// LogHTTPClient is an optional http.Client which the default LogBatchCallback will use to send logs to the Firetail logging API. You
+	// can use its Transport to configure a proxy, mTLS client certificates or a custom CA bundle. If unset, a http.Client with a 30 second
+	// timeout is used
+	LogHTTPClient *http.Client
+
+	// LogRequestSigner is an optional hook which is given each request the default LogBatchCallback makes to the Firetail logging API
+	// just before it is sent, so that you can, for example, sign it for your egress gateway. The request's body can be read using its
+	// GetBody method. If it returns an error, the batch of log entries is dropped
+	LogRequestSigner func(*http.Request) error
+
+	// LogCompressor is an optional logging.Compressor which the default LogBatchCallback will use to compress batches of log entries
+	// before sending them to the Firetail logging API, e.g. logging.GzipCompressor(gzip.DefaultCompression). If unset, batches are sent
+	// uncompressed
+	LogCompressor logging.Compressor
+
+	// LogRetryPolicy configures how many times, and how often, the default LogBatchCallback retries sending a batch of log entries after
+	// a network error, 408, 429 or 5xx response from the Firetail logging API. Any Retry-After header on a 429 or 503 response is honoured;
+	// if it's longer than the policy's MaxDelay, the batch is spooled rather than retried inline, or if there's no LogSpoolDir it's retried
+	// after MaxDelay. Other failures, such as a 401 for an invalid LogsApiToken, are not retried. If unset, logging.DefaultRetryPolicy is used
+	LogRetryPolicy *logging.RetryPolicy
+
+	// LogErrCallback is an optional callback which is given a logging.BatchError describing each batch of log entries that the default
+	// LogBatchCallback fails to send, including whether the failure was retryable and whether the batch was spooled. If unset, the errors
+	// are logged using the standard log package
+	LogErrCallback func(logging.BatchError)
+
 	// ErrCallback is an optional callback func which is given an error and a ResponseWriter to which an apropriate response can be written
 	// for the error. This allows you customise the responses given, when for example a request or response fails to validate against the
-	// openapi spec, to be consistent with the format in which the rest of your application returns error responses
+	// openapi spec, to be consistent with the format in which the rest of your application returns error responses. If unset, RFC7807
+	// application/problem+json responses are written, or plain JSON or XML variants if the request's Accept header prefers them
 	ErrCallback func(ErrorAtRequest, http.ResponseWriter, *http.Request)
 
 	// DebugErrs is a flag which, when set to true, will enable the default ErrCallback to send more verbose information in the RFC7807
-	// error responses' `details` member.
+	// error responses' `detail` member.
 	DebugErrs bool
 
+	// ErrTypeBaseURI is an optional base URI for the `type` member of the default ErrCallback's RFC7807 error responses, which is followed
+	// by the kebab-cased name of the error's type without its "Error" prefix, e.g. "https://example.com/problems/request-body-invalid".
+	// If unset, the type is "about:blank"
+	ErrTypeBaseURI string
+
+	// ErrInstance is an optional func which returns the `instance` member of the default ErrCallback's RFC7807 error responses for a
+	// request, such as a URN containing the request's ID. If unset, the request's path is used
+	ErrInstance func(*http.Request) string
+
+	// ErrExtensions is an optional func which returns extension members to add to the default ErrCallback's RFC7807 error responses, such
+	// as a request ID or a link to your API's documentation. Extensions cannot replace the standard members
+	ErrExtensions func(ErrorAtRequest, *http.Request) map[string]interface{}
+
+	// EnforceAcceptHeader is an optional flag which, if set to true, rejects requests with an ErrorNotAcceptable if none of the media
+	// types their Accept header accepts are declared for the responses of the operation they match in the openapi spec. Regardless of
+	// this flag, the negotiated media type is available to your handler via NegotiatedMediaType
+	EnforceAcceptHeader bool
+
+	// ReportAllErrors is an optional flag which, if set to true, makes request validation collect every error across the request's path,
+	// query, header & cookie params and its body instead of stopping at the first. They're passed to the ErrCallback together as an
+	// ErrorRequestInvalid, and the default ErrCallback lists each offending field in an `errors` member of its response
+	ReportAllErrors bool
+
 	// AuthCallbacks is a map of strings, which should match the names of your appspec's securitySchemes, to callback funcs which must be
 	// defined if you wish to use security schemas in your openapi specification. See the openapi3filter package's reference for further
 	// documentation
 	AuthCallbacks map[string]openapi3filter.AuthenticationFunc
 
+	// AuthRealm is an optional realm for the WWW-Authenticate challenges which are generated from the security schemes of routes when
+	// requests fail to authenticate, and sent by the default ErrCallback. If unset, the title of the openapi spec is used
+	AuthRealm string
+
 	// EnableRequestValidation is an optional flag which, if set to true, enables request validation against the openapi spec provided -
 	// if no openapi spec is provided, then no validation will be performed
 	EnableRequestValidation bool
@@ -69,10 +153,60 @@ type Options struct {
 	// 404 response will be returned
 	AllowUndefinedRoutes bool
 
+	// MonitorOnly is an optional flag which, if set to true, enables monitor-only mode for all operations. In monitor-only mode, requests
+	// & responses are still validated, and any errors are included in the log entries, metrics & spans, but the ErrCallback isn't used;
+	// the request is always passed on to the next handler and its original response is always returned to the client. This is useful for
+	// rolling out validation on an existing API without risk of breaking its clients. Requests which fail to authenticate using the
+	// AuthCallbacks are still blocked, unless MonitorOnlyAuth is also set
+	MonitorOnly bool
+
+	// MonitorOnlyOperations is an optional list of operations in your openapi spec for which monitor-only mode will be enabled, even if
+	// MonitorOnly is false. Operations can be identified by their operationId, or in the form "METHOD /path" (e.g. "POST /pets/{id}"). As
+	// with MonitorOnly, requests which fail to authenticate are still blocked unless MonitorOnlyAuth is set
+	MonitorOnlyOperations []string
+
+	// MonitorOnlyAuth is an optional flag which, if set to true, makes monitor-only mode apply to auth failures too, such as an
+	// ErrorAuthCredentialsMissing or ErrorAuthCredentialsInvalid, so requests which fail to authenticate are passed on to the next handler.
+	// This disables the auth enforced by your AuthCallbacks for the monitor-only operations, so it should only be set if your application
+	// authenticates requests itself. Security schemes which have no AuthCallback are never enforced in monitor-only mode
+	MonitorOnlyAuth bool
+
+	// StreamingContentTypes is an optional list of media types (e.g. "text/event-stream", or "video/*") for which responses will be
+	// streamed to the client as they are written, instead of being buffered by the middleware until the handler returns. Streamed
+	// responses cannot be validated, so response validation is skipped for them, and only the first MaxStreamedBodyLogSize bytes of
+	// their bodies are logged
+	StreamingContentTypes []string
+
+	// StreamingRoutes is an optional list of paths, matching those in your openapi spec (e.g. "/events/{id}"), for which responses will
+	// always be streamed regardless of their Content-Type. If no openapi spec is provided, or a request is made to an undefined route
+	// and AllowUndefinedRoutes is true, the request's path is used instead
+	StreamingRoutes []string
+
+	// MaxStreamedBodyLogSize is the maximum number of bytes of a streamed response's body which will be included in its log entry. The
+	// default value is 64KB
+	MaxStreamedBodyLogSize int
+
 	// CustomBodyDecoders is a map of Content-Type header values to openapi3 decoders - if the kin-openapi module does not support your
 	// Content-Type by default, you will need to add a custom decoder here
 	CustomBodyDecoders map[string]openapi3filter.BodyDecoder
 
+	// TracerProvider is an optional OpenTelemetry TracerProvider which, if set, the middleware will use to create a server span for each
+	// request, named after the route in your openapi spec to which the request was made, with child spans for the route lookup, request
+	// validation, the next handler and response validation. Validation failures are recorded as events on these spans, including the type
+	// of the ErrorAtRequest, and the trace & span IDs of the server span are included in the request's log entry. If unset, no spans are
+	// created, and only the trace ID propagated by the client, if any, is included in the log entry
+	TracerProvider trace.TracerProvider
+
+	// TracePropagator is an optional OpenTelemetry TextMapPropagator which will be used to extract trace context propagated by clients in
+	// the request headers, so that the middleware's server span can continue their trace. If unset, the global propagator is used
+	TracePropagator propagation.TextMapPropagator
+
+	// MetricsRegisterer is an optional Prometheus registerer on which, if set, the middleware will register metrics counting the requests
+	// it handles by route, method, status code & the type of ErrorAtRequest that occurred (e.g. ErrorRequestBodyInvalid), histograms of
+	// the durations of your handler & of request & response validation, and the queue length, batches sent, retries, dropped log entries
+	// etc. of its logger. All of the metrics' names are prefixed with firetail_
+	MetricsRegisterer prometheus.Registerer
+
 	// LogEntrySanitiser is a function used to sanitise the log entries sent to Firetail. You may wish to use this to redact sensitive
 	// information, or anonymise identifiable information using a custom implementation of this callback for your application. A default
 	// implementation is provided in the firetail logging package
@@ -84,34 +218,28 @@ func (o *Options) setDefaults() {
 		o.LogsApiUrl = "https://api.logging.eu-west-1.prod.firetail.app/logs/bulk"
 	}
 
-	if o.ErrCallback == nil {
-		o.ErrCallback = func(errAtRequest ErrorAtRequest, w http.ResponseWriter, r *http.Request) {
-			w.Header().Add("Content-Type", "application/json")
-			type ErrorResponse struct {
-				Code   int    `json:"code"`
-				Title  string `json:"title"`
-				Detail string `json:"detail,omitempty"`
-			}
-			errorResponse := ErrorResponse{
-				Code:  errAtRequest.StatusCode(),
-				Title: errAtRequest.Title(),
-			}
-			if o.DebugErrs {
-				errorResponse.Detail = errAtRequest.Error()
-			}
-			responseBody, err := json.Marshal(errorResponse)
-			if err != nil {
-				w.WriteHeader(http.StatusInternalServerError)
-				w.Write([]byte(`{
-					"code": 500,
-					"title": "internal server error"
-				}`))
-			}
-			w.WriteHeader(errAtRequest.StatusCode())
-			w.Write([]byte(responseBody))
+	if o.ErrInstance == nil {
+		o.ErrInstance = func(r *http.Request) string {
+			return r.URL.Path
 		}
 	}
 
+	if o.ErrCallback == nil {
+		o.ErrCallback = getDefaultErrCallback(o)
+	}
+
+	if o.MaxStreamedBodyLogSize <= 0 {
+		o.MaxStreamedBodyLogSize = 1024 * 64
+	}
+
+	if o.TracerProvider == nil {
+		o.TracerProvider = trace.NewNoopTracerProvider()
+	}
+
+	if o.TracePropagator == nil {
+		o.TracePropagator = otel.GetTextMapPropagator()
+	}
+
 	if o.LogEntrySanitiser == nil {
 		o.LogEntrySanitiser = logging.DefaultSanitiser()
 	}
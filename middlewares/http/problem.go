@@ -0,0 +1,157 @@
+package firetail
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// The media types in which the default ErrCallback can write its responses, in order of preference. The plain JSON & XML variants are
+// only used if the client asks for them in its Accept header
+var problemMediaTypes = []string{"application/problem+json", "application/json", "application/problem+xml", "application/xml"}
+
+// The members defined by RFC7807, or by us, which can't be overridden by the ErrExtensions option
+var problemMembers = map[string]bool{"type": true, "title": true, "status": true, "detail": true, "instance": true, "errors": true}
+
+// An RFC7807 problem details object, as written by the default ErrCallback
+type problemDetails struct {
+	XMLName    xml.Name          `json:"-" xml:"urn:ietf:rfc:7807 problem"`
+	Type       string            `json:"type" xml:"type"`
+	Title      string            `json:"title" xml:"title"`
+	Status     int               `json:"status" xml:"status"`
+	Detail     string            `json:"detail,omitempty" xml:"detail,omitempty"`
+	Instance   string            `json:"instance,omitempty" xml:"instance,omitempty"`
+	Errors     []ValidationIssue `json:"errors,omitempty" xml:"-"`
+	ErrorsXML  *problemErrorsXML `json:"-" xml:"errors,omitempty"` // The Errors, as RFC7807 represents arrays in XML; nil if there are none
+	Extensions problemExtensions `json:"-" xml:"extensions"`
+}
+
+// The errors member of a problem details object in XML, where each of the items in the array is an <i> element
+type problemErrorsXML struct {
+	Issues []ValidationIssue `xml:"i"`
+}
+
+// MarshalJSON adds the problem's extension members alongside its standard members
+func (p problemDetails) MarshalJSON() ([]byte, error) {
+	type standardMembers problemDetails // Has the same fields, but not this MarshalJSON method
+	standardBytes, err := json.Marshal(standardMembers(p))
+	if err != nil {
+		return nil, err
+	}
+
+	extensions := map[string]interface{}{}
+	for name, value := range p.Extensions {
+		if !problemMembers[name] {
+			extensions[name] = value
+		}
+	}
+	if len(extensions) == 0 {
+		return standardBytes, nil
+	}
+	extensionBytes, err := json.Marshal(extensions)
+	if err != nil {
+		return nil, err
+	}
+
+	// Both are JSON objects, so we can splice them together by replacing the closing brace of one & the opening brace of the other
+	return append(append(standardBytes[:len(standardBytes)-1], ','), extensionBytes[1:]...), nil
+}
+
+// Extension members of a problem details object, which are written as child elements of the problem when it's encoded as XML
+type problemExtensions map[string]interface{}
+
+// MarshalXML writes each of the extensions as an element named after it, in alphabetical order. Values which can't be encoded as XML,
+// such as maps, are written using their default format. Each value is checked by encoding it to a scratch buffer first, as the encoder may
+// have already written part of an element by the time it fails to encode it
+func (extensions problemExtensions) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	names := []string{}
+	for name := range extensions {
+		if !problemMembers[name] {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		value := extensions[name]
+		if _, err := xml.Marshal(value); err != nil {
+			value = fmt.Sprint(value)
+		}
+		if err := e.EncodeElement(value, xml.StartElement{Name: xml.Name{Local: name}}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// getProblemType returns the type URI for an ErrorAtRequest, which is the base URI followed by the kebab-cased name of its type without
+// its "Error" prefix, e.g. "https://example.com/problems/request-body-invalid". If there's no base URI, "about:blank" is used
+func getProblemType(baseURI string, errAtRequest ErrorAtRequest) string {
+	errorType := strings.TrimPrefix(getErrorType(errAtRequest), "Error")
+	if baseURI == "" || errorType == "" {
+		return "about:blank"
+	}
+	slug := ""
+	for i, r := range errorType {
+		if unicode.IsUpper(r) && i > 0 {
+			slug += "-"
+		}
+		slug += string(unicode.ToLower(r))
+	}
+	return strings.TrimSuffix(baseURI, "/") + "/" + slug
+}
+
+// getDefaultErrCallback returns the ErrCallback used if none is provided in the options, which writes an RFC7807 problem details object
+// describing the ErrorAtRequest as application/problem+json, or as plain JSON or XML if the client's Accept header prefers them
+func getDefaultErrCallback(options *Options) func(ErrorAtRequest, http.ResponseWriter, *http.Request) {
+	return func(errAtRequest ErrorAtRequest, w http.ResponseWriter, r *http.Request) {
+		problem := problemDetails{
+			Type:     getProblemType(options.ErrTypeBaseURI, errAtRequest),
+			Title:    errAtRequest.Title(),
+			Status:   errAtRequest.StatusCode(),
+			Instance: options.ErrInstance(r),
+		}
+		if options.DebugErrs {
+			problem.Detail = errAtRequest.Error()
+		}
+		if errRequestInvalid, isErrRequestInvalid := errAtRequest.(ErrorRequestInvalid); isErrRequestInvalid {
+			problem.Errors = errRequestInvalid.Issues
+			problem.ErrorsXML = &problemErrorsXML{errRequestInvalid.Issues}
+		}
+		if options.ErrExtensions != nil {
+			problem.Extensions = options.ErrExtensions(errAtRequest, r)
+		}
+
+		// If the client doesn't accept any of our media types, we'd still rather tell it what went wrong than not
+		mediaType := negotiateMediaType(r.Header.Get("Accept"), problemMediaTypes)
+		if mediaType == "" {
+			mediaType = problemMediaTypes[0]
+		}
+
+		var responseBody []byte
+		var err error
+		if strings.HasSuffix(mediaType, "xml") {
+			responseBody, err = xml.Marshal(problem)
+			responseBody = append([]byte(xml.Header), responseBody...)
+		} else {
+			responseBody, err = json.Marshal(problem)
+		}
+
+		w.Header().Add("Vary", "Accept")
+		if err != nil {
+			w.Header().Set("Content-Type", problemMediaTypes[0])
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"type":"about:blank","title":"internal server error","status":500}`))
+			return
+		}
+		for _, challenge := range getErrAuthChallenges(errAtRequest) {
+			w.Header().Add("WWW-Authenticate", challenge)
+		}
+		w.Header().Set("Content-Type", mediaType)
+		w.WriteHeader(problem.Status)
+		w.Write(responseBody)
+	}
+}
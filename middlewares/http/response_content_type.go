@@ -0,0 +1,87 @@
+package firetail
+
+import (
+	"mime"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/getkin/kin-openapi/routers"
+)
+
+// validateResponseContentType checks the Content-Type of a response is one of the media types declared for its status code in the OpenAPI
+// spec, returning an ErrorResponseContentTypeInvalid if it isn't. Declared media types may contain wildcards (e.g. "application/*"), and
+// a declared media type also matches responses with a structured syntax suffix of its subtype, so "application/json" matches
+// "application/problem+json". If the response matches a declared media type only by its suffix, the declared media type is returned so
+// the body can be decoded & validated as if it had that Content-Type; otherwise an empty string is returned
+func validateResponseContentType(route *routers.Route, statusCode int, header http.Header) (string, ErrorAtRequest) {
+	responseRef := route.Operation.Responses.Get(statusCode)
+	if responseRef == nil {
+		responseRef = route.Operation.Responses.Default()
+	}
+	if responseRef == nil || responseRef.Value == nil || len(responseRef.Value.Content) == 0 {
+		// If there's no response or no content declared for the status code, there's nothing to check the Content-Type against
+		return "", nil
+	}
+
+	declaredMediaTypes := []string{}
+	for declaredMediaType := range responseRef.Value.Content {
+		declaredMediaTypes = append(declaredMediaTypes, declaredMediaType)
+	}
+	sort.Strings(declaredMediaTypes)
+
+	contentType := header.Get("Content-Type")
+	respondedMediaType, _, err := mime.ParseMediaType(contentType)
+	if err == nil {
+		suffixMatch := ""
+		for _, declaredMediaType := range declaredMediaTypes {
+			switch matchMediaType(declaredMediaType, respondedMediaType) {
+			case mediaTypeMatch:
+				return "", nil
+			case mediaTypeSuffixMatch:
+				if suffixMatch == "" {
+					suffixMatch = declaredMediaType
+				}
+			}
+		}
+		if suffixMatch != "" {
+			return suffixMatch, nil
+		}
+	}
+
+	return "", ErrorResponseContentTypeInvalid{
+		RespondedContentType: contentType,
+		RespondedStatusCode:  statusCode,
+		AllowedContentTypes:  declaredMediaTypes,
+	}
+}
+
+// The ways in which a media type can match a media type, or media range, declared in the OpenAPI spec
+type mediaTypeMatchKind int
+
+const (
+	mediaTypeNoMatch     mediaTypeMatchKind = iota
+	mediaTypeMatch                          // The media type matches exactly, or by a wildcard
+	mediaTypeSuffixMatch                    // The media type's subtype has a structured syntax suffix which is the declared subtype
+)
+
+// matchMediaType compares a media type without parameters, e.g. "application/problem+json", to a declared media type or range, e.g.
+// "application/json", "application/*" or "*/*", of which any parameters are ignored
+func matchMediaType(declaredMediaType string, mediaType string) mediaTypeMatchKind {
+	declaredMediaType = strings.ToLower(strings.TrimSpace(strings.Split(declaredMediaType, ";")[0]))
+	declaredType, declaredSubtype, _ := strings.Cut(declaredMediaType, "/")
+	respondedType, respondedSubtype, _ := strings.Cut(strings.ToLower(mediaType), "/")
+
+	switch {
+	case declaredType == "*" && declaredSubtype == "*":
+		return mediaTypeMatch
+	case declaredType != respondedType:
+		return mediaTypeNoMatch
+	case declaredSubtype == "*" || declaredSubtype == respondedSubtype:
+		return mediaTypeMatch
+	case strings.HasSuffix(respondedSubtype, "+"+declaredSubtype):
+		return mediaTypeSuffixMatch
+	default:
+		return mediaTypeNoMatch
+	}
+}
@@ -0,0 +1,93 @@
+//go:build go1.20
+
+package firetail
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/FireTail-io/firetail-go-lib/logging"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// unwrappingResponseWriter is a ResponseWriter, like those of other middlewares, which doesn't implement http.Flusher or http.Hijacker
+// itself but lets http.ResponseController reach them via its Unwrap method
+type unwrappingResponseWriter struct {
+	http.ResponseWriter
+}
+
+func (w unwrappingResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func TestResponseControllerFlushDoesNotBypassBuffering(t *testing.T) {
+	middleware, err := GetMiddleware(&Options{})
+	require.Nil(t, err)
+	responseRecorder := httptest.NewRecorder()
+	handler := middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(201)
+		w.Write([]byte("test body"))
+
+		// The response is buffered so that it can be validated, so flushing it should do nothing until the handler returns
+		require.Nil(t, http.NewResponseController(w).Flush())
+		assert.False(t, responseRecorder.Flushed)
+		assert.Empty(t, responseRecorder.Body.String())
+	}))
+
+	handler.ServeHTTP(unwrappingResponseWriter{responseRecorder}, httptest.NewRequest("GET", "/health", nil))
+
+	assert.Equal(t, 201, responseRecorder.Code)
+	assert.Equal(t, "test body", responseRecorder.Body.String())
+}
+
+func TestResponseControllerFlushesStreamedResponse(t *testing.T) {
+	middleware, err := GetMiddleware(&Options{StreamingContentTypes: []string{"text/event-stream"}})
+	require.Nil(t, err)
+	responseRecorder := httptest.NewRecorder()
+	handler := middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Write([]byte("data: message 1\n\n"))
+		require.Nil(t, http.NewResponseController(w).Flush())
+		assert.True(t, responseRecorder.Flushed)
+	}))
+
+	handler.ServeHTTP(unwrappingResponseWriter{responseRecorder}, httptest.NewRequest("GET", "/events", nil))
+
+	assert.Equal(t, "data: message 1\n\n", responseRecorder.Body.String())
+}
+
+func TestResponseControllerHijackIsLogged(t *testing.T) {
+	batches := make(chan [][]byte, 1)
+	middleware, err := NewMiddleware(&Options{
+		LogBatchCallback: func(logs [][]byte) {
+			batches <- logs
+		},
+	})
+	require.Nil(t, err)
+	handler := middleware.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, _, err := http.NewResponseController(w).Hijack()
+		require.Nil(t, err)
+		conn.Close()
+	}))
+	responseRecorder := &hijackableResponseRecorder{recorder: httptest.NewRecorder()}
+
+	handler.ServeHTTP(unwrappingResponseWriter{responseRecorder}, httptest.NewRequest("GET", "/websocket", nil))
+
+	// Nothing should have been written to the hijacked connection's ResponseWriter
+	assert.True(t, responseRecorder.hijacked)
+	assert.Empty(t, responseRecorder.recorder.Header())
+	assert.Empty(t, responseRecorder.recorder.Body.Bytes())
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	require.Nil(t, middleware.Close(ctx))
+	logs := <-batches
+	require.Equal(t, 1, len(logs))
+	logEntry, err := logging.UnmarshalLogEntry(logs[0])
+	require.Nil(t, err)
+	assert.True(t, logEntry.Response.Hijacked)
+}
@@ -0,0 +1,151 @@
+package firetail
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/getkin/kin-openapi/openapi3"
+	"github.com/getkin/kin-openapi/routers"
+)
+
+// ResponseHeaderError describes a header of a response which is missing or doesn't conform to its schema in the OpenAPI spec
+type ResponseHeaderError struct {
+	Name   string // The name of the header, as it's declared in the OpenAPI spec
+	Reason string // Why the header failed to validate, e.g. "is missing"
+	Err    error  // The underlying error, such as an *openapi3.SchemaError, if there is one
+}
+
+func (e ResponseHeaderError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("header \"%s\" %s: %s", e.Name, e.Reason, e.Err.Error())
+	}
+	return fmt.Sprintf("header \"%s\" %s", e.Name, e.Reason)
+}
+
+func (e ResponseHeaderError) Unwrap() error {
+	return e.Err
+}
+
+// validateResponseHeaders validates the headers of a response against those declared for its status code in the OpenAPI spec, returning
+// an ErrorResponseHeadersInvalid describing each header which is required but missing, or doesn't match its schema. If the spec doesn't
+// declare a response for the status code then there's nothing to validate the headers against, so nil is returned
+func validateResponseHeaders(route *routers.Route, statusCode int, header http.Header) ErrorAtRequest {
+	responseRef := route.Operation.Responses.Get(statusCode)
+	if responseRef == nil {
+		responseRef = route.Operation.Responses.Default()
+	}
+	if responseRef == nil || responseRef.Value == nil {
+		return nil
+	}
+
+	// Sort the header names so the errors are always given in the same order
+	headerNames := []string{}
+	for headerName := range responseRef.Value.Headers {
+		headerNames = append(headerNames, headerName)
+	}
+	sort.Strings(headerNames)
+
+	headerErrs := []ResponseHeaderError{}
+	for _, headerName := range headerNames {
+		// The OpenAPI spec says Content-Type response headers should be ignored, as they're described by the response's content
+		headerRef := responseRef.Value.Headers[headerName]
+		if strings.EqualFold(headerName, "Content-Type") || headerRef == nil || headerRef.Value == nil {
+			continue
+		}
+
+		values := header.Values(headerName)
+		if len(values) == 0 {
+			if headerRef.Value.Required {
+				headerErrs = append(headerErrs, ResponseHeaderError{Name: headerName, Reason: "is missing"})
+			}
+			continue
+		}
+
+		// Headers described by content rather than a schema can only be checked for their presence
+		if headerRef.Value.Schema == nil || headerRef.Value.Schema.Value == nil {
+			continue
+		}
+		schema := headerRef.Value.Schema.Value
+
+		value, err := decodeHeaderValue(strings.Join(values, ","), schema)
+		if err != nil {
+			headerErrs = append(headerErrs, ResponseHeaderError{Name: headerName, Reason: "could not be decoded", Err: err})
+			continue
+		}
+		if err := schema.VisitJSON(value, openapi3.MultiErrors(), openapi3.VisitAsResponse()); err != nil {
+			headerErrs = append(headerErrs, ResponseHeaderError{Name: headerName, Reason: "doesn't match its schema", Err: err})
+		}
+	}
+
+	if len(headerErrs) == 0 {
+		return nil
+	}
+	multiErr := openapi3.MultiError{}
+	for _, headerErr := range headerErrs {
+		multiErr = append(multiErr, headerErr)
+	}
+	return ErrorResponseHeadersInvalid{Err: multiErr, Headers: headerErrs}
+}
+
+// decodeHeaderValue decodes the value of a header into the type described by its schema, using the "simple" style which is the only one
+// the OpenAPI spec allows for headers, so that it can be validated against the schema
+func decodeHeaderValue(value string, schema *openapi3.Schema) (interface{}, error) {
+	switch schema.Type {
+	case "array":
+		items := []interface{}{}
+		for _, item := range strings.Split(value, ",") {
+			if schema.Items == nil || schema.Items.Value == nil {
+				items = append(items, strings.TrimSpace(item))
+				continue
+			}
+			decodedItem, err := decodeHeaderValue(strings.TrimSpace(item), schema.Items.Value)
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, decodedItem)
+		}
+		return items, nil
+
+	case "object":
+		// Objects are serialised as a comma separated list of alternating property names & values
+		parts := strings.Split(value, ",")
+		if len(parts)%2 != 0 {
+			return nil, fmt.Errorf("%q is not a valid object; it must have a value for every property", value)
+		}
+		properties := map[string]interface{}{}
+		for i := 0; i < len(parts); i += 2 {
+			propertyName, propertyValue := strings.TrimSpace(parts[i]), strings.TrimSpace(parts[i+1])
+			propertySchema, hasPropertySchema := schema.Properties[propertyName]
+			if !hasPropertySchema || propertySchema.Value == nil {
+				properties[propertyName] = propertyValue
+				continue
+			}
+			decodedProperty, err := decodeHeaderValue(propertyValue, propertySchema.Value)
+			if err != nil {
+				return nil, err
+			}
+			properties[propertyName] = decodedProperty
+		}
+		return properties, nil
+
+	case "integer", "number":
+		number, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not a valid %s", value, schema.Type)
+		}
+		return number, nil
+
+	case "boolean":
+		boolean, err := strconv.ParseBool(strings.TrimSpace(value))
+		if err != nil {
+			return nil, fmt.Errorf("%q is not a valid boolean", value)
+		}
+		return boolean, nil
+
+	default:
+		return value, nil
+	}
+}
@@ -0,0 +1,277 @@
+package firetail
+
+import (
+	"bufio"
+	"bytes"
+	"mime"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// responseWriter is the http.ResponseWriter the Firetail middleware passes down the chain. By default it buffers the response so that it can
+// be validated before it's written to the underlying ResponseWriter. If the response is to be streamed, writes are instead passed straight
+// through to the underlying ResponseWriter as they happen, and only a bounded prefix of the body is kept for logging
+type responseWriter struct {
+	underlying             http.ResponseWriter // The ResponseWriter given to the middleware, to which the response is ultimately written
+	header                 http.Header         // The headers set on the response
+	writtenHeader          http.Header         // If the response is streamed, a snapshot of the headers taken when they were sent
+	statusCode             int                 // The status code of the response; defaults to 200 if WriteHeader is never called
+	wroteHeader            bool                // Whether WriteHeader has been called yet
+	body                   *bytes.Buffer       // The response body; if the response is streamed, this only holds up to maxStreamedBodyLogSize bytes
+	streamAll              bool                // If true, the response will be streamed regardless of its Content-Type
+	streamingContentTypes  []string            // Media types for which the response will be streamed
+	streaming              bool                // Whether the response is being streamed through to the underlying ResponseWriter
+	bytesWritten           int64               // The total number of bytes written to the response body
+	hijacked               bool                // Whether the underlying connection has been hijacked, in which case there's no response to write
+	maxStreamedBodyLogSize int                 // The maximum number of bytes of a streamed response's body to hold onto for logging
+}
+
+func newResponseWriter(underlying http.ResponseWriter, streamingContentTypes []string, maxStreamedBodyLogSize int) *responseWriter {
+	return &responseWriter{
+		underlying:             underlying,
+		header:                 http.Header{},
+		statusCode:             http.StatusOK,
+		body:                   &bytes.Buffer{},
+		streamingContentTypes:  streamingContentTypes,
+		maxStreamedBodyLogSize: maxStreamedBodyLogSize,
+	}
+}
+
+func (w *responseWriter) Header() http.Header {
+	return w.header
+}
+
+// WriteHeader records the status code of the response. If the response should be streamed, the headers & status code are immediately
+// written to the underlying ResponseWriter
+func (w *responseWriter) WriteHeader(statusCode int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	w.statusCode = statusCode
+
+	if !w.streamAll && !w.hasStreamingContentType() {
+		return
+	}
+	w.streaming = true
+	// Once a streamed response's headers are sent, like net/http we ignore any changes made to them. Buffered responses aren't sent until
+	// the handler returns, so any headers set before then are still sent with them
+	w.writtenHeader = w.header.Clone()
+	for key, vals := range w.writtenHeader {
+		for _, val := range vals {
+			w.underlying.Header().Add(key, val)
+		}
+	}
+	w.underlying.WriteHeader(statusCode)
+}
+
+// Write buffers the bytes given to it, or passes them through to the underlying ResponseWriter if the response is being streamed
+func (w *responseWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+
+	if !w.streaming {
+		n, err := w.body.Write(b)
+		w.bytesWritten += int64(n)
+		return n, err
+	}
+
+	if remaining := w.maxStreamedBodyLogSize - w.body.Len(); remaining > 0 {
+		if len(b) < remaining {
+			remaining = len(b)
+		}
+		w.body.Write(b[:remaining])
+	}
+	n, err := w.underlying.Write(b)
+	w.bytesWritten += int64(n)
+	return n, err
+}
+
+// Unwrap returns a ResponseWriter through which http.ResponseController can reach any features the underlying ResponseWriter supports
+// which the responseWriter doesn't expose itself, such as setting deadlines. Flushing & hijacking are routed back through the
+// responseWriter, so that buffered responses aren't flushed before they're validated & we know if the connection was hijacked
+func (w *responseWriter) Unwrap() http.ResponseWriter {
+	return controlledResponseWriter{w}
+}
+
+// sentHeader returns the headers which will be, or have been, sent with the response: if it's streamed, those set when WriteHeader was
+// called
+func (w *responseWriter) sentHeader() http.Header {
+	if w.streaming {
+		return w.writtenHeader
+	}
+	return w.header
+}
+
+// reset discards anything that has been written to the responseWriter so a different response can be written in its place, e.g. by the
+// ErrCallback if the response fails to validate. It has no effect if the response has already been streamed
+func (w *responseWriter) reset() {
+	if w.streaming {
+		return
+	}
+	w.header = http.Header{}
+	w.statusCode = http.StatusOK
+	w.wroteHeader = false
+	w.body.Reset()
+	w.bytesWritten = 0
+}
+
+// commit writes the buffered response to the underlying ResponseWriter. If the response was streamed, or the connection was hijacked,
+// there is nothing left to write
+func (w *responseWriter) commit() {
+	if w.streaming || w.hijacked {
+		return
+	}
+	for key, vals := range w.header {
+		for _, val := range vals {
+			w.underlying.Header().Add(key, val)
+		}
+	}
+	w.underlying.WriteHeader(w.statusCode)
+	w.underlying.Write(w.body.Bytes())
+}
+
+func (w *responseWriter) hasStreamingContentType() bool {
+	mediaType, _, err := mime.ParseMediaType(w.header.Get("Content-Type"))
+	if err != nil {
+		return false
+	}
+	for _, streamingContentType := range w.streamingContentTypes {
+		streamingContentType = strings.ToLower(streamingContentType)
+		if streamingContentType == mediaType {
+			return true
+		}
+		if strings.HasSuffix(streamingContentType, "/*") && strings.HasPrefix(mediaType, strings.TrimSuffix(streamingContentType, "*")) {
+			return true
+		}
+	}
+	return false
+}
+
+// flush sends any data written so far to the client if the response is being streamed. Buffered responses can't be flushed as they are yet
+// to be validated, so they will only be sent once the handler returns
+func (w *responseWriter) flush() error {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if !w.streaming {
+		return nil
+	}
+	// Like http.ResponseController, we look through any ResponseWriters the underlying ResponseWriter wraps for one we can flush
+	underlying := w.underlying
+	for {
+		switch t := underlying.(type) {
+		case interface{ FlushError() error }:
+			return t.FlushError()
+		case http.Flusher:
+			t.Flush()
+			return nil
+		case interface{ Unwrap() http.ResponseWriter }:
+			underlying = t.Unwrap()
+		default:
+			return http.ErrNotSupported
+		}
+	}
+}
+
+// hijack takes over the underlying connection, after which the middleware will no longer write any response to it
+func (w *responseWriter) hijack() (net.Conn, *bufio.ReadWriter, error) {
+	underlying := w.underlying
+	for {
+		switch t := underlying.(type) {
+		case http.Hijacker:
+			conn, readWriter, err := t.Hijack()
+			if err == nil {
+				w.hijacked = true
+			}
+			return conn, readWriter, err
+		case interface{ Unwrap() http.ResponseWriter }:
+			underlying = t.Unwrap()
+		default:
+			return nil, nil, http.ErrNotSupported
+		}
+	}
+}
+
+func (w *responseWriter) push(target string, opts *http.PushOptions) error {
+	return w.underlying.(http.Pusher).Push(target, opts)
+}
+
+type flusher struct{ w *responseWriter }
+
+func (f flusher) Flush() { f.w.flush() }
+
+// controlledResponseWriter is returned by responseWriter.Unwrap for http.ResponseController. It routes flushing & hijacking back through
+// the responseWriter, and unwraps to the underlying ResponseWriter for everything else
+type controlledResponseWriter struct{ w *responseWriter }
+
+func (c controlledResponseWriter) Header() http.Header         { return c.w.Header() }
+func (c controlledResponseWriter) Write(b []byte) (int, error) { return c.w.Write(b) }
+func (c controlledResponseWriter) WriteHeader(statusCode int)  { c.w.WriteHeader(statusCode) }
+func (c controlledResponseWriter) FlushError() error           { return c.w.flush() }
+func (c controlledResponseWriter) Unwrap() http.ResponseWriter { return c.w.underlying }
+
+func (c controlledResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) { return c.w.hijack() }
+
+type hijacker struct{ w *responseWriter }
+
+func (h hijacker) Hijack() (net.Conn, *bufio.ReadWriter, error) { return h.w.hijack() }
+
+type pusher struct{ w *responseWriter }
+
+func (p pusher) Push(target string, opts *http.PushOptions) error { return p.w.push(target, opts) }
+
+// withOptionalInterfaces returns the responseWriter wrapped such that it implements each of http.Flusher, http.Hijacker & http.Pusher only if
+// the underlying ResponseWriter does, so that handlers down the chain can still detect which of them are supported with a type assertion
+func (w *responseWriter) withOptionalInterfaces() http.ResponseWriter {
+	_, isFlusher := w.underlying.(http.Flusher)
+	_, isHijacker := w.underlying.(http.Hijacker)
+	_, isPusher := w.underlying.(http.Pusher)
+
+	switch {
+	case isFlusher && isHijacker && isPusher:
+		return struct {
+			*responseWriter
+			http.Flusher
+			http.Hijacker
+			http.Pusher
+		}{w, flusher{w}, hijacker{w}, pusher{w}}
+	case isFlusher && isHijacker:
+		return struct {
+			*responseWriter
+			http.Flusher
+			http.Hijacker
+		}{w, flusher{w}, hijacker{w}}
+	case isFlusher && isPusher:
+		return struct {
+			*responseWriter
+			http.Flusher
+			http.Pusher
+		}{w, flusher{w}, pusher{w}}
+	case isHijacker && isPusher:
+		return struct {
+			*responseWriter
+			http.Hijacker
+			http.Pusher
+		}{w, hijacker{w}, pusher{w}}
+	case isFlusher:
+		return struct {
+			*responseWriter
+			http.Flusher
+		}{w, flusher{w}}
+	case isHijacker:
+		return struct {
+			*responseWriter
+			http.Hijacker
+		}{w, hijacker{w}}
+	case isPusher:
+		return struct {
+			*responseWriter
+			http.Pusher
+		}{w, pusher{w}}
+	default:
+		return w
+	}
+}
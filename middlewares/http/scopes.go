@@ -0,0 +1,52 @@
+package firetail
+
+import (
+	"strings"
+
+	"github.com/getkin/kin-openapi/openapi3filter"
+)
+
+// EnforceScopes checks that the granted scopes include all of those which the security requirement being checked lists for the security
+// scheme, returning an ErrorAuthInsufficientScope if they don't. Auth callbacks can call it once they've verified a request's credentials
+// to enforce the scopes in the OpenAPI spec
+func EnforceScopes(ai *openapi3filter.AuthenticationInput, grantedScopes []string) error {
+	granted := map[string]bool{}
+	for _, scope := range grantedScopes {
+		granted[scope] = true
+	}
+	missingScopes := []string{}
+	for _, scope := range ai.Scopes {
+		if !granted[scope] {
+			missingScopes = append(missingScopes, scope)
+		}
+	}
+	if len(missingScopes) > 0 {
+		return ErrorAuthInsufficientScope{
+			SecuritySchemeName: ai.SecuritySchemeName,
+			RequiredScopes:     ai.Scopes,
+			MissingScopes:      missingScopes,
+		}
+	}
+	return nil
+}
+
+// getScopesFromClaim returns the scopes granted by a claim of a token, which may be a space-delimited string, as with the "scope" claim of
+// RFC8693, or an array of strings, as some identity providers use. If the claim is missing or has any other type, no scopes are returned
+func getScopesFromClaim(claims map[string]interface{}, claimName string) []string {
+	switch claim := claims[claimName].(type) {
+	case string:
+		return strings.Fields(claim)
+	case []interface{}:
+		scopes := []string{}
+		for _, scope := range claim {
+			if scope, isString := scope.(string); isString {
+				scopes = append(scopes, scope)
+			}
+		}
+		return scopes
+	case []string:
+		return claim
+	default:
+		return []string{}
+	}
+}
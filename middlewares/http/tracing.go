@@ -0,0 +1,31 @@
+package firetail
+
+import (
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracerName is the name of the OpenTelemetry tracer used by the middleware to create spans
+const tracerName = "github.com/FireTail-io/firetail-go-lib/middlewares/http"
+
+// endSpan ends a span created by the middleware. If an ErrorAtRequest is provided, it's recorded as an event on the span, & the span's
+// status is set to error
+func endSpan(span trace.Span, errAtRequest ErrorAtRequest) {
+	if errAtRequest != nil {
+		recordErrAtRequest(span, errAtRequest)
+		span.SetStatus(codes.Error, errAtRequest.Title())
+	}
+	span.End()
+}
+
+// recordErrAtRequest records an ErrorAtRequest as an event on a span, including its type (e.g. ErrorRequestBodyInvalid), status code &
+// title. It doesn't set the span's status, as a server span should only be marked as an error if the response has a 5xx status code
+func recordErrAtRequest(span trace.Span, errAtRequest ErrorAtRequest) {
+	span.AddEvent("firetail.error", trace.WithAttributes(
+		attribute.String("firetail.error.type", getErrorType(errAtRequest)),
+		attribute.Int("firetail.error.status_code", errAtRequest.StatusCode()),
+		attribute.String("firetail.error.title", errAtRequest.Title()),
+		attribute.String("exception.message", errAtRequest.Error()),
+	))
+}